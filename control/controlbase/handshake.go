@@ -66,6 +66,36 @@ func protocolVersionPrologue(version uint16) []byte {
 // message and a continuation, we can embed the handshake initiation
 // into the HTTP protocol switching request and avoid a bit of delay.
 func ClientDeferred(machineKey key.MachinePrivate, controlKey key.MachinePublic, protocolVersion uint16) (initialHandshake []byte, continueHandshake HandshakeContinuation, err error) {
+	return ClientDeferredSigner(privateKeySigner{machineKey}, controlKey, protocolVersion)
+}
+
+// MachineKeySigner performs the operations with the machine private key that
+// the client side of the handshake needs, so that the private key itself
+// needn't be in process memory (for instance, if it's held in a hardware
+// security module).
+type MachineKeySigner interface {
+	// Public returns the machine public key.
+	Public() key.MachinePublic
+
+	// SharedSecret returns X25519(priv, peer), where priv is the machine
+	// private key.
+	SharedSecret(peer key.MachinePublic) ([]byte, error)
+}
+
+// privateKeySigner is a MachineKeySigner for a machine key held in memory.
+type privateKeySigner struct {
+	k key.MachinePrivate
+}
+
+func (s privateKeySigner) Public() key.MachinePublic { return s.k.Public() }
+
+func (s privateKeySigner) SharedSecret(peer key.MachinePublic) ([]byte, error) {
+	return curve25519.X25519(s.k.UntypedBytes(), peer.UntypedBytes())
+}
+
+// ClientDeferredSigner is like ClientDeferred, but uses signer for the
+// operations with the machine private key.
+func ClientDeferredSigner(signer MachineKeySigner, controlKey key.MachinePublic, protocolVersion uint16) (initialHandshake []byte, continueHandshake HandshakeContinuation, err error) {
 	var s symmetricState
 	s.Initialize()
 
@@ -86,16 +116,16 @@ func ClientDeferred(machineKey key.MachinePrivate, controlKey key.MachinePublic,
 	if err != nil {
 		return nil, nil, fmt.Errorf("computing es: %w", err)
 	}
-	machineKeyPub := machineKey.Public()
+	machineKeyPub := signer.Public()
 	s.EncryptAndHash(cipher, init.MachinePub(), machineKeyPub.UntypedBytes())
-	cipher, err = s.MixDH(machineKey, controlKey)
+	cipher, err = s.MixSignerDH(signer, controlKey)
 	if err != nil {
 		return nil, nil, fmt.Errorf("computing ss: %w", err)
 	}
 	s.EncryptAndHash(cipher, init.Tag(), nil) // empty message payload
 
 	cont := func(ctx context.Context, conn net.Conn) (*Conn, error) {
-		return continueClientHandshake(ctx, conn, &s, machineKey, machineEphemeral, controlKey, protocolVersion)
+		return continueClientHandshake(ctx, conn, &s, signer, machineEphemeral, controlKey, protocolVersion)
 	}
 	return init[:], cont, nil
 }
@@ -117,7 +147,7 @@ func Client(ctx context.Context, conn net.Conn, machineKey key.MachinePrivate, c
 	return cont(ctx, conn)
 }
 
-func continueClientHandshake(ctx context.Context, conn net.Conn, s *symmetricState, machineKey, machineEphemeral key.MachinePrivate, controlKey key.MachinePublic, protocolVersion uint16) (*Conn, error) {
+func continueClientHandshake(ctx context.Context, conn net.Conn, s *symmetricState, signer MachineKeySigner, machineEphemeral key.MachinePrivate, controlKey key.MachinePublic, protocolVersion uint16) (*Conn, error) {
 	// No matter what, this function can only run once per s. Ensure
 	// attempted reuse causes a panic.
 	defer func() {
@@ -161,7 +191,7 @@ func continueClientHandshake(ctx context.Context, conn net.Conn, s *symmetricSta
 	if _, err := s.MixDH(machineEphemeral, controlEphemeralPub); err != nil {
 		return nil, fmt.Errorf("computing ee: %w", err)
 	}
-	cipher, err := s.MixDH(machineKey, controlEphemeralPub)
+	cipher, err := s.MixSignerDH(signer, controlEphemeralPub)
 	if err != nil {
 		return nil, fmt.Errorf("computing se: %w", err)
 	}
@@ -372,7 +402,22 @@ func (s *symmetricState) MixDH(priv key.MachinePrivate, pub key.MachinePublic) (
 	if err != nil {
 		return nil, fmt.Errorf("computing X25519: %w", err)
 	}
+	return s.mixKey(keyData)
+}
+
+// MixSignerDH is like MixDH, but with the private key held by signer.
+func (s *symmetricState) MixSignerDH(signer MachineKeySigner, pub key.MachinePublic) (*singleUseCHP, error) {
+	s.checkFinished()
+	keyData, err := signer.SharedSecret(pub)
+	if err != nil {
+		return nil, fmt.Errorf("computing X25519: %w", err)
+	}
+	return s.mixKey(keyData)
+}
 
+// mixKey updates s.ck with keyData, the result of a Diffie-Hellman
+// operation, and returns a singleUseCHP for the derived key.
+func (s *symmetricState) mixKey(keyData []byte) (*singleUseCHP, error) {
 	r := hkdf.New(newBLAKE2s, keyData, s.ck[:], nil)
 	if _, err := io.ReadFull(r, s.ck[:]); err != nil {
 		return nil, fmt.Errorf("extracting ck: %w", err)
@@ -6,6 +6,7 @@
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"strings"
 	"testing"
@@ -55,6 +56,69 @@ func TestHandshake(t *testing.T) {
 	}
 }
 
+// testSigner is a MachineKeySigner that counts its uses and can be made to
+// fail.
+type testSigner struct {
+	k     key.MachinePrivate
+	err   error
+	calls int
+}
+
+func (s *testSigner) Public() key.MachinePublic { return s.k.Public() }
+
+func (s *testSigner) SharedSecret(peer key.MachinePublic) ([]byte, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return privateKeySigner{s.k}.SharedSecret(peer)
+}
+
+func TestHandshakeSigner(t *testing.T) {
+	var (
+		clientConn, serverConn = memnet.NewConn("noise", 128000)
+		serverKey              = key.NewMachine()
+		signer                 = &testSigner{k: key.NewMachine()}
+		server                 *Conn
+		serverErr              = make(chan error, 1)
+	)
+	go func() {
+		var err error
+		server, err = Server(context.Background(), serverConn, serverKey, nil)
+		serverErr <- err
+	}()
+
+	init, cont, err := ClientDeferredSigner(signer, serverKey.Public(), testProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientConn.Write(init); err != nil {
+		t.Fatal(err)
+	}
+	client, err := cont(context.Background(), clientConn)
+	if err != nil {
+		t.Fatalf("client connection failed: %v", err)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatalf("server connection failed: %v", err)
+	}
+	if client.HandshakeHash() != server.HandshakeHash() {
+		t.Fatal("client and server disagree on handshake hash")
+	}
+	if server.Peer() != signer.Public() {
+		t.Fatal("server peer key isn't the signer's key")
+	}
+	// ss and se.
+	if signer.calls != 2 {
+		t.Errorf("signer used %d times; want 2", signer.calls)
+	}
+
+	signer.err = errors.New("hsm unavailable")
+	if _, _, err := ClientDeferredSigner(signer, serverKey.Public(), testProtocolVersion); !errors.Is(err, signer.err) {
+		t.Errorf("ClientDeferredSigner with failing signer: got error %v; want %v", err, signer.err)
+	}
+}
+
 // Check that handshaking repeatedly with the same long-term keys
 // result in different handshake hashes and wire traffic.
 func TestNoReuse(t *testing.T) {
@@ -0,0 +1,98 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+var (
+	// ErrAuthKeyInvalid is returned (wrapped) by Direct.LoginWithAuthKey
+	// when control rejects the auth key as unknown or malformed.
+	ErrAuthKeyInvalid = errors.New("invalid auth key")
+
+	// ErrAuthKeyExpired is returned (wrapped) by Direct.LoginWithAuthKey
+	// when control rejects the auth key because it has expired.
+	ErrAuthKeyExpired = errors.New("auth key expired")
+)
+
+// authPollInterval is how often LoginWithAuthKey polls control while waiting
+// for the node to be authorized.
+const authPollInterval = 5 * time.Second
+
+// LoginWithAuthKey registers the node with control using authKey (instead of
+// Options.AuthKey), waits until the node is authorized, and returns the
+// authorized self node. It's meant for short-lived tools that just want to
+// authenticate once, rather than running the usual login flow.
+//
+// If the tailnet requires devices to be approved, it polls control until the
+// node is approved or ctx is done.
+//
+// If control rejects the key, the error wraps the UserVisibleError from
+// control and, if the message is recognized as being about the key (see
+// authKeyError), ErrAuthKeyInvalid or ErrAuthKeyExpired.
+func (c *Direct) LoginWithAuthKey(ctx context.Context, authKey string) (*tailcfg.Node, error) {
+	if authKey == "" {
+		return nil, fmt.Errorf("%w: empty", ErrAuthKeyInvalid)
+	}
+	c.logf("[v1] direct.LoginWithAuthKey")
+	url, err := c.doLoginOrRegen(ctx, loginOpt{AuthKey: authKey})
+	if err != nil {
+		return nil, authKeyError(err)
+	}
+	if url != "" {
+		return nil, fmt.Errorf("control requires interactive login at %v", url)
+	}
+
+	for {
+		nm, err := c.fetchNetMap(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if nm.SelfNode.Valid() && nm.SelfNode.MachineAuthorized() {
+			return nm.SelfNode.AsStruct(), nil
+		}
+		c.logf("LoginWithAuthKey: waiting for node to be authorized")
+
+		t, tc := c.clock.NewTimer(authPollInterval)
+		select {
+		case <-tc:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// authKeyError returns err, a login error, wrapping ErrAuthKeyExpired or
+// ErrAuthKeyInvalid if it's control rejecting the auth key.
+//
+// This is a heuristic: RegisterResponse carries only a human-readable
+// Error, with no code saying why registration failed, so the message is
+// matched against the wording control uses for auth key rejections. Errors
+// it doesn't recognize, including those about the key for other reasons,
+// are returned unchanged.
+func authKeyError(err error) error {
+	var uerr UserVisibleError
+	if !errors.As(err, &uerr) {
+		return err
+	}
+	msg := strings.ToLower(string(uerr))
+	if !strings.Contains(msg, "key") {
+		return err
+	}
+	switch {
+	case strings.Contains(msg, "expired"):
+		return fmt.Errorf("%w: %w", ErrAuthKeyExpired, err)
+	case strings.Contains(msg, "invalid"), strings.Contains(msg, "not found"), strings.Contains(msg, "not valid"):
+		return fmt.Errorf("%w: %w", ErrAuthKeyInvalid, err)
+	}
+	return err
+}
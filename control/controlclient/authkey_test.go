@@ -0,0 +1,98 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestLoginWithAuthKey(t *testing.T) {
+	srv := newTestMapServer(t)
+	clk := newRetryClock()
+	c := srv.newDirect(Options{Clock: clk})
+
+	// Control authorizes the node on the second poll.
+	var polls atomic.Int32
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		n := polls.Add(1)
+		send(&tailcfg.MapResponse{
+			Node: &tailcfg.Node{ID: 1, Name: "foo.example.ts.net.", MachineAuthorized: n >= 2},
+		})
+	})
+
+	var node *tailcfg.Node
+	var err error
+	timers := clk.run(func() {
+		node, err = c.LoginWithAuthKey(context.Background(), "tskey-auth-test")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.ID != 1 || !node.MachineAuthorized {
+		t.Errorf("got node %+v; want authorized node 1", node)
+	}
+	if n := polls.Load(); n != 2 {
+		t.Errorf("polled %d times; want 2", n)
+	}
+	if want := []time.Duration{authPollInterval}; !reflect.DeepEqual(timers, want) {
+		t.Errorf("waited %v; want %v", timers, want)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.regReqs) != 1 {
+		t.Fatalf("got %d register requests; want 1", len(srv.regReqs))
+	}
+	if auth := srv.regReqs[0].Auth; auth == nil || auth.AuthKey != "tskey-auth-test" {
+		t.Errorf("RegisterRequest.Auth = %+v; want the auth key", auth)
+	}
+}
+
+func TestLoginWithAuthKeyErrors(t *testing.T) {
+	tests := []struct {
+		regErr  string
+		wantErr error // or nil for neither ErrAuthKeyInvalid nor ErrAuthKeyExpired
+	}{
+		{"invalid key: unable to validate API key", ErrAuthKeyInvalid},
+		{"auth key not found", ErrAuthKeyInvalid},
+		{"authkey expired", ErrAuthKeyExpired},
+		{"invalid key: key expired", ErrAuthKeyExpired},
+		{"node limit reached", nil},
+		{"node expired", nil},            // not about the key
+		{"auth key reuse disabled", nil}, // about the key, but unrecognized
+	}
+	for _, tt := range tests {
+		t.Run(tt.regErr, func(t *testing.T) {
+			srv := newTestMapServer(t)
+			srv.regErr = tt.regErr
+			c := srv.newDirect(Options{})
+
+			_, err := c.LoginWithAuthKey(context.Background(), "tskey-auth-test")
+			var uerr UserVisibleError
+			if !errors.As(err, &uerr) || string(uerr) != tt.regErr {
+				t.Fatalf("got error %v; want UserVisibleError %q", err, tt.regErr)
+			}
+			for _, e := range []error{ErrAuthKeyInvalid, ErrAuthKeyExpired} {
+				if got, want := errors.Is(err, e), e == tt.wantErr; got != want {
+					t.Errorf("errors.Is(%v, %v) = %v; want %v", err, e, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthKeyErrorNotFromControl(t *testing.T) {
+	err := fmt.Errorf("register request: %w", errors.New("invalid key: connection reset"))
+	if got := authKeyError(err); got != err {
+		t.Errorf("authKeyError(%v) = %v; want it unchanged", err, got)
+	}
+}
@@ -49,11 +49,19 @@ func (c *Auto) waitUnpause(routineLogName string) (keepRunning bool) {
 	return <-unpaused
 }
 
+// newBackoff returns a new backoff timer for retrying requests to control,
+// scaled by the current connection type (see Options.BackoffScaleFunc).
+func (c *Auto) newBackoff(name string) *backoff.Backoff {
+	bo := backoff.NewBackoff(name, c.logf, 30*time.Second)
+	bo.Scale = c.direct.backoffScale
+	return bo
+}
+
 // updateRoutine is responsible for informing the server of worthy changes to
 // our local state. It runs in its own goroutine.
 func (c *Auto) updateRoutine() {
 	defer close(c.updateDone)
-	bo := backoff.NewBackoff("updateRoutine", c.logf, 30*time.Second)
+	bo := c.newBackoff("updateRoutine")
 
 	// lastUpdateGenInformed is the value of lastUpdateAt that we've successfully
 	// informed the server of.
@@ -122,6 +130,9 @@ type Auto struct {
 
 	unregisterHealthWatch func()
 
+	maxSessionDuration time.Duration // or zero for no limit
+	onSessionExpired   func()        // or nil
+
 	mu sync.Mutex // mutex guards the following fields
 
 	wantLoggedIn bool   // whether the user wants to be logged in per last method call
@@ -139,6 +150,10 @@ type Auto struct {
 	inMapPoll      bool        // true once we get the first MapResponse in a stream; false when HTTP response ends
 	state          State       // TODO(bradfitz): delete this, make it computed by method from other state
 
+	// sessionTimer, if non-nil, starts a re-login when the current login
+	// session reaches maxSessionDuration.
+	sessionTimer tstime.TimerController
+
 	authCtx    context.Context // context used for auth requests
 	mapCtx     context.Context // context used for netmap and update requests
 	authCancel func()          // cancel authCtx
@@ -187,6 +202,9 @@ func NewNoStart(opts Options) (_ *Auto, err error) {
 		mapDone:    make(chan struct{}),
 		updateDone: make(chan struct{}),
 		observer:   opts.Observer,
+
+		maxSessionDuration: opts.MaxSessionDuration,
+		onSessionExpired:   opts.OnSessionExpired,
 	}
 	c.authCtx, c.authCancel = context.WithCancel(context.Background())
 	c.authCtx = sockstats.WithSockStats(c.authCtx, sockstats.LabelControlClientAuto, opts.Logf)
@@ -195,6 +213,14 @@ func NewNoStart(opts Options) (_ *Auto, err error) {
 	c.mapCtx = sockstats.WithSockStats(c.mapCtx, sockstats.LabelControlClientAuto, opts.Logf)
 
 	c.unregisterHealthWatch = opts.HealthTracker.RegisterWatcher(direct.ReportHealthChange)
+
+	// Send the new NetInfo.LinkType to control when the connection type changes.
+	direct.mu.Lock()
+	direct.onConnTypeChanged = c.updateControl
+	// Withdraw or send our endpoints when control disables or re-enables
+	// the data plane.
+	direct.onDataPlaneChanged = c.updateControl
+	direct.mu.Unlock()
 	return c, nil
 
 }
@@ -288,7 +314,7 @@ func (c *Auto) restartMap() {
 
 func (c *Auto) authRoutine() {
 	defer close(c.authDone)
-	bo := backoff.NewBackoff("authRoutine", c.logf, 30*time.Second)
+	bo := c.newBackoff("authRoutine")
 
 	for {
 		if !c.waitUnpause("authRoutine") {
@@ -383,6 +409,7 @@ func (c *Auto) authRoutine() {
 		c.loggedIn = true
 		c.loginGoal = nil
 		c.state = StateAuthenticated
+		c.startSessionTimerLocked()
 		c.mu.Unlock()
 
 		c.sendStatus("authRoutine-success", nil, "", nil)
@@ -391,6 +418,51 @@ func (c *Auto) authRoutine() {
 	}
 }
 
+// startSessionTimerLocked (re)starts the timer limiting the login session that
+// just began to maxSessionDuration, if set. c.mu must be held.
+func (c *Auto) startSessionTimerLocked() {
+	c.stopSessionTimerLocked()
+	if c.maxSessionDuration <= 0 || c.closed {
+		return
+	}
+	c.sessionTimer = c.clock.AfterFunc(c.maxSessionDuration, c.expireSession)
+}
+
+// stopSessionTimerLocked stops the session timer, if any. c.mu must be held.
+func (c *Auto) stopSessionTimerLocked() {
+	if c.sessionTimer != nil {
+		c.sessionTimer.Stop()
+		c.sessionTimer = nil
+	}
+}
+
+// expireSession is called when the login session reaches maxSessionDuration.
+// It starts an interactive re-login, as Login does, and notifies the
+// OnSessionExpired callback.
+func (c *Auto) expireSession() {
+	flags := LoginInteractive
+	if c.direct.IsEphemeral() {
+		flags |= LoginEphemeral
+	}
+
+	c.mu.Lock()
+	c.sessionTimer = nil
+	if c.closed || !c.loggedIn || c.loginGoal != nil {
+		// Shut down, logged out, or already logging in again.
+		c.mu.Unlock()
+		return
+	}
+	c.loginGoal = &LoginGoal{flags: flags}
+	c.cancelMapCtxLocked()
+	c.cancelAuthCtxLocked()
+	c.mu.Unlock()
+
+	c.logf("login session reached max duration %v; logging in again", c.maxSessionDuration)
+	if c.onSessionExpired != nil {
+		c.onSessionExpired()
+	}
+}
+
 // ExpiryForTests returns the credential expiration time, or the zero value if
 // the expiration time isn't known. It's used in tests only.
 func (c *Auto) ExpiryForTests() time.Time {
@@ -472,7 +544,7 @@ func (c *Auto) mapRoutine() {
 	defer close(c.mapDone)
 	mrs := mapRoutineState{
 		c:  c,
-		bo: backoff.NewBackoff("mapRoutine", c.logf, 30*time.Second),
+		bo: c.newBackoff("mapRoutine"),
 	}
 
 	for {
@@ -553,11 +625,23 @@ func (c *Auto) SetHostinfo(hi *tailcfg.Hostinfo) {
 	c.updateControl()
 }
 
+// UpdateHostinfo updates the Hostinfo in place (see Direct.UpdateHostinfo)
+// and sends the new Hostinfo to control if it changed.
+func (c *Auto) UpdateHostinfo(f func(*tailcfg.Hostinfo)) {
+	if !c.direct.UpdateHostinfo(f) {
+		return
+	}
+	c.updateControl()
+}
+
 func (c *Auto) SetNetInfo(ni *tailcfg.NetInfo) {
 	if ni == nil {
 		panic("nil NetInfo")
 	}
-	if !c.direct.SetNetInfo(ni) {
+	// A network change is also a good hint that the node may have moved to
+	// another time zone.
+	tzChanged := c.direct.RefreshTimeZone()
+	if !c.direct.SetNetInfo(ni) && !tzChanged {
 		return
 	}
 
@@ -565,6 +649,33 @@ func (c *Auto) SetNetInfo(ni *tailcfg.NetInfo) {
 	c.updateControl()
 }
 
+// RefreshFirewallMode re-evaluates the firewall mode reported in NetInfo and
+// sends the new NetInfo to control if it changed.
+func (c *Auto) RefreshFirewallMode() {
+	if !c.direct.RefreshFirewallMode() {
+		return
+	}
+	c.updateControl()
+}
+
+// RefreshTimeZone re-evaluates the local time zone reported in Hostinfo and
+// sends the new Hostinfo to control if it changed.
+func (c *Auto) RefreshTimeZone() {
+	if !c.direct.RefreshTimeZone() {
+		return
+	}
+	c.updateControl()
+}
+
+// SetAcceptDNS updates whether the node uses the DNS configuration from
+// control and sends the new Hostinfo to control if it changed.
+func (c *Auto) SetAcceptDNS(v bool) {
+	if !c.direct.SetAcceptDNS(v) {
+		return
+	}
+	c.updateControl()
+}
+
 // SetTKAHead updates the TKA head hash that map-request infrastructure sends.
 func (c *Auto) SetTKAHead(headHash string) {
 	if !c.direct.SetTKAHead(headHash) {
@@ -575,6 +686,27 @@ func (c *Auto) SetTKAHead(headHash string) {
 	c.updateControl()
 }
 
+// SetTKAKey updates the node's tailnet lock signing key reported in Hostinfo
+// and sends the new Hostinfo to control if it changed.
+func (c *Auto) SetTKAKey(k key.NLPublic) {
+	if !c.direct.SetTKAKey(k) {
+		return
+	}
+	c.updateControl()
+}
+
+// SetUsingExitNode updates the exit node reported in Hostinfo (see
+// Direct.SetUsingExitNode) and sends the new Hostinfo to control if it
+// changed.
+func (c *Auto) SetUsingExitNode(id tailcfg.NodeID) error {
+	changed, err := c.direct.SetUsingExitNode(id)
+	if err != nil || !changed {
+		return err
+	}
+	c.updateControl()
+	return nil
+}
+
 // sendStatus can not be called with the c.mu held.
 func (c *Auto) sendStatus(who string, err error, url string, nm *netmap.NetworkMap) {
 	c.mu.Lock()
@@ -639,6 +771,7 @@ func (c *Auto) Logout(ctx context.Context) error {
 	c.mu.Lock()
 	c.wantLoggedIn = false
 	c.loginGoal = nil
+	c.stopSessionTimerLocked()
 	closed := c.closed
 	if c.direct != nil && c.direct.panicOnUse {
 		panic("tainted client")
@@ -673,9 +806,16 @@ func (c *Auto) SetExpirySooner(ctx context.Context, expiry time.Time) error {
 // It does not retain the provided slice.
 func (c *Auto) UpdateEndpoints(endpoints []tailcfg.Endpoint) {
 	changed := c.direct.SetEndpoints(endpoints)
-	if changed {
-		c.updateControl()
+	if !changed {
+		return
 	}
+	// Control (or Options.EndpointPushMinInterval) may ask us to report
+	// endpoints less often. If so, they're sent (along with any later
+	// changes, including from Direct.PushEndpoints) once it allows.
+	c.direct.reportEndpoints(context.Background(), func(context.Context) error {
+		c.updateControl()
+		return nil
+	})
 }
 
 func (c *Auto) Shutdown() {
@@ -695,6 +835,7 @@ func (c *Auto) Shutdown() {
 		w <- false
 	}
 	c.unpauseWaiters = nil
+	c.stopSessionTimerLocked()
 	c.mu.Unlock()
 
 	c.unregisterHealthWatch()
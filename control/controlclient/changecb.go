@@ -0,0 +1,35 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import "tailscale.com/tailcfg"
+
+// peerChanges are the peer changes applied from a single MapResponse, as
+// passed to mapSession.onPeersUpdated.
+type peerChanges struct {
+	ok      bool // whether any peers changed
+	full    bool
+	changed []tailcfg.NodeView
+	removed []tailcfg.NodeID
+}
+
+// notifyChanges calls the change callbacks from Options for resp, which has
+// been fully applied, in a fixed order: OnDERPMapChange, OnDNSConfigChange,
+// then OnPeersChanged. Each is only called if resp changed what it reports.
+//
+// It's called from the map poll goroutine after HandleNonKeepAliveMapResponse
+// returns, so that Direct's state (such as its peers, user profiles and the
+// netmap seen by DumpNetMap) already reflects resp, and before the next
+// response is processed.
+func (c *Direct) notifyChanges(resp *tailcfg.MapResponse, pc peerChanges) {
+	if dm := resp.DERPMap; dm != nil && c.onDERPMapChange != nil {
+		c.onDERPMapChange(dm.View())
+	}
+	if dc := resp.DNSConfig; dc != nil && c.onDNSConfigChange != nil {
+		c.onDNSConfigChange(dc.View())
+	}
+	if pc.ok && c.onPeersChanged != nil {
+		c.onPeersChanged(pc.full, pc.changed, pc.removed)
+	}
+}
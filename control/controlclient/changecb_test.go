@@ -0,0 +1,86 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"reflect"
+	"testing"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func TestChangeCallbacksOrderAndState(t *testing.T) {
+	srv := newTestMapServer(t)
+	derpMap := func(regionID int) *tailcfg.DERPMap {
+		return &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+			regionID: {RegionID: regionID, RegionCode: "r", Nodes: []*tailcfg.DERPNode{{Name: "n", RegionID: regionID}}},
+		}}
+	}
+	peer := func(id tailcfg.NodeID, user tailcfg.UserID) *tailcfg.Node {
+		return &tailcfg.Node{ID: id, Key: key.NewNode().Public(), Addresses: testPeerAddresses(id), User: user}
+	}
+
+	var c *Direct
+	var events []string
+	checkf := func(ok bool, format string, args ...any) {
+		if !ok {
+			t.Errorf(format, args...)
+		}
+	}
+	c = srv.newDirect(Options{
+		OnDERPMapChange: func(dm tailcfg.DERPMapView) {
+			events = append(events, "derp")
+			nm := c.currentNetMap()
+			checkf(nm != nil && reflect.DeepEqual(nm.DERPMap, dm.AsStruct()), "in OnDERPMapChange, netmap DERP map not yet updated")
+		},
+		OnDNSConfigChange: func(dc tailcfg.DNSConfigView) {
+			events = append(events, "dns")
+			nm := c.currentNetMap()
+			checkf(nm != nil && reflect.DeepEqual(nm.DNS, *dc.AsStruct()), "in OnDNSConfigChange, netmap DNS config not yet updated")
+		},
+		OnPeersChanged: func(full bool, changed []tailcfg.NodeView, removed []tailcfg.NodeID) {
+			events = append(events, "peers")
+			checkf(c.VisiblePeerCount() == len(c.currentNetMap().Peers), "in OnPeersChanged, peer count mismatch")
+			for _, n := range changed {
+				_, ok := c.PeerTags(n.ID())
+				checkf(ok, "in OnPeersChanged, changed peer %v not yet known", n.ID())
+				_, ok = c.UserProfile(n.User())
+				checkf(ok, "in OnPeersChanged, user profile %v of peer %v not yet known", n.User(), n.ID())
+			}
+			for _, id := range removed {
+				_, ok := c.PeerTags(id)
+				checkf(!ok, "in OnPeersChanged, removed peer %v still known", id)
+			}
+		},
+	})
+
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{
+			Node:         &tailcfg.Node{ID: 1, User: 1},
+			Peers:        []*tailcfg.Node{peer(2, 1), peer(3, 2)},
+			DERPMap:      derpMap(1),
+			DNSConfig:    &tailcfg.DNSConfig{Domains: []string{"a.example"}},
+			UserProfiles: []tailcfg.UserProfile{{ID: 1}, {ID: 2}},
+		})
+		send(&tailcfg.MapResponse{
+			PeersChanged: []*tailcfg.Node{peer(4, 3)},
+			PeersRemoved: []tailcfg.NodeID{3},
+			DNSConfig:    &tailcfg.DNSConfig{Domains: []string{"b.example"}},
+			UserProfiles: []tailcfg.UserProfile{{ID: 3}},
+		})
+		send(&tailcfg.MapResponse{DERPMap: derpMap(2)})
+		send(&tailcfg.MapResponse{Domain: "no-callbacks.example"})
+	})
+	pollNetMap(t, c)
+
+	want := []string{
+		"derp", "dns", "peers", // full map
+		"dns", "peers", // delta with DNS and peer changes
+		"derp", // delta with just a DERP map
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("callbacks = %q; want %q", events, want)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is how to ask control to compress the MapResponses sent over
+// a map poll. See Options.Compression.
+type Compression int
+
+const (
+	// CompressionZstd asks for each MapResponse to be a zstd frame. It's
+	// the default.
+	CompressionZstd Compression = iota
+
+	// CompressionGzip asks for each MapResponse to be a gzip stream.
+	CompressionGzip
+
+	// CompressionNone asks for MapResponses to be sent uncompressed.
+	CompressionNone
+)
+
+// mapRequestCompress returns the tailcfg.MapRequest.Compress value for c.
+func (c Compression) mapRequestCompress() string {
+	switch c {
+	case CompressionGzip:
+		return "gzip"
+	case CompressionNone:
+		return ""
+	}
+	return "zstd"
+}
+
+var (
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	gzipMagic = []byte{0x1f, 0x8b}
+)
+
+// maxMapResponseSize is the largest MapResponse message that we'll read from
+// control, both as framed on the wire and once decompressed. It's a var for
+// tests.
+var maxMapResponseSize = 128 << 20
+
+// errMapResponseTooLarge is returned for a MapResponse message larger than
+// maxMapResponseSize.
+var errMapResponseTooLarge = errors.New("MapResponse message too large")
+
+// zstdDecoders pools the *zstd.Decoders used by decompressReader.
+var zstdDecoders sync.Pool
+
+// isCompressedMsg reports whether msg, a MapResponse message from control, is
+// compressed. The compression is detected from msg rather than assumed from
+// what was asked for, so that control may fall back to one it supports. JSON
+// can't start with either magic number.
+func isCompressedMsg(msg []byte) bool {
+	return bytes.HasPrefix(msg, zstdMagic) || bytes.HasPrefix(msg, gzipMagic)
+}
+
+// decompressReader returns a reader of the JSON in msg, a compressed
+// MapResponse message from control, and a func to call when done with it.
+func decompressReader(msg []byte) (_ io.Reader, done func(), _ error) {
+	if bytes.HasPrefix(msg, gzipMagic) {
+		zr, err := gzip.NewReader(bytes.NewReader(msg))
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, func() {}, nil
+	}
+	zd, _ := zstdDecoders.Get().(*zstd.Decoder)
+	if zd == nil {
+		var err error
+		zd, err = zstd.NewReader(nil,
+			zstd.WithDecoderConcurrency(1), // decode synchronously, as read
+			zstd.WithDecoderLowmem(true),
+			// Otherwise small inputs are decoded whole, which is what
+			// streaming is avoiding.
+			zstd.WithDecodeBuffersBelow(0),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := zd.Reset(bytes.NewReader(msg)); err != nil {
+		return nil, nil, err
+	}
+	return zd, func() {
+		zd.Reset(nil)
+		zstdDecoders.Put(zd)
+	}, nil
+}
+
+// decompressMsg returns the JSON of msg, a MapResponse message from control.
+func decompressMsg(msg []byte) ([]byte, error) {
+	if !isCompressedMsg(msg) {
+		return msg, nil
+	}
+	r, done, err := decompressReader(msg)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	b, err := io.ReadAll(io.LimitReader(r, int64(maxMapResponseSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxMapResponseSize {
+		return nil, errMapResponseTooLarge
+	}
+	return b, nil
+}
+
+// decodeCompressedMsg unmarshals msg, a compressed MapResponse message from
+// control, into v as it's decompressed, without holding all of the JSON.
+func decodeCompressedMsg(msg []byte, v any) error {
+	r, done, err := decompressReader(msg)
+	if err != nil {
+		return err
+	}
+	defer done()
+	zr := &zeroEscapeReader{r: r}
+	defer func() {
+		if zr.found {
+			log.Printf("[unexpected] zero byte in controlclient.Direct.decodeMsg into %T", v)
+		}
+	}()
+	lr := &io.LimitedReader{R: zr, N: int64(maxMapResponseSize) + 1}
+	dec := json.NewDecoder(lr)
+	if err := dec.Decode(v); err != nil {
+		if lr.N == 0 {
+			return errMapResponseTooLarge
+		}
+		return fmt.Errorf("response: %v", err)
+	}
+	if dec.More() {
+		return fmt.Errorf("response: trailing data after %T", v)
+	}
+	// Read to the end so that the checksum is verified.
+	if _, err := io.Copy(io.Discard, lr); err != nil {
+		return err
+	}
+	if lr.N == 0 {
+		return errMapResponseTooLarge
+	}
+	return nil
+}
+
+// zeroEscapeReader reads from r, noting whether the JSON read contains an
+// escaped zero byte (jsonEscapedZero), including one split across reads.
+type zeroEscapeReader struct {
+	r     io.Reader
+	tail  []byte // the last bytes read, up to len(jsonEscapedZero)-1
+	found bool
+}
+
+func (z *zeroEscapeReader) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+	if n > 0 && !z.found {
+		k := len(jsonEscapedZero) - 1
+		edge := append(z.tail, p[:min(n, k)]...)
+		z.found = bytes.Contains(edge, jsonEscapedZero) || bytes.Contains(p[:n], jsonEscapedZero)
+		if n >= k {
+			z.tail = append(z.tail[:0], p[n-k:n]...)
+		} else {
+			z.tail = append(z.tail[:0], edge[max(0, len(edge)-k):]...)
+		}
+	}
+	return n, err
+}
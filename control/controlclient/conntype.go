@@ -0,0 +1,121 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"time"
+
+	"tailscale.com/tstime"
+)
+
+// connTypeDebounce is how long a new connection type must persist before
+// it's reported, so that brief flaps during handoffs (e.g. between Wi-Fi and
+// cellular) aren't.
+const connTypeDebounce = 5 * time.Second
+
+// connTypeState is the connection type state of a Direct, guarded by
+// Direct.mu.
+type connTypeState struct {
+	cur     string                 // reported in NetInfo.LinkType
+	pending string                 // candidate new value, if timer is non-nil
+	timer   tstime.TimerController // or nil if no change is pending
+}
+
+// connectionType returns the current coarse connection type from
+// Options.ConnectionTypeFunc, or the empty string if it's unknown.
+func (c *Direct) connectionType() string {
+	if c.connTypeFunc == nil {
+		return ""
+	}
+	switch t := c.connTypeFunc(); t {
+	case "wired", "wifi", "mobile":
+		return t
+	default:
+		return ""
+	}
+}
+
+// backoffScale returns the factor from Options.BackoffScaleFunc by which to
+// scale retry backoff on the current connection type.
+func (c *Direct) backoffScale() float64 {
+	if c.backoffScaleFunc == nil {
+		return 1
+	}
+	c.mu.Lock()
+	t := c.connType.cur
+	if c.netinfo != nil {
+		t = c.netinfo.LinkType
+	}
+	c.mu.Unlock()
+	return c.backoffScaleFunc(t)
+}
+
+// UpdateConnectionType re-evaluates Options.ConnectionTypeFunc, such as after
+// a network link change. (SetNetInfo also calls it.) A new connection type is
+// only reported, in NetInfo.LinkType and to Options.OnConnectionTypeChange,
+// once it has persisted for a few seconds.
+func (c *Direct) UpdateConnectionType() {
+	if c.connTypeFunc == nil {
+		return
+	}
+	t := c.connectionType()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ct := &c.connType
+	switch {
+	case t == ct.cur:
+		// Flapped back (or never changed); cancel any pending change.
+		if ct.timer != nil {
+			ct.timer.Stop()
+			ct.timer = nil
+		}
+	case ct.timer != nil && t == ct.pending:
+		// Already waiting to report this one.
+	default:
+		if ct.timer != nil {
+			ct.timer.Stop()
+		}
+		ct.pending = t
+		ct.timer = c.clock.AfterFunc(connTypeDebounce, c.commitConnectionType)
+	}
+}
+
+// commitConnectionType is called after connTypeDebounce to report a pending
+// connection type change if it's still current.
+func (c *Direct) commitConnectionType() {
+	t := c.connectionType()
+
+	c.mu.Lock()
+	ct := &c.connType
+	if ct.timer == nil {
+		// Canceled while we were firing.
+		c.mu.Unlock()
+		return
+	}
+	ct.timer = nil
+	if t != ct.pending {
+		// Changed again while waiting. Start over with the new value.
+		c.mu.Unlock()
+		c.UpdateConnectionType()
+		return
+	}
+	old := ct.cur
+	ct.cur = t
+	if c.netinfo != nil {
+		ni := c.netinfo.Clone()
+		ni.LinkType = t
+		c.netinfo = ni
+	}
+	changed := c.onConnTypeChanged
+	c.mu.Unlock()
+
+	c.logf("connection type changed from %q to %q", old, t)
+	if changed != nil {
+		changed()
+	}
+	if c.onConnTypeChange != nil {
+		c.onConnTypeChange(old, t)
+	}
+}
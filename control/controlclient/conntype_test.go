@@ -0,0 +1,148 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/logtail/backoff"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
+	"tailscale.com/tstime"
+)
+
+func TestConnectionType(t *testing.T) {
+	clk := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1000, 0)})
+	srv := newTestMapServer(t)
+	connType := "wifi"
+	var changes [][2]string
+	c := srv.newDirect(Options{
+		Clock:                  clk,
+		ConnectionTypeFunc:     func() string { return connType },
+		OnConnectionTypeChange: func(old, new string) { changes = append(changes, [2]string{old, new}) },
+	})
+	c.SetNetInfo(&tailcfg.NetInfo{PreferredDERP: 1})
+
+	wantLinkType := func(want string) {
+		t.Helper()
+		if err := c.SendUpdate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := srv.lastRequest().Hostinfo.NetInfo.LinkType; got != want {
+			t.Errorf("NetInfo.LinkType = %q; want %q", got, want)
+		}
+	}
+	wantChanges := func(want ...[2]string) {
+		t.Helper()
+		if !reflect.DeepEqual(changes, want) {
+			t.Errorf("OnConnectionTypeChange calls = %q; want %q", changes, want)
+		}
+	}
+	wantLinkType("wifi")
+
+	// Wi-Fi to cellular, reported once the debounce period has passed.
+	connType = "mobile"
+	c.UpdateConnectionType()
+	clk.Advance(connTypeDebounce - time.Second)
+	wantChanges()
+	wantLinkType("wifi")
+	clk.Advance(time.Second)
+	wantChanges([2]string{"wifi", "mobile"})
+	wantLinkType("mobile")
+
+	// A flap that returns to the current type before the debounce period
+	// is never reported.
+	connType = "wifi"
+	c.UpdateConnectionType()
+	clk.Advance(2 * time.Second)
+	connType = "mobile"
+	c.UpdateConnectionType()
+	clk.Advance(2 * connTypeDebounce)
+	wantChanges([2]string{"wifi", "mobile"})
+
+	// Each new type restarts the debounce period.
+	connType = "wired"
+	c.UpdateConnectionType()
+	clk.Advance(2 * time.Second)
+	connType = "wifi"
+	c.SetNetInfo(&tailcfg.NetInfo{PreferredDERP: 2}) // also re-evaluates
+	clk.Advance(connTypeDebounce - time.Second)
+	wantChanges([2]string{"wifi", "mobile"})
+	clk.Advance(time.Second)
+	wantChanges([2]string{"wifi", "mobile"}, [2]string{"mobile", "wifi"})
+	wantLinkType("wifi")
+
+	// Unrecognized types are reported as unknown.
+	connType = "carrier-pigeon"
+	c.UpdateConnectionType()
+	clk.Advance(connTypeDebounce)
+	wantChanges([2]string{"wifi", "mobile"}, [2]string{"mobile", "wifi"}, [2]string{"wifi", ""})
+	wantLinkType("")
+}
+
+// timerRecordingClock is a tstime.Clock whose timers fire immediately,
+// recording the requested durations.
+type timerRecordingClock struct {
+	tstime.StdClock
+	durs []time.Duration
+}
+
+func (c *timerRecordingClock) NewTimer(d time.Duration) (tstime.TimerController, <-chan time.Time) {
+	c.durs = append(c.durs, d)
+	return c.StdClock.NewTimer(0)
+}
+
+func TestBackoffScale(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{
+		BackoffScaleFunc: func(connType string) float64 {
+			if connType == "mobile" {
+				return 4
+			}
+			return 1
+		},
+	})
+
+	// backoffs returns the first n backoff intervals on the current link.
+	backoffs := func(n int) []time.Duration {
+		clk := new(timerRecordingClock)
+		bo := backoff.NewBackoff("test", t.Logf, time.Second)
+		bo.Clock = clk
+		bo.Scale = c.backoffScale
+		for range n {
+			bo.BackOff(context.Background(), errors.New("control unreachable"))
+		}
+		return clk.durs
+	}
+
+	c.SetNetInfo(&tailcfg.NetInfo{LinkType: "wired"})
+	if got := c.backoffScale(); got != 1 {
+		t.Errorf("backoffScale on wired link = %v; want 1", got)
+	}
+	good := backoffs(20)
+
+	c.SetNetInfo(&tailcfg.NetInfo{LinkType: "mobile"})
+	if got := c.backoffScale(); got != 4 {
+		t.Errorf("backoffScale on mobile link = %v; want 4", got)
+	}
+	bad := backoffs(20)
+
+	// Jitter is 0.5-1.5x, so a 4x factor always wins, including once both
+	// have reached the maximum backoff.
+	for i := range good {
+		if bad[i] <= good[i] {
+			t.Errorf("backoff %d: bad link %v <= good link %v", i, bad[i], good[i])
+		}
+	}
+	if ceil := 3 * time.Second / 2; good[len(good)-1] > ceil {
+		t.Errorf("good link backoff %v exceeds jittered max %v", good[len(good)-1], ceil)
+	}
+	if floor := 2 * time.Second; bad[len(bad)-1] < floor {
+		t.Errorf("bad link backoff %v; want at least %v", bad[len(bad)-1], floor)
+	}
+}
@@ -4,8 +4,17 @@
 package controlclient
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
+	"time"
+
+	"tailscale.com/net/netmon"
+	"tailscale.com/net/tsdial"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
+	"tailscale.com/types/key"
+	"tailscale.com/types/persist"
 )
 
 func fieldsOf(t reflect.Type) (fields []string) {
@@ -62,3 +71,153 @@ func TestStatusEqual(t *testing.T) {
 		}
 	}
 }
+
+type nopObserver struct{}
+
+func (nopObserver) SetControlClientStatus(Client, Status) {}
+
+func TestMaxSessionDuration(t *testing.T) {
+	clk := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1000, 0)})
+	k := key.NewMachine()
+	expired := 0
+	c, err := NewNoStart(Options{
+		ServerURL:            newTestMapServer(t).ts.URL,
+		GetMachinePrivateKey: func() (key.MachinePrivate, error) { return k, nil },
+		Dialer:               tsdial.NewDialer(netmon.NewStatic()),
+		Observer:             nopObserver{},
+		Clock:                clk,
+		Logf:                 t.Logf,
+		MaxSessionDuration:   time.Hour,
+		OnSessionExpired:     func() { expired++ },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.direct.Close()
+
+	// loginSucceeded does what authRoutine does on a successful login.
+	loginSucceeded := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.loggedIn = true
+		c.loginGoal = nil
+		c.startSessionTimerLocked()
+	}
+	wantRelogin := func(want bool) {
+		t.Helper()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if got := c.loginGoal != nil; got != want {
+			t.Fatalf("login started = %v; want %v", got, want)
+		}
+		if want && c.loginGoal.flags != LoginInteractive {
+			t.Errorf("login flags = %v; want %v", c.loginGoal.flags, LoginInteractive)
+		}
+	}
+
+	loginSucceeded()
+	clk.Advance(59 * time.Minute)
+	wantRelogin(false)
+	if expired != 0 {
+		t.Fatalf("OnSessionExpired called %d times before the limit", expired)
+	}
+
+	clk.Advance(time.Minute)
+	wantRelogin(true)
+	if expired != 1 {
+		t.Fatalf("OnSessionExpired called %d times; want 1", expired)
+	}
+
+	// The limit applies again from the next successful login.
+	loginSucceeded()
+	clk.Advance(30 * time.Minute)
+	wantRelogin(false)
+	clk.Advance(30 * time.Minute)
+	wantRelogin(true)
+	if expired != 2 {
+		t.Fatalf("OnSessionExpired called %d times; want 2", expired)
+	}
+
+	// Logging out stops the timer.
+	loginSucceeded()
+	c.mu.Lock()
+	c.loggedIn = false
+	c.stopSessionTimerLocked()
+	c.mu.Unlock()
+	clk.Advance(2 * time.Hour)
+	wantRelogin(false)
+	if expired != 2 {
+		t.Errorf("OnSessionExpired called %d times after logout; want 2", expired)
+	}
+}
+
+func TestAutoDataPlaneDisabled(t *testing.T) {
+	srv := newTestMapServer(t)
+	k := key.NewMachine()
+	c, err := NewNoStart(Options{
+		ServerURL:            srv.ts.URL,
+		HTTPTestClient:       srv.ts.Client(),
+		NoiseTestClient:      srv.ts.Client(),
+		GetMachinePrivateKey: func() (key.MachinePrivate, error) { return k, nil },
+		Persist:              persist.Persist{PrivateNodeKey: key.NewNode()},
+		Hostinfo:             &tailcfg.Hostinfo{BackendLogID: "test-backend-log-id"},
+		Dialer:               tsdial.NewDialer(netmon.NewStatic()),
+		Observer:             nopObserver{},
+		Logf:                 t.Logf,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+	c.direct.SetEndpoints(fakeEndpoints(1, 2))
+
+	// The stream disables the data plane, then re-enables it once the
+	// endpoints have been withdrawn.
+	reenable := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done) // before Shutdown
+	srv.setStream(func(req *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 1}, DataPlaneDisabled: "true"})
+		select {
+		case <-reenable:
+			send(&tailcfg.MapResponse{DataPlaneDisabled: "false"})
+		case <-done:
+			return
+		}
+		<-done
+	})
+
+	// waitLiteUpdate waits for a lite update, after the first n MapRequests,
+	// carrying want endpoints.
+	waitLiteUpdate := func(n, want int) int {
+		t.Helper()
+		var got int
+		err := tstest.WaitFor(10*time.Second, func() error {
+			reqs := srv.requests()
+			for i := n; i < len(reqs); i++ {
+				if reqs[i].Stream || len(reqs[i].Endpoints) != want {
+					continue
+				}
+				got = i + 1
+				return nil
+			}
+			return fmt.Errorf("no lite update with %d endpoints in %d MapRequests", want, len(reqs))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	c.mu.Lock()
+	c.loggedIn = true
+	c.mu.Unlock()
+	c.Start()
+
+	n := waitLiteUpdate(0, 0)
+	if reqs := srv.requests(); len(reqs[0].Endpoints) != 2 {
+		t.Errorf("streaming MapRequest had %d endpoints; want 2", len(reqs[0].Endpoints))
+	}
+	close(reenable)
+	waitLiteUpdate(n, 2)
+}
@@ -8,8 +8,10 @@
 	"bytes"
 	"context"
 	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -25,9 +27,12 @@
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go4.org/mem"
+	"go4.org/netipx"
+	"tailscale.com/control/controlbase"
 	"tailscale.com/control/controlknobs"
 	"tailscale.com/envknob"
 	"tailscale.com/health"
@@ -39,6 +44,7 @@
 	"tailscale.com/net/netmon"
 	"tailscale.com/net/netutil"
 	"tailscale.com/net/tlsdial"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/net/tshttpproxy"
 	"tailscale.com/tailcfg"
@@ -47,16 +53,18 @@
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
+	"tailscale.com/types/opt"
 	"tailscale.com/types/persist"
 	"tailscale.com/types/ptr"
 	"tailscale.com/types/tkatype"
+	"tailscale.com/types/views"
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/multierr"
+	"tailscale.com/util/set"
 	"tailscale.com/util/singleflight"
 	"tailscale.com/util/syspolicy"
 	"tailscale.com/util/systemd"
 	"tailscale.com/util/testenv"
-	"tailscale.com/util/zstdframe"
 )
 
 // Direct is the client that connects to a tailcontrol server for a node.
@@ -72,6 +80,8 @@ type Direct struct {
 	health                     *health.Tracker
 	discoPubKey                key.DiscoPublic
 	getMachinePrivKey          func() (key.MachinePrivate, error)
+	machineKeySigner           controlbase.MachineKeySigner
+	generateNodeKey            func() (key.NodePrivate, error) // or nil to use key.NewNode
 	debugFlags                 []string
 	skipIPForwardingCheck      bool
 	pinger                     Pinger
@@ -80,10 +90,63 @@ type Direct struct {
 	onClientVersion            func(*tailcfg.ClientVersion) // or nil
 	onControlTime              func(time.Time)              // or nil
 	onTailnetDefaultAutoUpdate func(bool)                   // or nil
-	panicOnUse                 bool                         // if true, panic if client is used (for testing)
+	onDataPlaneDisabled        func(bool)                   // or nil
+	onEphemeralTTL             func(time.Duration)          // or nil
+	onOutOfOrderResponse       func(last, got int64)        // or nil
+	onEmptyDERPMap             func()                       // or nil
+	onQuarantinedPeers         func([]QuarantinedPeer)      // or nil
+	onFirstMap                 func(time.Duration)          // or nil
+	onEndpointReportInterval   func(time.Duration)          // or nil
+	onTKAStateChange           func(TKAState)               // or nil
+	onRediscoveryRequested     func()                       // or nil
+	created                    time.Time                    // when NewDirect was called, per clock
+	nodeIdentityFile           string                       // or empty
+	clockSourceFunc            func() (string, opt.Bool)    // or nil
+	timeZoneFunc               func() string                // or nil
+	firewallModeFunc           func() string                // or nil
+	features                   []tailcfg.ClientFeature      // sorted, immutable; see featuresFor
+	validateDeltas             bool
+	reportPublicIP             bool
+	reportTimeZone             bool
+	mapRequestTap              func(*tailcfg.MapRequest) // or nil
+	redactMapRequestTap        bool
+	onRawMapResponse           func([]byte)          // or nil
+	onMapPollHeartbeat         func(time.Time, bool) // or nil
+	endpointMaxRetries         int
+	endpointMaxDuration        time.Duration
+	endpointPushMinInterval    time.Duration
+	reportPeerLatency          bool
+	peerScope                  string
+	malformedPeerPolicy        MalformedPeerPolicy
+	peerFilter                 func(*tailcfg.Node) bool
+	onInvalidNode              func(tailcfg.NodeView, error)
+	compression                Compression
+	onPeerDelta                func(PeerDeltaStats)
+	skipLogoutOnShutdown       bool
+	attestationProvider        func() ([]byte, error) // or nil
+	requireAttestation         bool
+	stats                      atomic.Pointer[directStats] // never nil after NewDirect
+	connTypeFunc               func() string               // or nil
+	backoffScaleFunc           func(string) float64        // or nil
+	onConnTypeChange           func(old, new string)       // or nil
+	panicOnUse                 bool                        // if true, panic if client is used (for testing)
 
 	dialPlan ControlDialPlanner // can be nil
 
+	// From Options.HTTPClient, for requests over Noise: the proxy settings
+	// of its transport (if it's an *http.Transport) and its timeout.
+	noiseTransport *http.Transport // or nil for the defaults
+	httpTimeout    time.Duration   // zero means none
+
+	// shutdownCtx is canceled by Shutdown, ending any map requests in flight.
+	shutdownCtx    context.Context
+	shutdownCancel context.CancelFunc
+
+	// Change callbacks from Options, called by notifyChanges; each may be nil.
+	onDERPMapChange   func(tailcfg.DERPMapView)
+	onDNSConfigChange func(tailcfg.DNSConfigView)
+	onPeersChanged    func(full bool, changed []tailcfg.NodeView, removed []tailcfg.NodeID)
+
 	mu              sync.Mutex        // mutex guards the following fields
 	serverLegacyKey key.MachinePublic // original ("legacy") nacl crypto_box-based public key; only used for signRegisterRequest on Windows now
 	serverNoiseKey  key.MachinePublic
@@ -99,7 +162,69 @@ type Direct struct {
 	netinfo      *tailcfg.NetInfo
 	endpoints    []tailcfg.Endpoint
 	tkaHead      string
-	lastPingURL  string // last PingRequest.URL received, for dup suppression
+	acceptDNS    opt.Bool // reported as Hostinfo.AcceptDNS; empty until SetAcceptDNS
+	lastPingURL  string   // last PingRequest.URL received, for dup suppression
+
+	lastRediscoverID string // last MapResponse.RediscoverEndpoints acted on, for dup suppression
+
+	netinfoChanged time.Time // when netinfo last changed; see NetInfo
+
+	lastEndpointChange EndpointChange // how endpoints last changed; see LastEndpointChange
+
+	tkaKey        string   // reported as Hostinfo.TKAKey; empty until SetTKAKey
+	tkaState      TKAState // last tailnet lock state from control, if tkaStateKnown
+	tkaStateKnown bool
+
+	exitNodeID tailcfg.StableNodeID // reported as Hostinfo.ExitNodeID; empty until SetUsingExitNode
+
+	onKeyExpiry      func(time.Time) // or nil
+	keyExpiryWarning time.Duration   // 0 means defaultKeyExpiryWarning
+	keyExpiry        keyExpiryState
+
+	peerSortLess func(a, b tailcfg.NodeView) bool // or nil to order Peers by node ID
+
+	// dataPlaneDisabled is whether control has told us to carry no traffic.
+	// While set, endpoints and the public IPs derived from them are not
+	// reported to control.
+	dataPlaneDisabled bool
+
+	// onDataPlaneChanged, if non-nil, is called when dataPlaneDisabled
+	// changes. Auto sets it to send a lite update, withdrawing or sending
+	// the endpoints.
+	onDataPlaneChanged func()
+
+	shutDown bool // whether Shutdown has been called
+
+	reqHeaders RequestHeaders // extra headers to add to control requests
+
+	peers      map[tailcfg.NodeID]*peerState // peers in the most recent netmap
+	seedPeers  []*tailcfg.Node               // from Options.PersistedPeers, until used by a map session
+	onlineHist onlineHistogram               // how long peers stayed online
+
+	peerLatency        map[tailcfg.NodeID][]time.Duration // RTT samples since last upload, per ReportPeerLatency
+	peerLatencyAllowed bool                               // whether self node has NodeAttrReportPeerLatency
+
+	gotFirstMap    bool
+	timeToFirstMap time.Duration // from created to the first processed netmap, if gotFirstMap
+
+	endpointReportInterval time.Duration // min time between endpoint reports, per control; zero means no limit
+	lastEndpointReport     time.Time     // when control last accepted a MapRequest with endpoints
+
+	// endpointReport, if non-nil, is the endpoint report waiting for
+	// endpointReportDelay, which later endpoint changes join.
+	endpointReport *endpointReport
+
+	ephemeral    bool          // whether the node last registered as ephemeral
+	ephemeralTTL time.Duration // last MapResponse.EphemeralTTL, or zero
+
+	subs map[chan NetMapUpdate]bool // Subscribe channels
+
+	lastNetMap *netmap.NetworkMap // shallow copy of last full netmap, for DumpNetMap; Peers are in peers
+
+	connType          connTypeState
+	onConnTypeChanged func() // or nil; set by Auto to send the new NetInfo to control
+
+	nodeIdentity nodeIdentityCache // of nodeIdentityFile; has its own mutex
 }
 
 // Observer is implemented by users of the control client (such as LocalBackend)
@@ -115,6 +240,8 @@ type Observer interface {
 type Options struct {
 	Persist                    persist.Persist                    // initial persistent data
 	GetMachinePrivateKey       func() (key.MachinePrivate, error) // returns the machine key to use
+	MachineKeySigner           controlbase.MachineKeySigner       // optional; if set, used instead of GetMachinePrivateKey, for keys not held in memory (e.g. HSM-backed)
+	GenerateNodeKey            func() (key.NodePrivate, error)    // optional func to generate new node keys (e.g. FIPS or HSM-backed); nil means key.NewNode
 	ServerURL                  string                             // URL of the tailcontrol server
 	AuthKey                    string                             // optional node auth key for auto registration
 	Clock                      tstime.Clock
@@ -129,6 +256,15 @@ type Options struct {
 	OnClientVersion            func(*tailcfg.ClientVersion) // optional func to inform GUI of client version status
 	OnControlTime              func(time.Time)              // optional func to notify callers of new time from control
 	OnTailnetDefaultAutoUpdate func(bool)                   // optional func to inform GUI of default auto-update setting for the tailnet
+	OnDataPlaneDisabled        func(bool)                   // optional func to notify callers when control disables or re-enables the data plane
+	OnEphemeralTTL             func(time.Duration)          // optional func to notify callers of control's cleanup TTL for this ephemeral node
+	OnOutOfOrderResponse       func(last, got int64)        // optional func; if set, map responses whose Seq doesn't increase are reported to it and dropped
+	OnEmptyDERPMap             func()                       // optional func to notify callers that control sent an empty DERP map in a full netmap (it's ignored)
+	OnConnectionTypeChange     func(old, new string)        // optional func to notify callers of (debounced) changes to the ConnectionTypeFunc result
+	OnQuarantinedPeers         func([]QuarantinedPeer)      // optional func; if set, invalid peers are excluded from the netmap and reported to it
+	OnFirstMap                 func(time.Duration)          // optional func called once with the time from NewDirect to the first processed netmap
+	OnEndpointReportInterval   func(time.Duration)          // optional func to notify callers of control's minimum interval between endpoint reports (zero for none)
+	OnRediscoveryRequested     func()                       // optional func to rediscover endpoints (e.g. re-STUN) when control asks; called once per request
 	Dialer                     *tsdial.Dialer               // non-nil
 	C2NHandler                 http.Handler                 // or nil
 	ControlKnobs               *controlknobs.Knobs          // or nil to ignore
@@ -153,6 +289,308 @@ type Options struct {
 	// If we receive a new DialPlan from the server, this value will be
 	// updated.
 	DialPlan ControlDialPlanner
+
+	// PerRequestHeaders optionally specifies extra HTTP headers to send to
+	// the control server, differentiated by request type. This is useful
+	// for proxies that route login and map-poll requests differently.
+	// Reserved headers (see RequestHeaders) are rejected by NewDirect.
+	PerRequestHeaders RequestHeaders
+
+	// NodeIdentityFile optionally names a file (such as a cloud instance ID
+	// file) whose contents identify this host across re-creation. If set and
+	// readable, a hash of its contents is reported as Hostinfo.NodeIdentity.
+	// A missing or unreadable file is logged and otherwise ignored. It's
+	// re-read by SetHostinfo only when its size or modification time
+	// changes.
+	NodeIdentityFile string
+
+	// ClockSourceFunc optionally returns the detected source of the node's
+	// wall clock (such as "ntp" or "rtc") and whether the clock is
+	// synchronized, either of which may be empty if unknown. They're
+	// reported as Hostinfo.ClockSource and Hostinfo.ClockSynced, and logged
+	// along with any large skew from control's clock.
+	ClockSourceFunc func() (source string, synced opt.Bool)
+
+	// ReportTimeZone, if true, opts in to reporting the node's local time
+	// zone to control as Hostinfo.TimeZone. It's off by default, as the
+	// time zone reveals roughly where the node is.
+	ReportTimeZone bool
+
+	// TimeZoneFunc optionally returns the IANA name of the node's local time
+	// zone (such as "Europe/Berlin"), or the empty string if unknown, to
+	// report as Hostinfo.TimeZone if ReportTimeZone is set. If nil, the
+	// system time zone is used if it can be determined. Call
+	// Direct.RefreshTimeZone when it may have changed.
+	TimeZoneFunc func() string
+
+	// FirewallModeFunc optionally returns the firewall mode to report as
+	// NetInfo.FirewallMode, in its "nft-REASON" or "ipt-REASON" form, in
+	// place of the one in the NetInfo given to SetNetInfo. Any other result,
+	// such as the empty string on platforms where the client doesn't manage
+	// the firewall, omits it. Call Direct.RefreshFirewallMode when it may
+	// have changed.
+	FirewallModeFunc func() string
+
+	// Features optionally lists client features that the caller's build and
+	// platform support, to advertise to control in addition to those
+	// controlclient itself always supports. See
+	// Direct.AdvertisedCapabilities.
+	Features []tailcfg.ClientFeature
+
+	// CompressedUploads is whether the caller zstd-compresses the data it
+	// uploads, such as its logs, so tailcfg.ClientFeatureCompressedUploads
+	// is advertised.
+	CompressedUploads bool
+
+	// ConnectionTypeFunc optionally returns the coarse type of the current
+	// network connection: "wired", "wifi" or "mobile" (cellular), as used by
+	// NetInfo.LinkType. Any other value means unknown. It's re-evaluated by
+	// Direct.UpdateConnectionType.
+	ConnectionTypeFunc func() string
+
+	// BackoffScaleFunc optionally returns a factor by which to scale Auto's
+	// retry backoff after control connection failures, given the current
+	// connection type as reported in NetInfo.LinkType (see
+	// ConnectionTypeFunc). For example, returning 4 for "mobile" avoids
+	// hammering control over a flapping cellular link. Factors less than or
+	// equal to zero are treated as 1.
+	BackoffScaleFunc func(connType string) float64
+
+	// ValidateDeltas, if true, makes the client check each incremental map
+	// response against its current netmap before applying it. A delta that
+	// would leave the netmap inconsistent (such as one changing a peer that
+	// doesn't exist) ends the map poll instead, so that the next one starts
+	// over with a full netmap.
+	ValidateDeltas bool
+
+	// ReportPublicIP, if true, reports the node's full public IPs (as
+	// observed via STUN) in NetInfo.PublicIPs. Otherwise, they're coarsened
+	// to the containing /24 (IPv4) or /48 (IPv6).
+	ReportPublicIP bool
+
+	// MaxSessionDuration, if positive, is how long a login session may last
+	// before Auto forces a full, interactive re-login, regardless of the node
+	// key's expiry. The re-login goes through the usual auth retry and
+	// backoff.
+	MaxSessionDuration time.Duration
+
+	// OnSessionExpired, if non-nil, is called when Auto starts a re-login
+	// because MaxSessionDuration was exceeded.
+	OnSessionExpired func()
+
+	// MapRequestTap, if non-nil, is called with a copy of each MapRequest
+	// just before it's sent to control, for debugging. It must not block.
+	MapRequestTap func(*tailcfg.MapRequest)
+
+	// RedactMapRequestTap, if true, removes identifying details (such as
+	// endpoint addresses and the hostname) from the MapRequests passed to
+	// MapRequestTap.
+	RedactMapRequestTap bool
+
+	// OnRawMapResponse, if non-nil, is called with the JSON of each
+	// MapResponse (including keep-alives) received in a map poll, after
+	// decompression but before it's decoded and applied, for debugging. The
+	// callee owns the slice. It must not block.
+	OnRawMapResponse func([]byte)
+
+	// EndpointUpdateMaxRetries is the maximum number of times that
+	// Direct.PushEndpoints retries a failed endpoint update. If zero, 3 is
+	// used. If negative, failures aren't retried.
+	EndpointUpdateMaxRetries int
+
+	// EndpointUpdateMaxDuration bounds the total time that
+	// Direct.PushEndpoints spends sending an endpoint update, including
+	// retries. If zero, 30 seconds is used.
+	EndpointUpdateMaxDuration time.Duration
+
+	// EndpointPushMinInterval is the minimum time between sending changed
+	// endpoints to control, on top of any interval control asks for.
+	// Changes within it are coalesced, and only the latest endpoints are
+	// sent once it has elapsed. Zero means no minimum.
+	EndpointPushMinInterval time.Duration
+
+	// HTTPClient, if non-nil, is the HTTP client used instead of the default
+	// one for requests to control, such as for environments that must go
+	// through a particular proxy. If nil, the default client is used, which
+	// honors the system proxy configuration.
+	//
+	// Requests that don't go over the Noise protocol, such as fetching
+	// control's public keys, use it as is: its Transport (with any proxy,
+	// TLS and connection pooling settings) and Timeout aren't modified.
+	//
+	// Register and map requests go over a Noise connection, which is an
+	// upgraded HTTP connection that the client can't make itself. So if
+	// its Transport is an *http.Transport (or nil, for
+	// http.DefaultTransport), the Noise connection is dialed through that
+	// transport's Proxy, with its ProxyConnectHeader. Its TLS settings
+	// aren't needed for that, as TLS certificate errors on the Noise
+	// connection are only logged: the Noise protocol authenticates control.
+	// Its Timeout applies to register requests and to map requests that
+	// don't stream, but not to the map long-poll, which would otherwise be
+	// ended by it.
+	HTTPClient *http.Client
+
+	// OnKeyExpiry, if non-nil, is called with the node key's expiry time
+	// once it's within KeyExpiryWarning, so that the caller can prompt for
+	// re-authentication before the key expires. It's called at most once
+	// per expiry time; a new expiry from control re-arms it. It must not
+	// block.
+	OnKeyExpiry func(expiry time.Time)
+
+	// KeyExpiryWarning is how long before the node key expires that
+	// OnKeyExpiry is called. If zero, 24 hours is used.
+	KeyExpiryWarning time.Duration
+
+	// PeerSortLess, if non-nil, orders the Peers of each netmap, and those
+	// returned by Direct.Peers, instead of their node IDs. The sort is
+	// stable over peers sorted by node ID, so peers it considers equal stay
+	// in node ID order. As netmap.NetworkMap.PeerIndexByNodeID and delta
+	// updates (see NetmapDeltaUpdater) assume node ID order, setting it
+	// disables delta updates, and the netmap's PeerIndexByNodeID must not be
+	// used.
+	PeerSortLess func(a, b tailcfg.NodeView) bool
+
+	// OnMapPollHeartbeat, if non-nil, is called from the map poll goroutine
+	// each time a MapResponse is read from control, including keep-alives
+	// (for which keepAlive is set), with the time it was read. Callers can
+	// use it as a liveness signal for the long poll, which otherwise goes
+	// quiet while nothing changes. It must not block.
+	OnMapPollHeartbeat func(t time.Time, keepAlive bool)
+
+	// PeerFilter, if non-nil, reports whether to keep a peer from control
+	// (for instance, only those with a given ACL tag). Rejected peers are
+	// excluded from the netmap and not stored, and later deltas for them
+	// (including their removal) are ignored. It's called with each full peer
+	// node in a MapResponse, so a changed peer that's now rejected is
+	// removed, and one that's now accepted is added. It must not modify the
+	// node.
+	PeerFilter func(*tailcfg.Node) bool
+
+	// PersistedPeers optionally seeds the peers of the first map poll, as if
+	// control had sent them as the full peer list of a previous MapResponse,
+	// so that deltas apply to them. They'd typically have been saved from
+	// Direct.ExportPeers before a restart. A full peer list from control
+	// replaces them.
+	PersistedPeers []*tailcfg.Node
+
+	// OnInvalidNode, if non-nil, is called from the map poll goroutine with
+	// each peer entry from control that's skipped for having a zero node
+	// ID, or for being followed by another entry with the same node ID in
+	// the same MapResponse (the last one is used), and why.
+	OnInvalidNode func(n tailcfg.NodeView, err error)
+
+	// OnPeerDelta, if non-nil, is called from the map poll goroutine for
+	// each MapResponse that adds, changes or removes peers, with counts of
+	// how the peers actually changed once it was applied. It's called
+	// before the resulting netmap is published. It must not block.
+	OnPeerDelta func(stats PeerDeltaStats)
+
+	// SkipLogoutOnShutdown, if true, makes Direct.Shutdown only disconnect
+	// rather than also logging the node out, which expires its node key and
+	// requires logging in again.
+	SkipLogoutOnShutdown bool
+
+	// Compression is how to ask control to compress MapResponses. The
+	// default is CompressionZstd. Whatever control actually uses is
+	// decoded.
+	Compression Compression
+
+	// ReportPeerLatency, if true, opts in to sending peer latencies recorded
+	// with Direct.ReportPeerLatency to control, aggregated, in lite
+	// (non-streaming) MapRequests.
+	// They're only sent if control grants the node the
+	// tailcfg.NodeAttrReportPeerLatency capability.
+	ReportPeerLatency bool
+
+	// PeerScope optionally names the peer visibility scope to request from
+	// control. See tailcfg.MapRequest.PeerScope.
+	PeerScope string
+
+	// MalformedPeerPolicy is how to handle peers from control that lack a
+	// node key or addresses. The default is MalformedPeerDrop.
+	MalformedPeerPolicy MalformedPeerPolicy
+
+	// AttestationProvider optionally returns a hardware attestation (such as
+	// from a TPM or secure enclave) that the node key is hardware-bound, to
+	// send to control as tailcfg.MapRequest.Attestation. If it fails, map
+	// requests are sent without one, unless RequireAttestation is set.
+	AttestationProvider func() ([]byte, error)
+
+	// RequireAttestation, if true, makes map requests fail rather than be
+	// sent without an attestation from AttestationProvider.
+	RequireAttestation bool
+
+	// OnDERPMapChange, OnDNSConfigChange and OnPeersChanged are optional
+	// funcs called when a MapResponse changes the DERP map, the DNS config,
+	// or peers, respectively. For each response, they're called in that order,
+	// from the map poll goroutine, only after the response has been fully
+	// applied: Direct's accessors (such as PeerTags or UserProfile) already
+	// reflect it. They must not modify the slices they're passed.
+	//
+	// OnPeersChanged receives the changed or added peers and the IDs of
+	// removed ones; if full is set, changed is the complete set of peers and
+	// any others were removed.
+	OnDERPMapChange   func(tailcfg.DERPMapView)
+	OnDNSConfigChange func(tailcfg.DNSConfigView)
+	OnPeersChanged    func(full bool, changed []tailcfg.NodeView, removed []tailcfg.NodeID)
+
+	// OnTKAStateChange, if non-nil, is called with control's tailnet lock
+	// state when it's first received in a map poll, and whenever it changes.
+	OnTKAStateChange func(TKAState)
+}
+
+// builtinFeatures are the client features implemented by controlclient itself,
+// which are always advertised to control.
+var builtinFeatures = []tailcfg.ClientFeature{
+	tailcfg.ClientFeatureDeltaDERPMap, // see mapSession.updateStateFromResponse
+}
+
+// RequestHeaders are extra HTTP headers to add to requests sent to the control
+// server, by request type. Nil values mean no extra headers.
+//
+// Headers that the client itself manages (such as the load balancer header,
+// Content-Type, and hop-by-hop headers) may not be set.
+type RequestHeaders struct {
+	Login   http.Header // added to register (login) requests
+	MapPoll http.Header // added to map requests, both streaming and not
+	Logout  http.Header // added to logout requests
+}
+
+// reservedRequestHeaders are the headers that may not be set via
+// RequestHeaders, in canonical form.
+var reservedRequestHeaders = set.Of(
+	http.CanonicalHeaderKey(tailcfg.LBHeader),
+	"Connection",
+	"Content-Length",
+	"Content-Type",
+	"Host",
+	"Transfer-Encoding",
+	"Upgrade",
+)
+
+// validate reports an error if h contains any reserved headers.
+func (h RequestHeaders) validate() error {
+	for name, hh := range map[string]http.Header{
+		"Login":   h.Login,
+		"MapPoll": h.MapPoll,
+		"Logout":  h.Logout,
+	} {
+		for k := range hh {
+			if reservedRequestHeaders.Contains(http.CanonicalHeaderKey(k)) {
+				return fmt.Errorf("%s header %q is reserved", name, k)
+			}
+		}
+	}
+	return nil
+}
+
+// clone returns a deep copy of h.
+func (h RequestHeaders) clone() RequestHeaders {
+	return RequestHeaders{
+		Login:   h.Login.Clone(),
+		MapPoll: h.MapPoll.Clone(),
+		Logout:  h.Logout.Clone(),
+	}
 }
 
 // ControlDialPlanner is the interface optionally supplied when creating a
@@ -210,8 +648,8 @@ func NewDirect(opts Options) (*Direct, error) {
 	if opts.ServerURL == "" {
 		return nil, errors.New("controlclient.New: no server URL specified")
 	}
-	if opts.GetMachinePrivateKey == nil {
-		return nil, errors.New("controlclient.New: no GetMachinePrivateKey specified")
+	if opts.GetMachinePrivateKey == nil && opts.MachineKeySigner == nil {
+		return nil, errors.New("controlclient.New: no GetMachinePrivateKey or MachineKeySigner specified")
 	}
 	if opts.Dialer == nil {
 		if testenv.InTest() {
@@ -229,6 +667,9 @@ func NewDirect(opts Options) (*Direct, error) {
 	if opts.ControlKnobs == nil {
 		opts.ControlKnobs = &controlknobs.Knobs{}
 	}
+	if err := opts.PerRequestHeaders.validate(); err != nil {
+		return nil, fmt.Errorf("controlclient.New: %w", err)
+	}
 	opts.ServerURL = strings.TrimRight(opts.ServerURL, "/")
 	serverURL, err := url.Parse(opts.ServerURL)
 	if err != nil {
@@ -250,7 +691,10 @@ func NewDirect(opts Options) (*Direct, error) {
 		Logf:             opts.Logf,
 	}
 
-	httpc := opts.HTTPTestClient
+	httpc := opts.HTTPClient
+	if httpc == nil {
+		httpc = opts.HTTPTestClient
+	}
 	if httpc == nil && runtime.GOOS == "js" {
 		// In js/wasm, net/http.Transport (as of Go 1.18) will
 		// only use the browser's Fetch API if you're using
@@ -273,10 +717,24 @@ func NewDirect(opts Options) (*Direct, error) {
 		httpc = &http.Client{Transport: tr}
 	}
 
+	var noiseTransport *http.Transport
+	var httpTimeout time.Duration
+	if hc := opts.HTTPClient; hc != nil {
+		httpTimeout = hc.Timeout
+		switch tr := hc.Transport.(type) {
+		case nil:
+			noiseTransport = http.DefaultTransport.(*http.Transport)
+		case *http.Transport:
+			noiseTransport = tr
+		}
+	}
+
 	c := &Direct{
 		httpc:                      httpc,
 		controlKnobs:               opts.ControlKnobs,
 		getMachinePrivKey:          opts.GetMachinePrivateKey,
+		machineKeySigner:           opts.MachineKeySigner,
+		generateNodeKey:            opts.GenerateNodeKey,
 		serverURL:                  opts.ServerURL,
 		clock:                      opts.Clock,
 		logf:                       opts.Logf,
@@ -292,10 +750,69 @@ func NewDirect(opts Options) (*Direct, error) {
 		onClientVersion:            opts.OnClientVersion,
 		onTailnetDefaultAutoUpdate: opts.OnTailnetDefaultAutoUpdate,
 		onControlTime:              opts.OnControlTime,
+		onDataPlaneDisabled:        opts.OnDataPlaneDisabled,
+		onEphemeralTTL:             opts.OnEphemeralTTL,
+		onOutOfOrderResponse:       opts.OnOutOfOrderResponse,
+		onEmptyDERPMap:             opts.OnEmptyDERPMap,
+		onQuarantinedPeers:         opts.OnQuarantinedPeers,
+		onFirstMap:                 opts.OnFirstMap,
+		onEndpointReportInterval:   opts.OnEndpointReportInterval,
+		onRediscoveryRequested:     opts.OnRediscoveryRequested,
+		created:                    opts.Clock.Now(),
 		c2nHandler:                 opts.C2NHandler,
 		dialer:                     opts.Dialer,
 		dnsCache:                   dnsCache,
 		dialPlan:                   opts.DialPlan,
+		noiseTransport:             noiseTransport,
+		httpTimeout:                httpTimeout,
+		reqHeaders:                 opts.PerRequestHeaders.clone(),
+		nodeIdentityFile:           opts.NodeIdentityFile,
+		clockSourceFunc:            opts.ClockSourceFunc,
+		reportTimeZone:             opts.ReportTimeZone,
+		timeZoneFunc:               opts.TimeZoneFunc,
+		firewallModeFunc:           opts.FirewallModeFunc,
+		features:                   advertisedFeatures(opts),
+		connTypeFunc:               opts.ConnectionTypeFunc,
+		backoffScaleFunc:           opts.BackoffScaleFunc,
+		validateDeltas:             opts.ValidateDeltas,
+		reportPublicIP:             opts.ReportPublicIP,
+		mapRequestTap:              opts.MapRequestTap,
+		redactMapRequestTap:        opts.RedactMapRequestTap,
+		onRawMapResponse:           opts.OnRawMapResponse,
+		onMapPollHeartbeat:         opts.OnMapPollHeartbeat,
+		peerFilter:                 opts.PeerFilter,
+		onInvalidNode:              opts.OnInvalidNode,
+		compression:                opts.Compression,
+		onPeerDelta:                opts.OnPeerDelta,
+		skipLogoutOnShutdown:       opts.SkipLogoutOnShutdown,
+		endpointMaxRetries:         opts.EndpointUpdateMaxRetries,
+		endpointMaxDuration:        opts.EndpointUpdateMaxDuration,
+		endpointPushMinInterval:    opts.EndpointPushMinInterval,
+		onKeyExpiry:                opts.OnKeyExpiry,
+		keyExpiryWarning:           opts.KeyExpiryWarning,
+		peerSortLess:               opts.PeerSortLess,
+		reportPeerLatency:          opts.ReportPeerLatency,
+		peerScope:                  opts.PeerScope,
+		malformedPeerPolicy:        opts.MalformedPeerPolicy,
+		attestationProvider:        opts.AttestationProvider,
+		requireAttestation:         opts.RequireAttestation,
+		onDERPMapChange:            opts.OnDERPMapChange,
+		onDNSConfigChange:          opts.OnDNSConfigChange,
+		onPeersChanged:             opts.OnPeersChanged,
+		onTKAStateChange:           opts.OnTKAStateChange,
+		onConnTypeChange:           opts.OnConnectionTypeChange,
+	}
+	c.shutdownCtx, c.shutdownCancel = context.WithCancel(context.Background())
+	c.ResetStats()
+	c.connType.cur = c.connectionType()
+	if len(opts.PersistedPeers) > 0 {
+		c.seedPeers = make([]*tailcfg.Node, len(opts.PersistedPeers))
+		views := make([]tailcfg.NodeView, len(opts.PersistedPeers))
+		for i, n := range opts.PersistedPeers {
+			c.seedPeers[i] = n.Clone()
+			views[i] = c.seedPeers[i].View()
+		}
+		c.updatePeers(true, views, nil)
 	}
 	if opts.Hostinfo == nil {
 		c.SetHostinfo(hostinfo.New())
@@ -317,10 +834,48 @@ func NewDirect(opts Options) (*Direct, error) {
 	return c, nil
 }
 
+// Shutdown tears down c: it ends any map requests in flight, makes a
+// best-effort attempt (bounded by ctx) to log out so that control shows the
+// node as offline promptly, and closes c. It returns the error from logging
+// out, if any. If the node never logged in, or Options.SkipLogoutOnShutdown
+// is set, it doesn't try to log out.
+//
+// It's a Close that takes a context; it's named Shutdown because Close, which
+// only closes the Noise connection(s), already exists.
+//
+// Calls after the first do nothing and return nil.
+func (c *Direct) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	if c.shutDown {
+		c.mu.Unlock()
+		return nil
+	}
+	c.shutDown = true
+	logout := !c.skipLogoutOnShutdown && !c.persist.PrivateNodeKey().IsZero() && c.persist.UserProfile().ID != 0
+	c.mu.Unlock()
+
+	c.shutdownCancel()
+	var err error
+	if logout {
+		err = c.TryLogout(ctx)
+	}
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
 // Close closes the underlying Noise connection(s).
 func (c *Direct) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if t := c.keyExpiry.timer; t != nil {
+		t.Stop()
+		c.keyExpiry.timer = nil
+	}
+	if r := c.endpointReport; r != nil {
+		r.cancel()
+	}
 	if c.noiseClient != nil {
 		if err := c.noiseClient.Close(); err != nil {
 			return err
@@ -338,8 +893,14 @@ func (c *Direct) SetHostinfo(hi *tailcfg.Hostinfo) bool {
 	}
 	hi = ptr.To(*hi)
 	hi.NetInfo = nil
+	if c.nodeIdentityFile != "" {
+		hi.NodeIdentity = c.readNodeIdentity()
+	}
+	hi.ClockSource, hi.ClockSynced = c.clockSource()
+	hi.TimeZone = c.timeZone()
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.applyHostinfoOverridesLocked(hi)
 
 	if hi.Equal(c.hostinfo) {
 		return false
@@ -350,23 +911,219 @@ func (c *Direct) SetHostinfo(hi *tailcfg.Hostinfo) bool {
 	return true
 }
 
+// UpdateHostinfo updates the Hostinfo for the next update by calling f with
+// a copy of the current one, rather than replacing it like SetHostinfo does,
+// so that concurrent updates of different fields don't clobber each other.
+// It reports whether the Hostinfo has changed.
+//
+// f must not block or call back into c. Changes to NetInfo (see SetNetInfo)
+// and to the fields that c manages itself, such as NodeIdentity and
+// TimeZone, are ignored.
+func (c *Direct) UpdateHostinfo(f func(*tailcfg.Hostinfo)) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old := c.hostinfo
+	hi := old.Clone()
+	f(hi)
+	hi.NetInfo = nil
+	hi.NodeIdentity = old.NodeIdentity
+	hi.ClockSource, hi.ClockSynced = old.ClockSource, old.ClockSynced
+	hi.TimeZone = old.TimeZone
+	c.applyHostinfoOverridesLocked(hi)
+
+	if hi.Equal(old) {
+		return false
+	}
+	c.hostinfo = hi
+	j, _ := json.Marshal(c.hostinfo)
+	c.logf("[v1] HostInfo: %s", j)
+	return true
+}
+
+// applyHostinfoOverridesLocked sets the Hostinfo fields that are set by
+// their own Direct methods (such as SetAcceptDNS) in hi. c.mu must be held.
+func (c *Direct) applyHostinfoOverridesLocked(hi *tailcfg.Hostinfo) {
+	if c.acceptDNS != "" {
+		hi.AcceptDNS = c.acceptDNS
+	}
+	if c.tkaKey != "" {
+		hi.TKAKey = c.tkaKey
+	}
+	if c.exitNodeID != "" {
+		hi.ExitNodeID = c.exitNodeID
+	}
+}
+
+// advertisedFeatures returns the sorted, de-duplicated client features that
+// opts and the build enable, other than tailcfg.ClientFeatureExitNode, which
+// depends on the Hostinfo (see Direct.featuresFor).
+func advertisedFeatures(opts Options) []tailcfg.ClientFeature {
+	fs := slices.Concat(builtinFeatures, opts.Features)
+	if opts.CompressedUploads {
+		fs = append(fs, tailcfg.ClientFeatureCompressedUploads)
+	}
+	if sshServerBuilt && envknob.CanSSHD() {
+		fs = append(fs, tailcfg.ClientFeatureSSH)
+	}
+	slices.Sort(fs)
+	return slices.Compact(fs)
+}
+
+// featuresFor returns the client features to advertise to control along with
+// hi: c.features, plus tailcfg.ClientFeatureExitNode if hi offers the exit
+// routes.
+func (c *Direct) featuresFor(hi *tailcfg.Hostinfo) []tailcfg.ClientFeature {
+	if hi == nil || !tsaddr.ContainsExitRoutes(views.SliceOf(hi.RoutableIPs)) {
+		return c.features
+	}
+	fs := append(slices.Clip(c.features), tailcfg.ClientFeatureExitNode)
+	slices.Sort(fs)
+	return slices.Compact(fs)
+}
+
+// AdvertisedCapabilities returns the optional client features advertised to
+// control in each MapRequest, sorted. The caller must not modify the result.
+func (c *Direct) AdvertisedCapabilities() []tailcfg.ClientFeature {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.featuresFor(c.hostinfo)
+}
+
+// clockSource returns the Hostinfo.ClockSource and Hostinfo.ClockSynced
+// values to report, which are empty if unknown.
+func (c *Direct) clockSource() (source string, synced opt.Bool) {
+	if c.clockSourceFunc == nil {
+		return "", ""
+	}
+	return c.clockSourceFunc()
+}
+
+// clockSkewLogThreshold is how far the local clock must be from control's
+// before checkClockSkew logs it.
+const clockSkewLogThreshold = time.Minute
+
+// checkClockSkew compares the local clock with the time reported by control
+// and logs the difference, along with what's known about the local clock's
+// source, if it's large enough to cause problems such as auth failures.
+func (c *Direct) checkClockSkew(controlTime time.Time) {
+	skew := c.clock.Now().Sub(controlTime)
+	if skew.Abs() < clockSkewLogThreshold {
+		return
+	}
+	source, synced := c.clockSource()
+	c.logf("netmap: local clock is %v off from control's; clock source=%q synced=%q", skew.Round(time.Second), source, synced)
+}
+
+// SetAcceptDNS records whether the node uses the DNS configuration from
+// control, for reporting as Hostinfo.AcceptDNS. It reports whether the value
+// changed, in which case the new Hostinfo should be sent to control.
+func (c *Direct) SetAcceptDNS(v bool) (changed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.acceptDNS.Get(); ok && old == v {
+		return false
+	}
+	c.acceptDNS.Set(v)
+	hi := c.hostinfo.Clone()
+	hi.AcceptDNS = c.acceptDNS
+	c.hostinfo = hi
+	c.logf("[v1] HostInfo.AcceptDNS: %v", v)
+	return true
+}
+
+// nodeIdentityCache is the Hostinfo.NodeIdentity last read from
+// Options.NodeIdentityFile, and the file's size and modification time then.
+type nodeIdentityCache struct {
+	mu      sync.Mutex
+	ok      bool // whether the fields below are valid
+	size    int64
+	modTime time.Time
+	id      string
+}
+
+// readNodeIdentity returns the hex-encoded SHA-256 of the contents of
+// c.nodeIdentityFile, ignoring surrounding whitespace. It returns the empty
+// string if the file is missing, unreadable, or empty.
+//
+// The file is only re-read if its size or modification time has changed
+// since it was last read.
+func (c *Direct) readNodeIdentity() string {
+	nc := &c.nodeIdentity
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	fi, err := os.Stat(c.nodeIdentityFile)
+	if err != nil {
+		c.logf("[v1] node identity file: %v", err)
+		nc.ok = false
+		return ""
+	}
+	if nc.ok && fi.Size() == nc.size && fi.ModTime().Equal(nc.modTime) {
+		return nc.id
+	}
+	b, err := os.ReadFile(c.nodeIdentityFile)
+	if err != nil {
+		c.logf("[v1] node identity file: %v", err)
+		nc.ok = false
+		return ""
+	}
+	nc.ok, nc.size, nc.modTime, nc.id = true, fi.Size(), fi.ModTime(), ""
+	if b = bytes.TrimSpace(b); len(b) > 0 {
+		sum := sha256.Sum256(b)
+		nc.id = hex.EncodeToString(sum[:])
+	}
+	return nc.id
+}
+
+// SetCustomHeaders replaces the extra HTTP headers sent with each type of
+// control request. It returns an error, leaving the current headers
+// unchanged, if h contains any reserved headers.
+func (c *Direct) SetCustomHeaders(h RequestHeaders) error {
+	if err := h.validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reqHeaders = h.clone()
+	return nil
+}
+
 // SetNetInfo clones the provided NetInfo and remembers it for the
 // next update. It reports whether the NetInfo has changed.
 func (c *Direct) SetNetInfo(ni *tailcfg.NetInfo) bool {
 	if ni == nil {
 		panic("nil NetInfo")
 	}
+	if c.connTypeFunc != nil {
+		defer c.UpdateConnectionType()
+	}
+	if c.firewallModeFunc != nil {
+		ni = ni.Clone()
+		ni.FirewallMode = c.firewallMode()
+	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.connTypeFunc != nil {
+		ni = ni.Clone()
+		ni.LinkType = c.connType.cur
+	}
 	if reflect.DeepEqual(ni, c.netinfo) {
 		return false
 	}
 	c.netinfo = ni.Clone()
+	c.netinfoChanged = c.clock.Now()
 	c.logf("NetInfo: %v", ni)
 	return true
 }
 
+// NetInfo returns a copy of the NetInfo last stored by SetNetInfo, and when
+// it last changed. It returns nil and the zero time if there's none yet.
+func (c *Direct) NetInfo() (*tailcfg.NetInfo, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.netinfo.Clone(), c.netinfoChanged
+}
+
 // SetNetInfo stores a new TKA head value for next update.
 // It reports whether the TKA head changed.
 func (c *Direct) SetTKAHead(tkaHead string) bool {
@@ -382,6 +1139,78 @@ func (c *Direct) SetTKAHead(tkaHead string) bool {
 	return true
 }
 
+// SetTKAKey records the node's tailnet lock signing key, for reporting as
+// Hostinfo.TKAKey. A zero key clears it. It reports whether the value changed,
+// in which case the new Hostinfo should be sent to control.
+func (c *Direct) SetTKAKey(k key.NLPublic) (changed bool) {
+	var s string
+	if !k.IsZero() {
+		b, _ := k.MarshalText()
+		s = string(b)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s == c.tkaKey {
+		return false
+	}
+	c.tkaKey = s
+	hi := c.hostinfo.Clone()
+	hi.TKAKey = s
+	c.hostinfo = hi
+	c.logf("[v1] HostInfo.TKAKey: %q", s)
+	return true
+}
+
+// SetUsingExitNode updates the exit node reported in Hostinfo.ExitNodeID to
+// the peer with the given ID, which must be in the current netmap. A zero id
+// means no exit node is in use. It reports whether the Hostinfo changed.
+func (c *Direct) SetUsingExitNode(id tailcfg.NodeID) (changed bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sid tailcfg.StableNodeID
+	if !id.IsZero() {
+		ps, ok := c.peers[id]
+		if !ok {
+			return false, fmt.Errorf("exit node %v is not in the netmap", id)
+		}
+		sid = ps.node.StableID()
+	}
+	if sid == c.exitNodeID {
+		return false, nil
+	}
+	c.exitNodeID = sid
+	hi := c.hostinfo.Clone()
+	hi.ExitNodeID = sid
+	c.hostinfo = hi
+	c.logf("[v1] HostInfo.ExitNodeID: %q", sid)
+	return true, nil
+}
+
+// TKAState is control's view of the tailnet lock (TKA) state, as sent in
+// MapResponse.TKAInfo.
+type TKAState struct {
+	Enabled bool   // whether tailnet lock is enforced
+	Head    string // hash of the latest AUM, as tka.AUMHash.MarshalText; empty if unknown
+}
+
+// setTKAState records the tailnet lock state from control, notifying the
+// OnTKAStateChange callback when it's first known or changes.
+func (c *Direct) setTKAState(st TKAState) {
+	c.mu.Lock()
+	if c.tkaStateKnown && c.tkaState == st {
+		c.mu.Unlock()
+		return
+	}
+	c.tkaState = st
+	c.tkaStateKnown = true
+	c.mu.Unlock()
+
+	c.logf("netmap: tailnet lock state: enabled=%v head=%q", st.Enabled, st.Head)
+	if c.onTKAStateChange != nil {
+		c.onTKAStateChange(st)
+	}
+}
+
 func (c *Direct) GetPersist() persist.PersistView {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -452,6 +1281,9 @@ type loginOpt struct {
 	// expiry time in the far past.
 	Expiry *time.Time
 
+	// AuthKey, if non-empty, is used instead of Options.AuthKey.
+	AuthKey string
+
 	// OldNodeKeySignature indicates the former NodeKeySignature
 	// that must be resigned for the new node-key.
 	OldNodeKeySignature tkatype.MarshaledSignature
@@ -462,9 +1294,43 @@ type loginOpt struct {
 func (c *Direct) hostInfoLocked() *tailcfg.Hostinfo {
 	hi := c.hostinfo.Clone()
 	hi.NetInfo = c.netinfo.Clone()
+	if hi.NetInfo != nil {
+		hi.NetInfo.PublicIPs = c.publicIPsLocked()
+	}
 	return hi
 }
 
+// publicIPsLocked returns the NetInfo.PublicIPs value to report, derived from
+// the STUN-discovered endpoints. The IPs are coarsened unless
+// Options.ReportPublicIP is set, and withheld, like the endpoints, while
+// control has disabled the data plane. c.mu must be held.
+func (c *Direct) publicIPsLocked() []netip.Prefix {
+	if c.dataPlaneDisabled {
+		return nil
+	}
+	var ips []netip.Prefix
+	for _, ep := range c.endpoints {
+		if ep.Type != tailcfg.EndpointSTUN && ep.Type != tailcfg.EndpointSTUN4LocalPort {
+			continue
+		}
+		ip := ep.Addr.Addr().Unmap()
+		bits := ip.BitLen()
+		if !c.reportPublicIP {
+			bits = 24
+			if ip.Is6() {
+				bits = 48
+			}
+		}
+		p, err := ip.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		ips = append(ips, p)
+	}
+	slices.SortFunc(ips, netipx.ComparePrefix)
+	return slices.Compact(ips)
+}
+
 func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, newURL string, nks tkatype.MarshaledSignature, err error) {
 	if c.panicOnUse {
 		panic("tainted client")
@@ -474,18 +1340,23 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 	tryingNewKey := c.tryingNewKey
 	serverKey := c.serverLegacyKey
 	serverNoiseKey := c.serverNoiseKey
-	authKey, isWrapped, wrappedSig, wrappedKey := decodeWrappedAuthkey(c.authKey, c.logf)
+	rawAuthKey := c.authKey
+	if opt.AuthKey != "" {
+		rawAuthKey = opt.AuthKey
+	}
+	authKey, isWrapped, wrappedSig, wrappedKey := decodeWrappedAuthkey(rawAuthKey, c.logf)
 	hi := c.hostInfoLocked()
 	backendLogID := hi.BackendLogID
 	expired := !c.expiry.IsZero() && c.expiry.Before(c.clock.Now())
+	extraHeaders := c.reqHeaders.Login
+	if opt.Logout {
+		extraHeaders = c.reqHeaders.Logout
+	}
 	c.mu.Unlock()
 
-	machinePrivKey, err := c.getMachinePrivKey()
+	machinePubKey, err := c.machinePublicKey()
 	if err != nil {
-		return false, "", nil, fmt.Errorf("getMachinePrivKey: %w", err)
-	}
-	if machinePrivKey.IsZero() {
-		return false, "", nil, errors.New("getMachinePrivKey returned zero key")
+		return false, "", nil, err
 	}
 
 	regen := opt.Regen
@@ -536,8 +1407,12 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 		// Nothing.
 	case regen || persist.PrivateNodeKey.IsZero():
 		c.logf("Generating a new nodekey.")
+		k, err := c.newNodeKey()
+		if err != nil {
+			return regen, opt.URL, nil, err
+		}
 		persist.OldPrivateNodeKey = persist.PrivateNodeKey
-		tryingNewKey = key.NewNode()
+		tryingNewKey = k
 	default:
 		// Try refreshing the current key first
 		tryingNewKey = persist.PrivateNodeKey
@@ -616,7 +1491,7 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 			AuthKey:     authKey,
 		}
 	}
-	err = signRegisterRequest(&request, c.serverURL, c.serverLegacyKey, machinePrivKey.Public())
+	err = signRegisterRequest(&request, c.serverURL, c.serverLegacyKey, machinePubKey)
 	if err != nil {
 		// If signing failed, clear all related fields
 		request.SignatureType = tailcfg.SignatureNone
@@ -649,13 +1524,17 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 	if err != nil {
 		return regen, opt.URL, nil, err
 	}
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(bodyData))
+	reqCtx, cancel := c.withHTTPTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, "POST", url, bytes.NewReader(bodyData))
 	if err != nil {
 		return regen, opt.URL, nil, err
 	}
+	addExtraHeaders(req, extraHeaders)
 	addLBHeader(req, request.OldNodeKey)
 	addLBHeader(req, request.NodeKey)
 
+	c.curStats().registerRequests.Add(1)
 	res, err := httpc.Do(req)
 	if err != nil {
 		return regen, opt.URL, nil, fmt.Errorf("register request: %w", err)
@@ -668,7 +1547,7 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 	}
 	resp := tailcfg.RegisterResponse{}
 	if err := decode(res, &resp); err != nil {
-		c.logf("error decoding RegisterResponse with server key %s and machine key %s: %v", serverKey, machinePrivKey.Public(), err)
+		c.logf("error decoding RegisterResponse with server key %s and machine key %s: %v", serverKey, machinePubKey, err)
 		return regen, opt.URL, nil, fmt.Errorf("register request: %v", err)
 	}
 	if debugRegister() {
@@ -715,6 +1594,11 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 	}
 
 	c.mu.Lock()
+	if !opt.Logout && opt.URL == "" && opt.Expiry == nil {
+		// Only a fresh login carries the caller's LoginFlags; follow-ups
+		// and expiry changes keep the original registration's value.
+		c.ephemeral = request.Ephemeral
+	}
 	if resp.AuthURL == "" {
 		// key rotation is complete
 		persist.PrivateNodeKey = tryingNewKey
@@ -771,10 +1655,11 @@ func resignNKS(priv key.NLPrivate, nodeKey key.NodePublic, oldNKS tkatype.Marsha
 }
 
 // newEndpoints acquires c.mu and sets the local port and endpoints and reports
-// whether they've changed.
+// whether they've changed. If so, it records how in c.lastEndpointChange.
 //
 // It does not retain the provided slice.
 func (c *Direct) newEndpoints(endpoints []tailcfg.Endpoint) (changed bool) {
+	now := c.clock.Now()
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -782,7 +1667,9 @@ func (c *Direct) newEndpoints(endpoints []tailcfg.Endpoint) (changed bool) {
 	if slices.Equal(c.endpoints, endpoints) {
 		return false // unchanged
 	}
-	c.logf("[v2] client.newEndpoints(%v)", endpoints)
+	c.lastEndpointChange = diffEndpoints(c.endpoints, endpoints)
+	c.lastEndpointChange.Time = now
+	c.logf("[v2] client.newEndpoints(%v): %v", endpoints, c.lastEndpointChange)
 	c.endpoints = slices.Clone(endpoints)
 	return true // changed
 }
@@ -815,6 +1702,11 @@ func (nu *rememberLastNetmapUpdater) UpdateFullNetmap(nm *netmap.NetworkMap) {
 
 // FetchNetMapForTest fetches the netmap once.
 func (c *Direct) FetchNetMapForTest(ctx context.Context) (*netmap.NetworkMap, error) {
+	return c.fetchNetMap(ctx)
+}
+
+// fetchNetMap fetches the netmap once, with a non-streaming map request.
+func (c *Direct) fetchNetMap(ctx context.Context) (*netmap.NetworkMap, error) {
 	var nu rememberLastNetmapUpdater
 	err := c.sendMapRequest(ctx, false, &nu)
 	if err == nil && nu.last == nil {
@@ -830,6 +1722,17 @@ func (c *Direct) SendUpdate(ctx context.Context) error {
 	return c.sendMapRequest(ctx, false, nil)
 }
 
+// mapStatusError is the error returned by sendMapRequest when control answers
+// a map request with a non-200 status.
+type mapStatusError struct {
+	code int    // HTTP status code
+	msg  string // response body, trimmed
+}
+
+func (e mapStatusError) Error() string {
+	return fmt.Sprintf("initial fetch failed %d: %.200s", e.code, e.msg)
+}
+
 // If we go more than watchdogTimeout without hearing from the server,
 // end the long poll. We should be receiving a keep alive ping
 // every minute.
@@ -850,6 +1753,7 @@ func (c *Direct) sendMapRequest(ctx context.Context, isStreaming bool, nu Netmap
 	}
 
 	metricMapRequests.Add(1)
+	c.curStats().mapRequests.Add(1)
 	metricMapRequestsActive.Add(1)
 	defer metricMapRequestsActive.Add(-1)
 	if isStreaming {
@@ -864,13 +1768,16 @@ func (c *Direct) sendMapRequest(ctx context.Context, isStreaming bool, nu Netmap
 	serverNoiseKey := c.serverNoiseKey
 	hi := c.hostInfoLocked()
 	backendLogID := hi.BackendLogID
+	extraHeaders := c.reqHeaders.MapPoll
 	var epStrs []string
 	var eps []netip.AddrPort
 	var epTypes []tailcfg.EndpointType
-	for _, ep := range c.endpoints {
-		eps = append(eps, ep.Addr)
-		epStrs = append(epStrs, ep.Addr.String())
-		epTypes = append(epTypes, ep.Type)
+	if !c.dataPlaneDisabled {
+		for _, ep := range c.endpoints {
+			eps = append(eps, ep.Addr)
+			epStrs = append(epStrs, ep.Addr.String())
+			epTypes = append(epTypes, ep.Type)
+		}
 	}
 	c.mu.Unlock()
 
@@ -878,12 +1785,9 @@ func (c *Direct) sendMapRequest(ctx context.Context, isStreaming bool, nu Netmap
 		return errors.New("control server is too old; no noise key")
 	}
 
-	machinePrivKey, err := c.getMachinePrivKey()
+	machinePubKey, err := c.machinePublicKey()
 	if err != nil {
-		return fmt.Errorf("getMachinePrivKey: %w", err)
-	}
-	if machinePrivKey.IsZero() {
-		return errors.New("getMachinePrivKey returned zero key")
+		return err
 	}
 
 	if persist.PrivateNodeKey().IsZero() {
@@ -892,6 +1796,10 @@ func (c *Direct) sendMapRequest(ctx context.Context, isStreaming bool, nu Netmap
 	if backendLogID == "" {
 		return errors.New("hostinfo: BackendLogID missing")
 	}
+	attestation, err := c.attestation()
+	if err != nil {
+		return err
+	}
 
 	c.logf("[v1] PollNetMap: stream=%v ep=%v", isStreaming, epStrs)
 
@@ -915,6 +1823,9 @@ func (c *Direct) sendMapRequest(ctx context.Context, isStreaming bool, nu Netmap
 		DebugFlags:    c.debugFlags,
 		OmitPeers:     nu == nil,
 		TKAHead:       c.tkaHead,
+		Features:      c.featuresFor(hi),
+		PeerScope:     c.peerScope,
+		Attestation:   attestation,
 	}
 	var extraDebugFlags []string
 	if hi != nil && c.netMon != nil && !c.skipIPForwardingCheck &&
@@ -932,18 +1843,36 @@ func (c *Direct) sendMapRequest(ctx context.Context, isStreaming bool, nu Netmap
 		old := request.DebugFlags
 		request.DebugFlags = append(old[:len(old):len(old)], extraDebugFlags...)
 	}
-	request.Compress = "zstd"
+	request.Compress = c.compression.mapRequestCompress()
+	// Peer latencies go in lite updates, not each time the streaming poll
+	// is reopened, and are put back if the request isn't accepted.
+	var latencySent bool
+	if !isStreaming {
+		var latencySamples map[tailcfg.NodeID][]time.Duration
+		request.PeerLatencies, latencySamples = c.takePeerLatencies()
+		defer func() {
+			if !latencySent {
+				c.restorePeerLatencies(latencySamples)
+			}
+		}()
+	}
 
 	bodyData, err := encode(request)
 	if err != nil {
 		vlogf("netmap: encode: %v", err)
 		return err
 	}
+	c.tapMapRequest(bodyData)
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	defer context.AfterFunc(c.shutdownCtx, cancel)()
+	if !isStreaming {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = c.withHTTPTimeout(ctx)
+		defer cancelTimeout()
+	}
 
-	machinePubKey := machinePrivKey.Public()
 	t0 := c.clock.Now()
 
 	httpc, err := c.getNoiseClient()
@@ -981,6 +1910,7 @@ func (c *Direct) sendMapRequest(ctx context.Context, isStreaming bool, nu Netmap
 	if err != nil {
 		return err
 	}
+	addExtraHeaders(req, extraHeaders)
 	addLBHeader(req, nodeKey)
 
 	res, err := httpc.Do(req)
@@ -992,10 +1922,17 @@ func (c *Direct) sendMapRequest(ctx context.Context, isStreaming bool, nu Netmap
 	if res.StatusCode != 200 {
 		msg, _ := io.ReadAll(res.Body)
 		res.Body.Close()
-		return fmt.Errorf("initial fetch failed %d: %.200s",
-			res.StatusCode, strings.TrimSpace(string(msg)))
+		return mapStatusError{res.StatusCode, strings.TrimSpace(string(msg))}
 	}
 	defer res.Body.Close()
+	latencySent = true
+	if len(eps) > 0 {
+		// The endpoint report interval runs from the last report that
+		// control accepted.
+		c.mu.Lock()
+		c.lastEndpointReport = c.clock.Now()
+		c.mu.Unlock()
+	}
 
 	c.health.NoteMapRequestHeard(request)
 	watchdogTimer.Reset(watchdogTimeout)
@@ -1005,15 +1942,40 @@ func (c *Direct) sendMapRequest(ctx context.Context, isStreaming bool, nu Netmap
 		return nil
 	}
 
-	sess := newMapSession(persist.PrivateNodeKey(), nu, c.controlKnobs)
+	sess := newMapSession(persist.PrivateNodeKey(), c.newPublishingNetmapUpdater(nu), c.controlKnobs)
 	defer sess.Close()
 	sess.cancel = cancel
 	sess.logf = c.logf
 	sess.vlogf = vlogf
 	sess.altClock = c.clock
 	sess.machinePubKey = machinePubKey
+	sess.peerSortLess = c.peerSortLess
+	c.mu.Lock()
+	sess.seedPeers(c.seedPeers)
+	c.seedPeers = nil
+	c.mu.Unlock()
 	sess.onDebug = c.handleDebugMessage
+	var peersChanged peerChanges // from the MapResponse being handled
+	sess.onPeersUpdated = func(full bool, changed []tailcfg.NodeView, removed []tailcfg.NodeID) {
+		c.updatePeers(full, changed, removed)
+		peersChanged = peerChanges{ok: true, full: full, changed: changed, removed: removed}
+	}
+	if c.onEmptyDERPMap != nil {
+		sess.onEmptyDERPMap = c.onEmptyDERPMap
+	}
+	if c.onInvalidNode != nil {
+		sess.onInvalidNode = c.onInvalidNode
+	}
+	if c.onQuarantinedPeers != nil {
+		sess.quarantinePeers = true
+		sess.onQuarantinedPeers = c.onQuarantinedPeers
+	}
+	sess.validateDeltas = c.validateDeltas
+	sess.malformedPeerPolicy = c.malformedPeerPolicy
+	sess.peerFilter = c.peerFilter
+	sess.onPeerDelta = c.onPeerDelta
 	sess.onSelfNodeChanged = func(nm *netmap.NetworkMap) {
+		defer c.noteKeyExpiry(nm.Expiry) // after c.mu is released
 		c.mu.Lock()
 		defer c.mu.Unlock()
 		// If we are the ones who last updated persist, then we can update it
@@ -1028,11 +1990,14 @@ func (c *Direct) sendMapRequest(ctx context.Context, isStreaming bool, nu Netmap
 			persist = c.persist
 		}
 		c.expiry = nm.Expiry
+		c.peerLatencyAllowed = c.reportPeerLatency && nm.HasCap(tailcfg.NodeAttrReportPeerLatency)
 	}
 
 	// gotNonKeepAliveMessage is whether we've yet received a MapResponse message without
 	// KeepAlive set.
 	var gotNonKeepAliveMessage bool
+	var lastSeq int64 // last MapResponse.Seq seen in this stream, or 0
+	var notedFirstMap bool
 
 	// If allowStream, then the server will use an HTTP long poll to
 	// return incremental results. There is always one response right
@@ -1051,6 +2016,9 @@ func (c *Direct) sendMapRequest(ctx context.Context, isStreaming bool, nu Netmap
 		}
 		size := binary.LittleEndian.Uint32(siz[:])
 		vlogf("netmap: read size %v after %v", size, time.Since(t0).Round(time.Millisecond))
+		if int64(size) > int64(maxMapResponseSize) {
+			return fmt.Errorf("netmap: %w (%d bytes)", errMapResponseTooLarge, size)
+		}
 		msg = append(msg[:0], make([]byte, size)...)
 		if _, err := io.ReadFull(res.Body, msg); err != nil {
 			vlogf("netmap: body read error: %v", err)
@@ -1066,6 +2034,10 @@ func (c *Direct) sendMapRequest(ctx context.Context, isStreaming bool, nu Netmap
 		watchdogTimer.Stop()
 
 		metricMapResponseMessages.Add(1)
+		c.curStats().mapResponses.Add(1)
+		if c.onMapPollHeartbeat != nil {
+			c.onMapPollHeartbeat(c.clock.Now(), resp.KeepAlive)
+		}
 
 		if isStreaming {
 			c.health.GotStreamedMapResponse()
@@ -1089,6 +2061,7 @@ func (c *Direct) sendMapRequest(ctx context.Context, isStreaming bool, nu Netmap
 		}
 		if resp.ControlTime != nil && !resp.ControlTime.IsZero() {
 			c.logf.JSON(1, "controltime", resp.ControlTime.UTC())
+			c.checkClockSkew(*resp.ControlTime)
 			if c.onControlTime != nil {
 				c.onControlTime(*resp.ControlTime)
 			}
@@ -1108,6 +2081,14 @@ func (c *Direct) sendMapRequest(ctx context.Context, isStreaming bool, nu Netmap
 		}
 		if resp.KeepAlive {
 			metricMapResponseKeepAlives.Add(1)
+			c.curStats().keepAlives.Add(1)
+			continue
+		}
+		if !c.checkResponseSeq(&lastSeq, &resp) {
+			continue
+		}
+		if !sess.addPeersPage(&resp) {
+			// More of a paginated peer list to come.
 			continue
 		}
 		if au, ok := resp.DefaultAutoUpdate.Get(); ok {
@@ -1115,6 +2096,25 @@ func (c *Direct) sendMapRequest(ctx context.Context, isStreaming bool, nu Netmap
 				c.onTailnetDefaultAutoUpdate(au)
 			}
 		}
+		if v, ok := resp.DataPlaneDisabled.Get(); ok {
+			c.setDataPlaneDisabled(v)
+		}
+		if d := resp.EphemeralTTL; d > 0 {
+			c.setEphemeralTTL(d)
+		}
+		if ti := resp.TKAInfo; ti != nil {
+			c.setTKAState(TKAState{Enabled: !ti.Disabled, Head: ti.Head})
+		} else if !gotNonKeepAliveMessage {
+			// A nil TKAInfo in the initial response means that tailnet
+			// lock isn't enabled; in later ones, that it's unchanged.
+			c.setTKAState(TKAState{})
+		}
+		if d := resp.EndpointReportInterval; d != 0 {
+			c.setEndpointReportInterval(max(d, 0))
+		}
+		if id := resp.RediscoverEndpoints; id != "" {
+			c.rediscoverEndpoints(id)
+		}
 
 		metricMapResponseMap.Add(1)
 		if gotNonKeepAliveMessage {
@@ -1127,9 +2127,15 @@ func (c *Direct) sendMapRequest(ctx context.Context, isStreaming bool, nu Netmap
 		}
 		gotNonKeepAliveMessage = true
 
+		peersChanged = peerChanges{}
 		if err := sess.HandleNonKeepAliveMapResponse(ctx, &resp); err != nil {
 			return err
 		}
+		c.notifyChanges(&resp, peersChanged)
+		if !notedFirstMap {
+			notedFirstMap = true
+			c.noteFirstMap()
+		}
 	}
 	if ctx.Err() != nil {
 		return ctx.Err()
@@ -1137,6 +2143,203 @@ func (c *Direct) sendMapRequest(ctx context.Context, isStreaming bool, nu Netmap
 	return nil
 }
 
+// setDataPlaneDisabled records whether control has disabled this node's data
+// plane, notifying the OnDataPlaneDisabled callback on transitions.
+//
+// While disabled, the map session stays up and the netmap is kept current,
+// but endpoints are withheld from subsequent MapRequests. The streaming map
+// request isn't resent, so the change only reaches control with the next lite
+// update; see onDataPlaneChanged.
+func (c *Direct) setDataPlaneDisabled(v bool) {
+	c.mu.Lock()
+	if c.dataPlaneDisabled == v {
+		c.mu.Unlock()
+		return
+	}
+	c.dataPlaneDisabled = v
+	changed := c.onDataPlaneChanged
+	c.mu.Unlock()
+
+	c.logf("netmap: control set data plane disabled=%v", v)
+	if changed != nil {
+		changed()
+	}
+	if c.onDataPlaneDisabled != nil {
+		c.onDataPlaneDisabled(v)
+	}
+}
+
+// noteFirstMap records the time to the first processed netmap, if this is the
+// first, and reports it to the OnFirstMap callback.
+func (c *Direct) noteFirstMap() {
+	d := c.clock.Since(c.created)
+	c.mu.Lock()
+	if c.gotFirstMap {
+		c.mu.Unlock()
+		return
+	}
+	c.gotFirstMap = true
+	c.timeToFirstMap = d
+	c.mu.Unlock()
+
+	c.logf("netmap: first map processed %v after start", d.Round(time.Millisecond))
+	if c.onFirstMap != nil {
+		c.onFirstMap(d)
+	}
+}
+
+// TimeToFirstMap reports how long after NewDirect the first netmap was
+// processed, for startup profiling. It reports false if no netmap has been
+// processed yet.
+func (c *Direct) TimeToFirstMap() (_ time.Duration, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.timeToFirstMap, c.gotFirstMap
+}
+
+// checkResponseSeq reports whether resp should be processed given the Seq of
+// the previous response in the same stream, updating *lastSeq.
+//
+// It only verifies sequence numbers if Options.OnOutOfOrderResponse was set.
+// A response with a Seq that doesn't increase (a replayed or reordered
+// message, e.g. from a misbehaving proxy) is then logged, reported and
+// rejected. Responses without a Seq aren't checked, and a full netmap (one
+// with a non-nil Peers) resets the baseline.
+func (c *Direct) checkResponseSeq(lastSeq *int64, resp *tailcfg.MapResponse) bool {
+	if c.onOutOfOrderResponse == nil || resp.Seq == 0 {
+		return true
+	}
+	if resp.Peers == nil && *lastSeq != 0 && resp.Seq <= *lastSeq {
+		metricMapResponseOutOfOrder.Add(1)
+		c.logf("netmap: ignoring out-of-order map response; seq %d after %d", resp.Seq, *lastSeq)
+		c.onOutOfOrderResponse(*lastSeq, resp.Seq)
+		return false
+	}
+	*lastSeq = resp.Seq
+	return true
+}
+
+// setEphemeralTTL records the cleanup TTL control reported for this
+// ephemeral node, notifying the OnEphemeralTTL callback when it changes.
+func (c *Direct) setEphemeralTTL(d time.Duration) {
+	c.mu.Lock()
+	if c.ephemeralTTL == d {
+		c.mu.Unlock()
+		return
+	}
+	c.ephemeralTTL = d
+	ephemeral := c.ephemeral
+	c.mu.Unlock()
+
+	c.logf("netmap: control says ephemeral node TTL is %v (ephemeral=%v)", d, ephemeral)
+	if c.onEphemeralTTL != nil {
+		c.onEphemeralTTL(d)
+	}
+}
+
+// setEndpointReportInterval records control's minimum interval between
+// endpoint reports, notifying the OnEndpointReportInterval callback when it
+// changes. Zero means no limit.
+func (c *Direct) setEndpointReportInterval(d time.Duration) {
+	c.mu.Lock()
+	if c.endpointReportInterval == d {
+		c.mu.Unlock()
+		return
+	}
+	c.endpointReportInterval = d
+	c.mu.Unlock()
+
+	c.logf("netmap: control says to report endpoints at most every %v", d)
+	if c.onEndpointReportInterval != nil {
+		c.onEndpointReportInterval(d)
+	}
+}
+
+// rediscoverEndpoints calls the OnRediscoveryRequested callback for
+// control's endpoint rediscovery request with the given ID, unless it's the
+// same request as last time.
+func (c *Direct) rediscoverEndpoints(id string) {
+	c.mu.Lock()
+	if id == c.lastRediscoverID {
+		c.mu.Unlock()
+		return
+	}
+	c.lastRediscoverID = id
+	c.mu.Unlock()
+
+	c.logf("netmap: control requested endpoint rediscovery (%q)", id)
+	metricMapResponseRediscover.Add(1)
+	if c.onRediscoveryRequested != nil {
+		c.onRediscoveryRequested()
+	}
+}
+
+// endpointReportDelay returns how long to wait before sending changed
+// endpoints to control, to honor its EndpointReportInterval and
+// Options.EndpointPushMinInterval. It returns zero if they can be sent now.
+func (c *Direct) endpointReportDelay() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.endpointReportDelayLocked()
+}
+
+// endpointReportDelayLocked is endpointReportDelay with c.mu held.
+func (c *Direct) endpointReportDelayLocked() time.Duration {
+	interval := max(c.endpointReportInterval, c.endpointPushMinInterval)
+	if interval <= 0 || c.lastEndpointReport.IsZero() {
+		return 0
+	}
+	return max(interval-c.clock.Since(c.lastEndpointReport), 0)
+}
+
+// attestation returns the hardware attestation to send in a MapRequest, or
+// nil if there's none. It only returns an error if Options.RequireAttestation
+// is set and no attestation is available.
+func (c *Direct) attestation() ([]byte, error) {
+	if c.attestationProvider == nil {
+		if c.requireAttestation {
+			return nil, errors.New("attestation required but no AttestationProvider set")
+		}
+		return nil, nil
+	}
+	b, err := c.attestationProvider()
+	if err == nil && len(b) == 0 {
+		err = errors.New("empty attestation")
+	}
+	if err != nil {
+		if c.requireAttestation {
+			return nil, fmt.Errorf("attestation required: %w", err)
+		}
+		c.logf("[v1] sending map request without attestation: %v", err)
+		return nil, nil
+	}
+	return b, nil
+}
+
+// newNodeKey returns a new node private key from Options.GenerateNodeKey, or
+// from key.NewNode if that's nil.
+func (c *Direct) newNodeKey() (key.NodePrivate, error) {
+	if c.generateNodeKey == nil {
+		return key.NewNode(), nil
+	}
+	k, err := c.generateNodeKey()
+	if err != nil {
+		return key.NodePrivate{}, fmt.Errorf("GenerateNodeKey: %w", err)
+	}
+	if k.IsZero() {
+		return key.NodePrivate{}, errors.New("GenerateNodeKey returned a zero key")
+	}
+	return k, nil
+}
+
+// IsEphemeral reports whether the node most recently registered as an
+// ephemeral node.
+func (c *Direct) IsEphemeral() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ephemeral
+}
+
 func (c *Direct) handleDebugMessage(ctx context.Context, debug *tailcfg.Debug) error {
 	if code := debug.Exit; code != nil {
 		c.logf("exiting process with status %v per controlplane", *code)
@@ -1176,6 +2379,15 @@ func initDisplayNames(selfNode tailcfg.NodeView, resp *tailcfg.MapResponse) {
 	}
 }
 
+// withHTTPTimeout returns ctx bounded by Options.HTTPClient's Timeout, if
+// any, for a request over Noise that doesn't stream.
+func (c *Direct) withHTTPTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.httpTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.httpTimeout)
+}
+
 // decode JSON decodes the res.Body into v.
 func decode(res *http.Response, v any) error {
 	defer res.Body.Close()
@@ -1198,7 +2410,11 @@ func decode(res *http.Response, v any) error {
 
 // decodeMsg is responsible for uncompressing msg and unmarshaling into v.
 func (c *Direct) decodeMsg(compressedMsg []byte, v any) error {
-	b, err := zstdframe.AppendDecode(nil, compressedMsg)
+	if isCompressedMsg(compressedMsg) && !debugMap() && c.onRawMapResponse == nil {
+		// Nothing needs the JSON itself, so decode it as it's decompressed.
+		return decodeCompressedMsg(compressedMsg, v)
+	}
+	b, err := decompressMsg(compressedMsg)
 	if err != nil {
 		return err
 	}
@@ -1207,6 +2423,14 @@ func (c *Direct) decodeMsg(compressedMsg []byte, v any) error {
 		json.Indent(&buf, b, "", "    ")
 		log.Printf("MapResponse: %s", buf.Bytes())
 	}
+	if c.onRawMapResponse != nil {
+		if !isCompressedMsg(compressedMsg) {
+			// b is the poll loop's read buffer, which is reused for the
+			// next message, but the callee owns what it's given.
+			b = bytes.Clone(b)
+		}
+		c.onRawMapResponse(b)
+	}
 
 	if bytes.Contains(b, jsonEscapedZero) {
 		log.Printf("[unexpected] zero byte in controlclient.Direct.decodeMsg into %T: %q", v, b)
@@ -1240,7 +2464,7 @@ func loadServerPubKeys(ctx context.Context, httpc *http.Client, serverURL string
 	}
 	res, err := httpc.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("fetch control key: %v", err)
+		return nil, fmt.Errorf("fetch control key: %w", err)
 	}
 	defer res.Body.Close()
 	b, err := io.ReadAll(io.LimitReader(res.Body, 64<<10))
@@ -1471,22 +2695,31 @@ func (c *Direct) getNoiseClient() (*NoiseClient, error) {
 		dp = c.dialPlan.Load
 	}
 	nc, err, _ := c.sfGroup.Do(struct{}{}, func() (*NoiseClient, error) {
-		k, err := c.getMachinePrivKey()
-		if err != nil {
-			return nil, err
+		var k key.MachinePrivate
+		if c.machineKeySigner == nil {
+			var err error
+			if k, err = c.getMachinePrivKey(); err != nil {
+				return nil, err
+			}
 		}
 		c.logf("[v1] creating new noise client")
-		nc, err := NewNoiseClient(NoiseOpts{
-			PrivKey:       k,
-			ServerPubKey:  serverNoiseKey,
-			ServerURL:     c.serverURL,
-			Dialer:        c.dialer,
-			DNSCache:      c.dnsCache,
-			Logf:          c.logf,
-			NetMon:        c.netMon,
-			HealthTracker: c.health,
-			DialPlan:      dp,
-		})
+		opts := NoiseOpts{
+			PrivKey:          k,
+			MachineKeySigner: c.machineKeySigner,
+			ServerPubKey:     serverNoiseKey,
+			ServerURL:        c.serverURL,
+			Dialer:           c.dialer,
+			DNSCache:         c.dnsCache,
+			Logf:             c.logf,
+			NetMon:           c.netMon,
+			HealthTracker:    c.health,
+			DialPlan:         dp,
+		}
+		if tr := c.noiseTransport; tr != nil {
+			opts.Proxy = tr.Proxy
+			opts.ProxyConnectHeader = tr.ProxyConnectHeader
+		}
+		nc, err := NewNoiseClient(opts)
 		if err != nil {
 			return nil, err
 		}
@@ -1501,6 +2734,26 @@ func (c *Direct) getNoiseClient() (*NoiseClient, error) {
 	return nc, nil
 }
 
+// machinePublicKey returns the machine public key, from c.machineKeySigner if
+// set, and otherwise from c.getMachinePrivKey.
+func (c *Direct) machinePublicKey() (key.MachinePublic, error) {
+	if c.machineKeySigner != nil {
+		k := c.machineKeySigner.Public()
+		if k.IsZero() {
+			return key.MachinePublic{}, errors.New("MachineKeySigner returned zero key")
+		}
+		return k, nil
+	}
+	k, err := c.getMachinePrivKey()
+	if err != nil {
+		return key.MachinePublic{}, fmt.Errorf("getMachinePrivKey: %w", err)
+	}
+	if k.IsZero() {
+		return key.MachinePublic{}, errors.New("getMachinePrivKey returned zero key")
+	}
+	return k.Public(), nil
+}
+
 // setDNSNoise sends the SetDNSRequest request to the control plane server over Noise,
 // requesting a DNS record be created or updated.
 func (c *Direct) setDNSNoise(ctx context.Context, req *tailcfg.SetDNSRequest) error {
@@ -1704,6 +2957,15 @@ func addLBHeader(req *http.Request, nodeKey key.NodePublic) {
 	}
 }
 
+// addExtraHeaders adds the user-configured headers h to req.
+func addExtraHeaders(req *http.Request, h http.Header) {
+	for k, vv := range h {
+		for _, v := range vv {
+			req.Header.Add(k, v)
+		}
+	}
+}
+
 var (
 	metricMapRequestsActive = clientmetric.NewGauge("controlclient_map_requests_active")
 
@@ -1714,8 +2976,10 @@ func addLBHeader(req *http.Request, nodeKey key.NodePublic) {
 	metricMapResponseMessages   = clientmetric.NewCounter("controlclient_map_response_message") // any message type
 	metricMapResponsePings      = clientmetric.NewCounter("controlclient_map_response_ping")
 	metricMapResponseKeepAlives = clientmetric.NewCounter("controlclient_map_response_keepalive")
-	metricMapResponseMap        = clientmetric.NewCounter("controlclient_map_response_map")       // any non-keepalive map response
-	metricMapResponseMapDelta   = clientmetric.NewCounter("controlclient_map_response_map_delta") // 2nd+ non-keepalive map response
+	metricMapResponseMap        = clientmetric.NewCounter("controlclient_map_response_map")          // any non-keepalive map response
+	metricMapResponseMapDelta   = clientmetric.NewCounter("controlclient_map_response_map_delta")    // 2nd+ non-keepalive map response
+	metricMapResponseOutOfOrder = clientmetric.NewCounter("controlclient_map_response_out_of_order") // rejected by OnOutOfOrderResponse checking
+	metricMapResponseRediscover = clientmetric.NewCounter("controlclient_map_response_rediscover")   // distinct RediscoverEndpoints requests
 
 	metricSetDNS      = clientmetric.NewCounter("controlclient_setdns")
 	metricSetDNSError = clientmetric.NewCounter("controlclient_setdns_error")
@@ -4,20 +4,49 @@
 package controlclient
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/ed25519"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
+	"golang.org/x/crypto/curve25519"
+	"tailscale.com/envknob"
 	"tailscale.com/hostinfo"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/netmon"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
 	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/opt"
+	"tailscale.com/types/persist"
+	"tailscale.com/util/mak"
+	"tailscale.com/util/must"
+	"tailscale.com/util/zstdframe"
 )
 
 func TestNewDirect(t *testing.T) {
@@ -87,6 +116,59 @@ func TestNewDirect(t *testing.T) {
 	}
 }
 
+func TestDirectNetInfo(t *testing.T) {
+	hi := hostinfo.New()
+	ni := tailcfg.NetInfo{LinkType: "wired"}
+	hi.NetInfo = &ni
+
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1000, 0)})
+	k := key.NewMachine()
+	c, err := NewDirect(Options{
+		ServerURL: "https://example.com",
+		Hostinfo:  hi,
+		GetMachinePrivateKey: func() (key.MachinePrivate, error) {
+			return k, nil
+		},
+		Dialer: tsdial.NewDialer(netmon.NewStatic()),
+		Clock:  clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(wantLinkType string, wantTime time.Time) {
+		t.Helper()
+		got, changed := c.NetInfo()
+		if got == nil || got.LinkType != wantLinkType {
+			t.Errorf("c.NetInfo() = %v; want LinkType %q", got, wantLinkType)
+		}
+		if !changed.Equal(wantTime) {
+			t.Errorf("c.NetInfo() changed at %v; want %v", changed, wantTime)
+		}
+	}
+	// The Hostinfo's NetInfo is stored by NewDirect.
+	start := clock.Now()
+	check("wired", start)
+
+	// Setting the same NetInfo later doesn't count as a change.
+	clock.Advance(time.Minute)
+	if c.SetNetInfo(&ni) {
+		t.Errorf("c.SetNetInfo(ni) want false got true")
+	}
+	check("wired", start)
+
+	ni = tailcfg.NetInfo{LinkType: "wifi"}
+	if !c.SetNetInfo(&ni) {
+		t.Errorf("c.SetNetInfo(ni) want true got false")
+	}
+	check("wifi", clock.Now())
+
+	// The returned NetInfo is a copy.
+	got, _ := c.NetInfo()
+	got.LinkType = "mobile"
+	check("wifi", clock.Now())
+}
+
 func fakeEndpoints(ports ...uint16) (ret []tailcfg.Endpoint) {
 	for _, port := range ports {
 		ret = append(ret, tailcfg.Endpoint{
@@ -186,3 +268,1973 @@ func TestDecodeWrappedAuthkey(t *testing.T) {
 	}
 
 }
+
+// testMapServer is a fake control server that answers /machine/map requests
+// made by a Direct.
+type testMapServer struct {
+	t  testing.TB
+	ts *httptest.Server
+
+	mu sync.Mutex
+	// stream, if non-nil, is called to answer each streaming MapRequest,
+	// and each non-streaming one that fetches the netmap. It sends
+	// MapResponses to the client with send. The long-poll ends when stream
+	// returns; a non-streaming request only reads the first response.
+	stream  func(req *tailcfg.MapRequest, send func(*tailcfg.MapResponse))
+	reqs    []*tailcfg.MapRequest      // all MapRequests received, in order
+	regReqs []*tailcfg.RegisterRequest // all RegisterRequests received, in order
+	headers map[string]http.Header     // last request headers, keyed by URL path
+	fails   []int                      // status codes to answer the next MapRequests with
+	regErr  string                     // if non-empty, RegisterResponse.Error to reply with
+	regHang bool                       // if set, RegisterRequests get no reply until canceled
+}
+
+func newTestMapServer(t testing.TB) *testMapServer {
+	s := &testMapServer{t: t}
+	s.ts = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.ts.Close)
+	return s
+}
+
+func (s *testMapServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	mak.Set(&s.headers, r.URL.Path, r.Header.Clone())
+	s.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/key":
+		json.NewEncoder(w).Encode(&tailcfg.OverTLSPublicKeyResponse{
+			LegacyPublicKey: key.NewMachine().Public(),
+			PublicKey:       key.NewMachine().Public(),
+		})
+		return
+	case "/machine/register":
+		s.serveRegister(w, r)
+		return
+	case "/machine/map":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	req := new(tailcfg.MapRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.reqs = append(s.reqs, req)
+	stream := s.stream
+	var fail int
+	if len(s.fails) > 0 {
+		fail, s.fails = s.fails[0], s.fails[1:]
+	}
+	s.mu.Unlock()
+
+	if fail != 0 {
+		http.Error(w, http.StatusText(fail), fail)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if (!req.Stream && req.OmitPeers) || stream == nil {
+		return
+	}
+	stream(req, func(res *tailcfg.MapResponse) {
+		b := compressMapResponse(req.Compress, must.Get(json.Marshal(res)))
+		var siz [4]byte
+		binary.LittleEndian.PutUint32(siz[:], uint32(len(b)))
+		w.Write(siz[:])
+		w.Write(b)
+		w.(http.Flusher).Flush()
+	})
+}
+
+// compressMapResponse compresses j, a MapResponse's JSON, as asked for by a
+// MapRequest's Compress field.
+func compressMapResponse(compress string, j []byte) []byte {
+	switch compress {
+	case "zstd":
+		return zstdframe.AppendEncode(nil, j)
+	case "gzip":
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(j)
+		zw.Close()
+		return buf.Bytes()
+	}
+	return j
+}
+
+func (s *testMapServer) serveRegister(w http.ResponseWriter, r *http.Request) {
+	req := new(tailcfg.RegisterRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.regReqs = append(s.regReqs, req)
+	regErr, regHang := s.regErr, s.regHang
+	s.mu.Unlock()
+	if regHang {
+		<-r.Context().Done()
+		return
+	}
+
+	json.NewEncoder(w).Encode(&tailcfg.RegisterResponse{
+		User:              tailcfg.User{ID: 1},
+		Login:             tailcfg.Login{ID: 1, LoginName: "test@example.com"},
+		MachineAuthorized: regErr == "",
+		Error:             regErr,
+	})
+}
+
+// header returns the headers of the last request received for path.
+func (s *testMapServer) header(path string) http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.headers[path]
+}
+
+// setStream sets the func used to answer streaming MapRequests.
+func (s *testMapServer) setStream(stream func(req *tailcfg.MapRequest, send func(*tailcfg.MapResponse))) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stream = stream
+}
+
+// failNextMaps makes s answer the next MapRequests with the given HTTP
+// status codes, in order.
+func (s *testMapServer) failNextMaps(codes ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fails = append(s.fails, codes...)
+}
+
+// requests returns the MapRequests received so far.
+func (s *testMapServer) requests() []*tailcfg.MapRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*tailcfg.MapRequest(nil), s.reqs...)
+}
+
+// lastRequest returns the most recently received MapRequest.
+func (s *testMapServer) lastRequest() *tailcfg.MapRequest {
+	reqs := s.requests()
+	if len(reqs) == 0 {
+		s.t.Fatal("no MapRequests received")
+	}
+	return reqs[len(reqs)-1]
+}
+
+// newDirect returns a logged-in Direct that talks to s, filling in any
+// required fields not already set in opts.
+func (s *testMapServer) newDirect(opts Options) *Direct {
+	s.t.Helper()
+	opts.ServerURL = s.ts.URL
+	opts.HTTPTestClient = s.ts.Client()
+	opts.NoiseTestClient = s.ts.Client()
+	if opts.GetMachinePrivateKey == nil && opts.MachineKeySigner == nil {
+		k := key.NewMachine()
+		opts.GetMachinePrivateKey = func() (key.MachinePrivate, error) { return k, nil }
+	}
+	if opts.Dialer == nil {
+		opts.Dialer = tsdial.NewDialer(netmon.NewStatic())
+	}
+	if opts.Persist.PrivateNodeKey.IsZero() {
+		opts.Persist.PrivateNodeKey = key.NewNode()
+	}
+	if opts.Hostinfo == nil {
+		opts.Hostinfo = &tailcfg.Hostinfo{BackendLogID: "test-backend-log-id"}
+	}
+	if opts.Logf == nil {
+		opts.Logf = s.t.Logf
+	}
+	c, err := NewDirect(opts)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// pollNetMap runs a streaming map poll against the fake server until the
+// server's stream func returns, returning the netmaps received.
+func pollNetMap(t testing.TB, c *Direct) []*netmap.NetworkMap {
+	t.Helper()
+	var nu recordingNetmapUpdater
+	c.PollNetMap(context.Background(), &nu)
+	return nu.nms
+}
+
+type recordingNetmapUpdater struct {
+	nms []*netmap.NetworkMap
+}
+
+func (nu *recordingNetmapUpdater) UpdateFullNetmap(nm *netmap.NetworkMap) {
+	nu.nms = append(nu.nms, nm)
+}
+
+func TestMapCompression(t *testing.T) {
+	peers := []*tailcfg.Node{
+		{ID: 2, Name: "peer2.example.ts.net.", Key: key.NewNode().Public(), Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")}},
+		{ID: 3, Name: "peer3.example.ts.net.", Key: key.NewNode().Public(), Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.3/32")}},
+	}
+	pollPeers := func(t *testing.T, opts Options, wantCompress string) []tailcfg.NodeView {
+		t.Helper()
+		srv := newTestMapServer(t)
+		c := srv.newDirect(opts)
+		srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+			send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 1}, Peers: peers})
+		})
+		nms := pollNetMap(t, c)
+		if len(nms) != 1 {
+			t.Fatalf("got %d netmaps; want 1", len(nms))
+		}
+		if got := srv.lastRequest().Compress; got != wantCompress {
+			t.Errorf("MapRequest.Compress = %q; want %q", got, wantCompress)
+		}
+		return nms[0].Peers
+	}
+
+	want := pollPeers(t, Options{Compression: CompressionNone}, "")
+	if len(want) != len(peers) {
+		t.Fatalf("got %d peers uncompressed; want %d", len(want), len(peers))
+	}
+	tests := []struct {
+		name         string
+		opts         Options
+		wantCompress string
+	}{
+		{"zstd", Options{}, "zstd"},
+		{"gzip", Options{Compression: CompressionGzip}, "gzip"},
+		{"zstd-raw", Options{OnRawMapResponse: func([]byte) {}}, "zstd"},
+		{"gzip-raw", Options{Compression: CompressionGzip, OnRawMapResponse: func([]byte) {}}, "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pollPeers(t, tt.opts, tt.wantCompress); !reflect.DeepEqual(got, want) {
+				t.Errorf("peers differ from uncompressed:\n got: %v\nwant: %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMapResponseSizeLimit(t *testing.T) {
+	j := must.Get(json.Marshal(&tailcfg.MapResponse{Domain: strings.Repeat("x", 1000)}))
+	defer func(old int) { maxMapResponseSize = old }(maxMapResponseSize)
+	for _, compress := range []string{"zstd", "gzip"} {
+		msg := compressMapResponse(compress, j)
+		for _, tt := range []struct {
+			limit   int
+			wantErr bool
+		}{
+			{len(j), false},
+			{len(j) - 1, true},
+		} {
+			maxMapResponseSize = tt.limit
+			check := func(fn string, err error) {
+				t.Helper()
+				if tt.wantErr && !errors.Is(err, errMapResponseTooLarge) || !tt.wantErr && err != nil {
+					t.Errorf("%s: %s with limit %d: err = %v; want too large = %v", compress, fn, tt.limit, err, tt.wantErr)
+				}
+			}
+			_, err := decompressMsg(msg)
+			check("decompressMsg", err)
+			var res tailcfg.MapResponse
+			check("decodeCompressedMsg", decodeCompressedMsg(msg, &res))
+		}
+	}
+
+	// Messages are also limited as framed on the wire.
+	maxMapResponseSize = 100
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{Compression: CompressionNone})
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Domain: strings.Repeat("x", 1000)})
+	})
+	err := c.PollNetMap(context.Background(), new(recordingNetmapUpdater))
+	if !errors.Is(err, errMapResponseTooLarge) {
+		t.Errorf("PollNetMap error = %v; want too large", err)
+	}
+}
+
+func TestZeroEscapeReader(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want bool
+	}{
+		{`{"a":"b"}`, false},
+		{`{"a":"\u0000"}`, true},
+		{`{"a":"\u000"}`, false},
+		{`\u0000`, true},
+	} {
+		// Byte at a time, so the escape is split across reads.
+		zr := &zeroEscapeReader{r: iotest.OneByteReader(strings.NewReader(tt.in))}
+		if _, err := io.ReadAll(zr); err != nil {
+			t.Fatal(err)
+		}
+		if zr.found != tt.want {
+			t.Errorf("%s: found = %v; want %v", tt.in, zr.found, tt.want)
+		}
+		zr = &zeroEscapeReader{r: strings.NewReader(tt.in)}
+		io.ReadAll(zr)
+		if zr.found != tt.want {
+			t.Errorf("%s in one read: found = %v; want %v", tt.in, zr.found, tt.want)
+		}
+	}
+}
+
+func TestDataPlaneDisabled(t *testing.T) {
+	srv := newTestMapServer(t)
+	var got []bool
+	c := srv.newDirect(Options{
+		OnDataPlaneDisabled: func(v bool) { got = append(got, v) },
+	})
+	c.SetNetInfo(&tailcfg.NetInfo{PreferredDERP: 1})
+	c.SetEndpoints([]tailcfg.Endpoint{
+		{Addr: netip.MustParseAddrPort("192.168.1.5:41641"), Type: tailcfg.EndpointLocal},
+		{Addr: netip.MustParseAddrPort("203.0.113.7:41641"), Type: tailcfg.EndpointSTUN},
+	})
+
+	// sendAndCheckEndpoints checks that a map update carries want
+	// endpoints, and the public IP derived from them only if any.
+	sendAndCheckEndpoints := func(want int) {
+		t.Helper()
+		if err := c.SendUpdate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		req := srv.lastRequest()
+		if n := len(req.Endpoints); n != want {
+			t.Errorf("MapRequest had %d endpoints; want %d", n, want)
+		}
+		if got, want := len(req.Hostinfo.NetInfo.PublicIPs) > 0, want > 0; got != want {
+			t.Errorf("MapRequest NetInfo.PublicIPs = %v; want reported = %v", req.Hostinfo.NetInfo.PublicIPs, want)
+		}
+	}
+	sendAndCheckEndpoints(2)
+
+	// Enter: control disables the data plane.
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 1}, DataPlaneDisabled: "true"})
+		send(&tailcfg.MapResponse{Domain: "still-updating.example"})
+	})
+	nms := pollNetMap(t, c)
+	if len(nms) != 2 {
+		t.Fatalf("got %d netmaps; want 2 (config kept current)", len(nms))
+	}
+	if nms[1].Domain != "still-updating.example" {
+		t.Errorf("netmap Domain = %q; want update applied while disabled", nms[1].Domain)
+	}
+	if want := []bool{true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("OnDataPlaneDisabled calls = %v; want %v", got, want)
+	}
+	sendAndCheckEndpoints(0)
+
+	// An unset value in a later response doesn't change anything.
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 1}})
+	})
+	pollNetMap(t, c)
+	if want := []bool{true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("OnDataPlaneDisabled calls = %v; want %v", got, want)
+	}
+	sendAndCheckEndpoints(0)
+
+	// Exit: control lifts the hold.
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 1}, DataPlaneDisabled: "false"})
+	})
+	pollNetMap(t, c)
+	if want := []bool{true, false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("OnDataPlaneDisabled calls = %v; want %v", got, want)
+	}
+	sendAndCheckEndpoints(2)
+}
+
+func TestPerRequestHeaders(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{
+		PerRequestHeaders: RequestHeaders{
+			Login:   http.Header{"X-Route": {"login"}},
+			MapPoll: http.Header{"X-Route": {"map"}, "X-Map-Only": {"1"}},
+			Logout:  http.Header{"X-Route": {"logout"}},
+		},
+	})
+	ctx := context.Background()
+
+	checkHeader := func(path, k, want string) {
+		t.Helper()
+		if got := srv.header(path).Get(k); got != want {
+			t.Errorf("%s: header %q = %q; want %q", path, k, got, want)
+		}
+	}
+
+	if _, err := c.TryLogin(ctx, nil, LoginDefault); err != nil {
+		t.Fatal(err)
+	}
+	checkHeader("/machine/register", "X-Route", "login")
+	checkHeader("/machine/register", "X-Map-Only", "")
+
+	if err := c.SendUpdate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkHeader("/machine/map", "X-Route", "map")
+	checkHeader("/machine/map", "X-Map-Only", "1")
+	if got := srv.header("/machine/map").Get(tailcfg.LBHeader); got == "" {
+		t.Errorf("map request lost %s header", tailcfg.LBHeader)
+	}
+
+	if err := c.TryLogout(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkHeader("/machine/register", "X-Route", "logout")
+
+	if err := c.SetCustomHeaders(RequestHeaders{MapPoll: http.Header{"X-Route": {"map2"}}}); err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	c.persist = (&persist.Persist{PrivateNodeKey: key.NewNode()}).View()
+	c.mu.Unlock()
+	if err := c.SendUpdate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkHeader("/machine/map", "X-Route", "map2")
+	checkHeader("/machine/map", "X-Map-Only", "")
+}
+
+func TestPerRequestHeadersReserved(t *testing.T) {
+	for _, h := range []RequestHeaders{
+		{Login: http.Header{"Content-Type": {"text/plain"}}},
+		{MapPoll: http.Header{tailcfg.LBHeader: {"x"}}},
+		{Logout: http.Header{"host": {"example.com"}}},
+	} {
+		_, err := NewDirect(Options{
+			ServerURL:            "https://example.com",
+			GetMachinePrivateKey: func() (key.MachinePrivate, error) { return key.NewMachine(), nil },
+			Dialer:               tsdial.NewDialer(netmon.NewStatic()),
+			PerRequestHeaders:    h,
+		})
+		if err == nil {
+			t.Errorf("NewDirect with %+v: got nil error; want reserved header error", h)
+		}
+	}
+
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{})
+	if err := c.SetCustomHeaders(RequestHeaders{MapPoll: http.Header{"Ts-Lb": {"x"}}}); err == nil {
+		t.Error("SetCustomHeaders with reserved header: got nil error")
+	}
+}
+
+func TestNodeIdentityFile(t *testing.T) {
+	newDirect := func(path string) *Direct {
+		t.Helper()
+		c, err := NewDirect(Options{
+			ServerURL:            "https://example.com",
+			GetMachinePrivateKey: func() (key.MachinePrivate, error) { return key.NewMachine(), nil },
+			Dialer:               tsdial.NewDialer(netmon.NewStatic()),
+			Hostinfo:             &tailcfg.Hostinfo{Hostname: "eph"},
+			NodeIdentityFile:     path,
+			Logf:                 t.Logf,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	identity := func(c *Direct) string {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.hostinfo.NodeIdentity
+	}
+
+	path := filepath.Join(t.TempDir(), "instance-id")
+
+	t.Run("missing", func(t *testing.T) {
+		if got := identity(newDirect(path)); got != "" {
+			t.Errorf("NodeIdentity = %q; want empty for missing file", got)
+		}
+	})
+
+	t.Run("present", func(t *testing.T) {
+		must.Do(os.WriteFile(path, []byte("i-0123456789abcdef\n"), 0600))
+		id1 := identity(newDirect(path))
+		if id1 == "" {
+			t.Fatal("NodeIdentity empty; want hash of file")
+		}
+		if strings.Contains(id1, "i-0123") {
+			t.Errorf("NodeIdentity %q contains raw file contents", id1)
+		}
+		// A re-created host with the same identity file is recognized.
+		if id2 := identity(newDirect(path)); id2 != id1 {
+			t.Errorf("NodeIdentity differs across re-creation: %q vs %q", id1, id2)
+		}
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		must.Do(os.WriteFile(path, []byte("i-0123456789abcdef"), 0600))
+		c := newDirect(path)
+		id1 := identity(c)
+
+		hi := &tailcfg.Hostinfo{Hostname: "eph"}
+		if c.SetHostinfo(hi) {
+			t.Error("SetHostinfo with unchanged identity file reported a change")
+		}
+		must.Do(os.WriteFile(path, []byte("i-fedcba9876543210"), 0600))
+		if !c.SetHostinfo(hi) {
+			t.Error("SetHostinfo after identity file change reported no change")
+		}
+		if id2 := identity(c); id2 == id1 || id2 == "" {
+			t.Errorf("NodeIdentity after change = %q; want new non-empty value (was %q)", id2, id1)
+		}
+	})
+
+	t.Run("cached", func(t *testing.T) {
+		must.Do(os.WriteFile(path, []byte("i-0123456789abcdef"), 0600))
+		fi := must.Get(os.Stat(path))
+		c := newDirect(path)
+		id1 := identity(c)
+
+		// A rewrite that keeps the size and modification time isn't
+		// noticed, showing that the file wasn't read again.
+		must.Do(os.WriteFile(path, []byte("i-fedcba9876543210"), 0600))
+		must.Do(os.Chtimes(path, fi.ModTime(), fi.ModTime()))
+		if c.SetHostinfo(&tailcfg.Hostinfo{Hostname: "eph"}) {
+			t.Error("SetHostinfo with unchanged size and modification time reported a change")
+		}
+		if id2 := identity(c); id2 != id1 {
+			t.Errorf("NodeIdentity = %q; want cached %q", id2, id1)
+		}
+	})
+}
+
+func TestEphemeral(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name  string
+		flags LoginFlags
+		want  bool
+	}{
+		{"persistent", LoginDefault, false},
+		{"ephemeral", LoginEphemeral, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestMapServer(t)
+			c := srv.newDirect(Options{})
+			if c.IsEphemeral() {
+				t.Error("IsEphemeral before registration = true")
+			}
+			if _, err := c.TryLogin(ctx, nil, tt.flags); err != nil {
+				t.Fatal(err)
+			}
+			if got := c.IsEphemeral(); got != tt.want {
+				t.Errorf("IsEphemeral = %v; want %v", got, tt.want)
+			}
+			srv.mu.Lock()
+			gotReq := srv.regReqs[len(srv.regReqs)-1].Ephemeral
+			srv.mu.Unlock()
+			if gotReq != tt.want {
+				t.Errorf("RegisterRequest.Ephemeral = %v; want %v", gotReq, tt.want)
+			}
+		})
+	}
+}
+
+// testMachineKeySigner is a controlbase.MachineKeySigner wrapping an
+// in-memory key.
+type testMachineKeySigner struct {
+	k key.MachinePrivate
+}
+
+func (s testMachineKeySigner) Public() key.MachinePublic { return s.k.Public() }
+
+func (s testMachineKeySigner) SharedSecret(peer key.MachinePublic) ([]byte, error) {
+	return curve25519.X25519(s.k.UntypedBytes(), peer.UntypedBytes())
+}
+
+func TestMachineKeySigner(t *testing.T) {
+	ctx := context.Background()
+	machineKey := key.NewMachine()
+	nodeKey := key.NewNode()
+	nlKey := key.NewNLPrivate()
+
+	// register logs in and sends a map request with opts, returning the
+	// RegisterRequest sent.
+	register := func(opts Options) *tailcfg.RegisterRequest {
+		t.Helper()
+		srv := newTestMapServer(t)
+		opts.Clock = tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1000, 0)})
+		opts.Persist.PrivateNodeKey = nodeKey
+		opts.Persist.NetworkLockKey = nlKey
+		c := srv.newDirect(opts)
+		if _, err := c.TryLogin(ctx, nil, LoginDefault); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.SendUpdate(ctx); err != nil {
+			t.Fatal(err)
+		}
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		if len(srv.regReqs) != 1 {
+			t.Fatalf("got %d register requests; want 1", len(srv.regReqs))
+		}
+		return srv.regReqs[0]
+	}
+
+	want := register(Options{
+		GetMachinePrivateKey: func() (key.MachinePrivate, error) { return machineKey, nil },
+	})
+	signer := testMachineKeySigner{machineKey}
+	if got := register(Options{MachineKeySigner: signer}); !reflect.DeepEqual(got, want) {
+		t.Errorf("register request with MachineKeySigner differs:\n got: %v\nwant: %v", logger.AsJSON(got), logger.AsJSON(want))
+	}
+
+	// The signer is preferred over GetMachinePrivateKey.
+	got := register(Options{
+		GetMachinePrivateKey: func() (key.MachinePrivate, error) {
+			return key.MachinePrivate{}, errors.New("GetMachinePrivateKey called")
+		},
+		MachineKeySigner: signer,
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("register request with both differs:\n got: %v\nwant: %v", logger.AsJSON(got), logger.AsJSON(want))
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	ctx := context.Background()
+	// logouts returns the number of logout requests srv received.
+	logouts := func(srv *testMapServer) (n int) {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		for _, req := range srv.regReqs {
+			if req.Expiry.Equal(time.Unix(123, 0)) {
+				n++
+			}
+		}
+		return n
+	}
+
+	t.Run("logged_in", func(t *testing.T) {
+		// By default, Shutdown logs out.
+		srv := newTestMapServer(t)
+		c := srv.newDirect(Options{})
+		if _, err := c.TryLogin(ctx, nil, LoginDefault); err != nil {
+			t.Fatal(err)
+		}
+
+		// Start a long-poll that only ends when it's canceled.
+		done := make(chan struct{})
+		defer close(done)
+		polling := make(chan struct{})
+		srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+			send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 1}})
+			close(polling)
+			<-done
+		})
+		pollErr := make(chan error, 1)
+		go func() { pollErr <- c.PollNetMap(ctx, new(recordingNetmapUpdater)) }()
+		<-polling
+
+		if err := c.Shutdown(ctx); err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+		select {
+		case err := <-pollErr:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("PollNetMap error = %v; want context.Canceled", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("PollNetMap didn't end on Shutdown")
+		}
+
+		if err := c.Shutdown(ctx); err != nil {
+			t.Errorf("second Shutdown: %v", err)
+		}
+		if n := logouts(srv); n != 1 {
+			t.Errorf("got %d logout requests; want 1", n)
+		}
+	})
+
+	t.Run("skip_logout", func(t *testing.T) {
+		srv := newTestMapServer(t)
+		c := srv.newDirect(Options{SkipLogoutOnShutdown: true})
+		if _, err := c.TryLogin(ctx, nil, LoginDefault); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Shutdown(ctx); err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+		if n := logouts(srv); n != 0 {
+			t.Errorf("got %d logout requests; want 0", n)
+		}
+		if c.GetPersist().PrivateNodeKey().IsZero() {
+			t.Error("Shutdown cleared the node key")
+		}
+	})
+
+	t.Run("never_logged_in", func(t *testing.T) {
+		srv := newTestMapServer(t)
+		c := srv.newDirect(Options{})
+		if err := c.Shutdown(ctx); err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+		if n := logouts(srv); n != 0 {
+			t.Errorf("got %d logout requests; want 0", n)
+		}
+	})
+}
+
+func TestGenerateNodeKey(t *testing.T) {
+	ctx := context.Background()
+	fixed := key.NewNode()
+	srv := newTestMapServer(t)
+	calls := 0
+	c := srv.newDirect(Options{
+		GenerateNodeKey: func() (key.NodePrivate, error) {
+			calls++
+			return fixed, nil
+		},
+	})
+	oldKey := c.persist.PrivateNodeKey().Public()
+
+	// Refreshing the existing key doesn't generate a new one.
+	if _, err := c.TryLogin(ctx, nil, LoginDefault); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 0 {
+		t.Errorf("GenerateNodeKey called %d times without key rotation", calls)
+	}
+
+	// Rotating the key uses the generator.
+	if _, err := c.TryLogin(ctx, nil, LoginInteractive); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("GenerateNodeKey called %d times; want 1", calls)
+	}
+	srv.mu.Lock()
+	reg := srv.regReqs[len(srv.regReqs)-1]
+	srv.mu.Unlock()
+	if reg.NodeKey != fixed.Public() {
+		t.Errorf("RegisterRequest.NodeKey = %v; want %v", reg.NodeKey, fixed.Public())
+	}
+	if reg.OldNodeKey != oldKey {
+		t.Errorf("RegisterRequest.OldNodeKey = %v; want %v", reg.OldNodeKey, oldKey)
+	}
+
+	if err := c.SendUpdate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.lastRequest().NodeKey; got != fixed.Public() {
+		t.Errorf("MapRequest.NodeKey = %v; want %v", got, fixed.Public())
+	}
+}
+
+func TestGenerateNodeKeyError(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{
+		GenerateNodeKey: func() (key.NodePrivate, error) {
+			return key.NodePrivate{}, errors.New("hsm unavailable")
+		},
+	})
+	oldKey := c.persist.PrivateNodeKey()
+	_, err := c.TryLogin(context.Background(), nil, LoginInteractive)
+	if err == nil || !strings.Contains(err.Error(), "hsm unavailable") {
+		t.Fatalf("TryLogin error = %v; want GenerateNodeKey error", err)
+	}
+	if !c.persist.PrivateNodeKey().Equal(oldKey) {
+		t.Error("node key changed after failed generation")
+	}
+}
+
+func TestEphemeralTTL(t *testing.T) {
+	srv := newTestMapServer(t)
+	var got []time.Duration
+	c := srv.newDirect(Options{
+		OnEphemeralTTL: func(d time.Duration) { got = append(got, d) },
+	})
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 1}, EphemeralTTL: 5 * time.Minute})
+		send(&tailcfg.MapResponse{Domain: "unchanged-ttl.example"})
+		send(&tailcfg.MapResponse{EphemeralTTL: 5 * time.Minute})
+		send(&tailcfg.MapResponse{EphemeralTTL: time.Minute})
+	})
+	pollNetMap(t, c)
+	if want := []time.Duration{5 * time.Minute, time.Minute}; !reflect.DeepEqual(got, want) {
+		t.Errorf("OnEphemeralTTL calls = %v; want %v", got, want)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{})
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 1}, Domain: "a.example"})
+		send(&tailcfg.MapResponse{Domain: "b.example"})
+	})
+
+	ch1, unsub1 := c.Subscribe()
+	ch2, unsub2 := c.Subscribe()
+	defer unsub2()
+
+	recvDomains := func(ch <-chan NetMapUpdate, n int) (got []string) {
+		t.Helper()
+		for range n {
+			select {
+			case u := <-ch:
+				if u.NetMap == nil {
+					t.Fatalf("got update without NetMap: %+v", u)
+				}
+				got = append(got, u.NetMap.Domain)
+			default:
+				t.Fatalf("got %d updates; want %d", len(got), n)
+			}
+		}
+		return got
+	}
+
+	pollNetMap(t, c)
+	want := []string{"a.example", "b.example"}
+	if got := recvDomains(ch1, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("subscriber 1 got %q; want %q", got, want)
+	}
+	if got := recvDomains(ch2, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("subscriber 2 got %q; want %q", got, want)
+	}
+
+	unsub1()
+	unsub1() // idempotent
+	pollNetMap(t, c)
+	if u, ok := <-ch1; ok {
+		t.Errorf("unsubscribed channel received %+v", u)
+	}
+	if got := recvDomains(ch2, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("subscriber 2 got %q after other unsubscribed; want %q", got, want)
+	}
+}
+
+func TestSubscribeDropsOldest(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{})
+	ch, unsub := c.Subscribe()
+	defer unsub()
+
+	const n = subscriberBuffer + 5
+	for i := range n {
+		c.publish(NetMapUpdate{NetMap: &netmap.NetworkMap{Domain: strconv.Itoa(i)}})
+	}
+	if got := len(ch); got != subscriberBuffer {
+		t.Fatalf("buffered %d updates; want %d", got, subscriberBuffer)
+	}
+	if got, want := (<-ch).NetMap.Domain, strconv.Itoa(n-subscriberBuffer); got != want {
+		t.Errorf("oldest buffered update = %q; want %q", got, want)
+	}
+}
+
+func TestClockSource(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		fn         func() (string, opt.Bool)
+		wantSource string
+		wantSynced opt.Bool
+	}{
+		{"synced", func() (string, opt.Bool) { return "ntp", "true" }, "ntp", "true"},
+		{"unsynced", func() (string, opt.Bool) { return "rtc", "false" }, "rtc", "false"},
+		{"unknown_sync", func() (string, opt.Bool) { return "chrony", "" }, "chrony", ""},
+		{"unknown", func() (string, opt.Bool) { return "", "" }, "", ""},
+		{"nil_func", nil, "", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestMapServer(t)
+			c := srv.newDirect(Options{ClockSourceFunc: tt.fn})
+			if err := c.SendUpdate(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			hi := srv.lastRequest().Hostinfo
+			if hi.ClockSource != tt.wantSource {
+				t.Errorf("Hostinfo.ClockSource = %q; want %q", hi.ClockSource, tt.wantSource)
+			}
+			if hi.ClockSynced != tt.wantSynced {
+				t.Errorf("Hostinfo.ClockSynced = %q; want %q", hi.ClockSynced, tt.wantSynced)
+			}
+		})
+	}
+}
+
+func TestCheckClockSkew(t *testing.T) {
+	clk := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1000, 0)})
+	var logs []string
+	c := newTestMapServer(t).newDirect(Options{
+		Clock:           clk,
+		ClockSourceFunc: func() (string, opt.Bool) { return "rtc", "false" },
+		Logf: func(format string, args ...any) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	})
+	logs = nil
+
+	c.checkClockSkew(clk.Now().Add(10 * time.Second))
+	if len(logs) != 0 {
+		t.Errorf("small skew logged: %q", logs)
+	}
+	c.checkClockSkew(clk.Now().Add(-5 * time.Minute))
+	want := `netmap: local clock is 5m0s off from control's; clock source="rtc" synced="false"`
+	if len(logs) != 1 || logs[0] != want {
+		t.Errorf("logs = %q; want [%q]", logs, want)
+	}
+}
+
+func TestUpdateHostinfo(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{
+		Hostinfo:       &tailcfg.Hostinfo{BackendLogID: "test-backend-log-id", Hostname: "a"},
+		ReportTimeZone: true,
+		TimeZoneFunc:   func() string { return "Europe/Berlin" },
+	})
+	c.SetAcceptDNS(true)
+
+	if !c.UpdateHostinfo(func(hi *tailcfg.Hostinfo) { hi.Hostname = "b" }) {
+		t.Error("UpdateHostinfo with new hostname reported no change")
+	}
+	if c.UpdateHostinfo(func(hi *tailcfg.Hostinfo) { hi.Hostname = "b" }) {
+		t.Error("UpdateHostinfo with same hostname reported a change")
+	}
+	// Fields managed by Direct itself can't be changed.
+	if c.UpdateHostinfo(func(hi *tailcfg.Hostinfo) {
+		hi.AcceptDNS = ""
+		hi.TimeZone = "America/New_York"
+		hi.NetInfo = &tailcfg.NetInfo{PreferredDERP: 1}
+	}) {
+		t.Error("UpdateHostinfo of managed fields reported a change")
+	}
+
+	if err := c.SendUpdate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	hi := srv.lastRequest().Hostinfo
+	if hi.Hostname != "b" || hi.BackendLogID != "test-backend-log-id" {
+		t.Errorf("Hostinfo = %+v; want updated hostname and other fields kept", hi)
+	}
+	if hi.AcceptDNS != "true" || hi.TimeZone != "Europe/Berlin" {
+		t.Errorf("Hostinfo = %+v; want managed fields kept", hi)
+	}
+}
+
+func TestUpdateHostinfoConcurrent(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{})
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.UpdateHostinfo(func(hi *tailcfg.Hostinfo) {
+				hi.RequestTags = append(hi.RequestTags, fmt.Sprintf("tag:%d", i))
+			})
+		}()
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if got := len(c.hostinfo.RequestTags); got != 10 {
+		t.Errorf("got %d tags (%q); want all 10 updates kept", got, c.hostinfo.RequestTags)
+	}
+}
+
+func TestTimeZone(t *testing.T) {
+	srv := newTestMapServer(t)
+	tz := "Europe/Berlin"
+
+	// The time zone isn't reported unless opted in to.
+	c := srv.newDirect(Options{TimeZoneFunc: func() string { return tz }})
+	if err := c.SendUpdate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.lastRequest().Hostinfo.TimeZone; got != "" {
+		t.Errorf("Hostinfo.TimeZone without ReportTimeZone = %q; want omitted", got)
+	}
+	if c.RefreshTimeZone() {
+		t.Error("RefreshTimeZone without ReportTimeZone reported a change")
+	}
+
+	c = srv.newDirect(Options{ReportTimeZone: true, TimeZoneFunc: func() string { return tz }})
+	if err := c.SendUpdate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.lastRequest().Hostinfo.TimeZone; got != "Europe/Berlin" {
+		t.Errorf("Hostinfo.TimeZone = %q; want %q", got, "Europe/Berlin")
+	}
+	if c.RefreshTimeZone() {
+		t.Error("RefreshTimeZone with unchanged zone reported a change")
+	}
+
+	tz = "America/New_York"
+	if !c.RefreshTimeZone() {
+		t.Error("RefreshTimeZone after zone change reported no change")
+	}
+	if err := c.SendUpdate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.lastRequest().Hostinfo.TimeZone; got != "America/New_York" {
+		t.Errorf("Hostinfo.TimeZone = %q; want %q", got, "America/New_York")
+	}
+
+	tz = ""
+	if !c.RefreshTimeZone() {
+		t.Error("RefreshTimeZone to unknown zone reported no change")
+	}
+	if err := c.SendUpdate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.lastRequest().Hostinfo.TimeZone; got != "" {
+		t.Errorf("Hostinfo.TimeZone = %q; want omitted", got)
+	}
+}
+
+func TestFirewallMode(t *testing.T) {
+	// sentMode returns the NetInfo.FirewallMode c sends to srv.
+	sentMode := func(srv *testMapServer, c *Direct) string {
+		t.Helper()
+		if err := c.SendUpdate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		ni := srv.lastRequest().Hostinfo.NetInfo
+		if ni == nil {
+			t.Fatal("no NetInfo sent")
+		}
+		return ni.FirewallMode
+	}
+
+	for _, tt := range []struct {
+		name string
+		mode string // from FirewallModeFunc
+		want string
+	}{
+		{"nftables", "nft-forced", "nft-forced"},
+		{"iptables", "ipt-default", "ipt-default"},
+		{"unsupported_platform", "", ""},
+		{"unknown_mode", "pf", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestMapServer(t)
+			c := srv.newDirect(Options{FirewallModeFunc: func() string { return tt.mode }})
+			c.SetNetInfo(&tailcfg.NetInfo{FirewallMode: "ipt-from-netinfo"})
+			if got := sentMode(srv, c); got != tt.want {
+				t.Errorf("NetInfo.FirewallMode = %q; want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("no_func", func(t *testing.T) {
+		// Without a FirewallModeFunc, the NetInfo's own mode is sent.
+		srv := newTestMapServer(t)
+		c := srv.newDirect(Options{})
+		c.SetNetInfo(&tailcfg.NetInfo{FirewallMode: "ipt-from-netinfo"})
+		if got := sentMode(srv, c); got != "ipt-from-netinfo" {
+			t.Errorf("NetInfo.FirewallMode = %q; want %q", got, "ipt-from-netinfo")
+		}
+		if c.RefreshFirewallMode() {
+			t.Error("RefreshFirewallMode without FirewallModeFunc reported a change")
+		}
+	})
+
+	t.Run("refresh", func(t *testing.T) {
+		srv := newTestMapServer(t)
+		mode := "ipt-default"
+		c := srv.newDirect(Options{FirewallModeFunc: func() string { return mode }})
+		if c.RefreshFirewallMode() {
+			t.Error("RefreshFirewallMode without NetInfo reported a change")
+		}
+		c.SetNetInfo(&tailcfg.NetInfo{})
+		if c.RefreshFirewallMode() {
+			t.Error("RefreshFirewallMode with unchanged mode reported a change")
+		}
+
+		mode = "nft-forced"
+		if !c.RefreshFirewallMode() {
+			t.Error("RefreshFirewallMode after mode change reported no change")
+		}
+		if got := sentMode(srv, c); got != "nft-forced" {
+			t.Errorf("NetInfo.FirewallMode = %q; want %q", got, "nft-forced")
+		}
+
+		// The mode stays what FirewallModeFunc says across NetInfo updates.
+		c.SetNetInfo(&tailcfg.NetInfo{PreferredDERP: 1, FirewallMode: "ipt-stale"})
+		if got := sentMode(srv, c); got != "nft-forced" {
+			t.Errorf("NetInfo.FirewallMode after SetNetInfo = %q; want %q", got, "nft-forced")
+		}
+
+		mode = ""
+		if !c.RefreshFirewallMode() {
+			t.Error("RefreshFirewallMode to no mode reported no change")
+		}
+		if got := sentMode(srv, c); got != "" {
+			t.Errorf("NetInfo.FirewallMode = %q; want omitted", got)
+		}
+	})
+}
+
+func TestSystemTimeZone(t *testing.T) {
+	tests := []struct {
+		tz   string
+		want string
+	}{
+		{"Europe/Berlin", "Europe/Berlin"},
+		{":Asia/Tokyo", "Asia/Tokyo"},
+		{"/usr/share/zoneinfo/America/Chicago", "America/Chicago"},
+		{"/some/other/file", ""},
+		{"", "UTC"},
+	}
+	for _, tt := range tests {
+		t.Setenv("TZ", tt.tz)
+		if got := systemTimeZone(); got != tt.want {
+			t.Errorf("systemTimeZone with TZ=%q = %q; want %q", tt.tz, got, tt.want)
+		}
+	}
+}
+
+// roundTripFunc is an http.RoundTripper func.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestHTTPClient(t *testing.T) {
+	srv := newTestMapServer(t)
+	var mu sync.Mutex
+	var paths []string
+	tr := srv.ts.Client().Transport
+	c := srv.newDirect(Options{
+		HTTPClient: &http.Client{
+			Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				mu.Lock()
+				paths = append(paths, r.URL.Path)
+				mu.Unlock()
+				return tr.RoundTrip(r)
+			}),
+		},
+	})
+	if _, err := c.TryLogin(context.Background(), nil, LoginDefault); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Contains(paths, "/key") {
+		t.Errorf("custom HTTPClient got requests for %q; want the key fetch", paths)
+	}
+}
+
+func TestHTTPClientTimeout(t *testing.T) {
+	t.Run("key", func(t *testing.T) {
+		srv := newTestMapServer(t)
+		c := srv.newDirect(Options{
+			HTTPClient: &http.Client{
+				Timeout: 50 * time.Millisecond,
+				Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+					<-r.Context().Done()
+					return nil, r.Context().Err()
+				}),
+			},
+		})
+		checkTryLoginTimeout(t, c)
+	})
+	t.Run("register", func(t *testing.T) {
+		// Register requests go over Noise but still honor the timeout.
+		srv := newTestMapServer(t)
+		srv.regHang = true
+		c := srv.newDirect(Options{
+			HTTPClient: &http.Client{
+				Timeout:   50 * time.Millisecond,
+				Transport: srv.ts.Client().Transport,
+			},
+		})
+		checkTryLoginTimeout(t, c)
+	})
+}
+
+// checkTryLoginTimeout checks that c.TryLogin fails from its HTTP client's
+// timeout, well before a 10 second context deadline.
+func checkTryLoginTimeout(t *testing.T, c *Direct) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := c.TryLogin(ctx, nil, LoginDefault)
+	if err == nil {
+		t.Fatal("TryLogin succeeded with a stalled request")
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("TryLogin error = %v after the context's deadline; want the client's timeout", err)
+	}
+	var ne net.Error
+	if !errors.Is(err, context.DeadlineExceeded) && !(errors.As(err, &ne) && ne.Timeout()) {
+		t.Fatalf("TryLogin error = %v; want a timeout", err)
+	}
+}
+
+func TestHTTPClientNoiseProxy(t *testing.T) {
+	var proxied atomic.Bool
+	tr := &http.Transport{
+		Proxy: func(*http.Request) (*url.URL, error) {
+			proxied.Store(true)
+			return nil, nil
+		},
+	}
+	k := key.NewMachine()
+	c, err := NewDirect(Options{
+		ServerURL:            "https://example.com",
+		GetMachinePrivateKey: func() (key.MachinePrivate, error) { return k, nil },
+		Dialer:               tsdial.NewDialer(netmon.NewStatic()),
+		HTTPClient:           &http.Client{Transport: tr},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.mu.Lock()
+	c.serverNoiseKey = key.NewMachine().Public()
+	c.mu.Unlock()
+
+	nc, err := c.getNoiseClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nc.proxy == nil {
+		t.Fatal("Noise client has no proxy func; want the HTTPClient transport's")
+	}
+	nc.proxy(&http.Request{URL: &url.URL{Scheme: "http", Host: "example.com"}})
+	if !proxied.Load() {
+		t.Error("Noise client's proxy func isn't the HTTPClient transport's")
+	}
+}
+
+func TestOutOfOrderResponse(t *testing.T) {
+	srv := newTestMapServer(t)
+	type report struct{ last, got int64 }
+	var reports []report
+	c := srv.newDirect(Options{
+		OnOutOfOrderResponse: func(last, got int64) { reports = append(reports, report{last, got}) },
+	})
+	peers := []*tailcfg.Node{{ID: 2, Key: key.NewNode().Public(), Addresses: testPeerAddresses(2)}}
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Seq: 1, Node: &tailcfg.Node{ID: 1}, Peers: peers, Domain: "a.example"})
+		send(&tailcfg.MapResponse{Seq: 2, Domain: "b.example"})
+		send(&tailcfg.MapResponse{Seq: 2, Domain: "replayed.example"})
+		send(&tailcfg.MapResponse{Seq: 1, Domain: "old.example"})
+		send(&tailcfg.MapResponse{Domain: "unsequenced.example"})
+		send(&tailcfg.MapResponse{Seq: 3, Domain: "c.example"})
+		send(&tailcfg.MapResponse{Seq: 1, Peers: peers, Domain: "full.example"})
+		send(&tailcfg.MapResponse{Seq: 2, Domain: "d.example"})
+	})
+	var domains []string
+	for _, nm := range pollNetMap(t, c) {
+		domains = append(domains, nm.Domain)
+	}
+	if want := []string{"a.example", "b.example", "unsequenced.example", "c.example", "full.example", "d.example"}; !reflect.DeepEqual(domains, want) {
+		t.Errorf("netmap domains = %q; want %q", domains, want)
+	}
+	if want := []report{{2, 2}, {2, 1}}; !reflect.DeepEqual(reports, want) {
+		t.Errorf("OnOutOfOrderResponse calls = %v; want %v", reports, want)
+	}
+}
+
+func TestOutOfOrderResponseUnchecked(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{})
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Seq: 2, Node: &tailcfg.Node{ID: 1}, Domain: "a.example"})
+		send(&tailcfg.MapResponse{Seq: 1, Domain: "b.example"})
+	})
+	if nms := pollNetMap(t, c); len(nms) != 2 {
+		t.Errorf("got %d netmaps; want 2 when OnOutOfOrderResponse is unset", len(nms))
+	}
+}
+
+func TestAdvertisedCapabilities(t *testing.T) {
+	delta := tailcfg.ClientFeatureDeltaDERPMap
+	for _, tt := range []struct {
+		name   string
+		opts   Options
+		noSSH  bool                    // set TS_DISABLE_SSH_SERVER
+		routes []netip.Prefix          // Hostinfo.RoutableIPs
+		want   []tailcfg.ClientFeature // plus ClientFeatureSSH where expected
+	}{
+		{
+			name:  "builtin_only",
+			noSSH: true,
+			want:  []tailcfg.ClientFeature{delta},
+		},
+		{
+			name: "ssh",
+			want: []tailcfg.ClientFeature{delta},
+		},
+		{
+			name:  "compressed_uploads",
+			opts:  Options{CompressedUploads: true},
+			noSSH: true,
+			want:  []tailcfg.ClientFeature{tailcfg.ClientFeatureCompressedUploads, delta},
+		},
+		{
+			name:   "exit_node",
+			noSSH:  true,
+			routes: tsaddr.ExitRoutes(),
+			want:   []tailcfg.ClientFeature{delta, tailcfg.ClientFeatureExitNode},
+		},
+		{
+			name:   "subnet_routes_only",
+			noSSH:  true,
+			routes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+			want:   []tailcfg.ClientFeature{delta},
+		},
+		{
+			name:  "extra",
+			opts:  Options{Features: []tailcfg.ClientFeature{"zz-feature", "aa-feature"}},
+			noSSH: true,
+			want:  []tailcfg.ClientFeature{"aa-feature", delta, "zz-feature"},
+		},
+		{
+			name:  "duplicates",
+			opts:  Options{Features: []tailcfg.ClientFeature{"aa-feature", delta, "aa-feature"}},
+			noSSH: true,
+			want:  []tailcfg.ClientFeature{"aa-feature", delta},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.noSSH {
+				envknob.Setenv("TS_DISABLE_SSH_SERVER", "1")
+				t.Cleanup(func() { envknob.Setenv("TS_DISABLE_SSH_SERVER", "") })
+			}
+			want := tt.want
+			if sshServerBuilt && !tt.noSSH {
+				want = append(slices.Clone(want), tailcfg.ClientFeatureSSH)
+			}
+
+			srv := newTestMapServer(t)
+			tt.opts.Hostinfo = &tailcfg.Hostinfo{BackendLogID: "test-backend-log-id", RoutableIPs: tt.routes}
+			c := srv.newDirect(tt.opts)
+			if got := c.AdvertisedCapabilities(); !reflect.DeepEqual(got, want) {
+				t.Errorf("AdvertisedCapabilities = %q; want %q", got, want)
+			}
+			if err := c.SendUpdate(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := srv.lastRequest().Features; !reflect.DeepEqual(got, want) {
+				t.Errorf("MapRequest.Features = %q; want %q", got, want)
+			}
+		})
+	}
+}
+
+// TestAdvertisedCapabilitiesExitNodeChange tests that the exit node feature
+// follows Hostinfo changes.
+func TestAdvertisedCapabilitiesExitNodeChange(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{})
+	check := func(wantExitNode bool) {
+		t.Helper()
+		if err := c.SendUpdate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := slices.Contains(srv.lastRequest().Features, tailcfg.ClientFeatureExitNode); got != wantExitNode {
+			t.Errorf("exit node advertised = %v; want %v", got, wantExitNode)
+		}
+		if got := slices.Contains(c.AdvertisedCapabilities(), tailcfg.ClientFeatureExitNode); got != wantExitNode {
+			t.Errorf("AdvertisedCapabilities has exit node = %v; want %v", got, wantExitNode)
+		}
+	}
+	check(false)
+	c.SetHostinfo(&tailcfg.Hostinfo{BackendLogID: "test-backend-log-id", RoutableIPs: tsaddr.ExitRoutes()})
+	check(true)
+	c.SetHostinfo(&tailcfg.Hostinfo{BackendLogID: "test-backend-log-id"})
+	check(false)
+}
+
+func TestResetStats(t *testing.T) {
+	ctx := context.Background()
+	clk := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1000, 0)})
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{Clock: clk})
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 1}})
+		send(&tailcfg.MapResponse{KeepAlive: true})
+		send(&tailcfg.MapResponse{Domain: "b.example"})
+	})
+
+	if _, err := c.TryLogin(ctx, nil, LoginDefault); err != nil {
+		t.Fatal(err)
+	}
+	pollNetMap(t, c)
+	want := Stats{
+		Since:            time.Unix(1000, 0),
+		RegisterRequests: 1,
+		MapRequests:      1,
+		MapResponses:     3,
+		KeepAlives:       1,
+	}
+	if got := c.Stats(); got != want {
+		t.Errorf("Stats = %+v; want %+v", got, want)
+	}
+
+	clk.Advance(time.Minute)
+	c.ResetStats()
+	if got, want := c.Stats(), (Stats{Since: time.Unix(1060, 0)}); got != want {
+		t.Errorf("Stats after reset = %+v; want %+v", got, want)
+	}
+
+	// Counting resumes from zero.
+	pollNetMap(t, c)
+	want = Stats{
+		Since:        time.Unix(1060, 0),
+		MapRequests:  1,
+		MapResponses: 3,
+		KeepAlives:   1,
+	}
+	if got := c.Stats(); got != want {
+		t.Errorf("Stats after resuming = %+v; want %+v", got, want)
+	}
+}
+
+func TestTimeToFirstMap(t *testing.T) {
+	clk := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1000, 0)})
+	srv := newTestMapServer(t)
+	var got []time.Duration
+	c := srv.newDirect(Options{
+		Clock:      clk,
+		OnFirstMap: func(d time.Duration) { got = append(got, d) },
+	})
+	if _, ok := c.TimeToFirstMap(); ok {
+		t.Error("TimeToFirstMap known before any netmap")
+	}
+
+	// Registering and a lite update don't count.
+	clk.Advance(2 * time.Second)
+	if _, err := c.TryLogin(context.Background(), nil, LoginDefault); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendUpdate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.TimeToFirstMap(); ok {
+		t.Error("TimeToFirstMap known before any processed netmap")
+	}
+
+	clk.Advance(time.Second)
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 1}})
+		send(&tailcfg.MapResponse{Domain: "b.example"})
+	})
+	pollNetMap(t, c)
+	clk.Advance(time.Minute)
+	pollNetMap(t, c)
+
+	if d, ok := c.TimeToFirstMap(); !ok || d != 3*time.Second {
+		t.Errorf("TimeToFirstMap = %v, %v; want 3s, true", d, ok)
+	}
+	if want := []time.Duration{3 * time.Second}; !reflect.DeepEqual(got, want) {
+		t.Errorf("OnFirstMap calls = %v; want %v", got, want)
+	}
+}
+
+func TestEndpointReportInterval(t *testing.T) {
+	clk := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1000, 0)})
+	srv := newTestMapServer(t)
+	var got []time.Duration
+	c := srv.newDirect(Options{
+		Clock:                    clk,
+		OnEndpointReportInterval: func(d time.Duration) { got = append(got, d) },
+	})
+	c.SetEndpoints(fakeEndpoints(1, 2))
+
+	wantDelay := func(want time.Duration) {
+		t.Helper()
+		if d := c.endpointReportDelay(); d != want {
+			t.Errorf("endpointReportDelay = %v; want %v", d, want)
+		}
+	}
+	pollWithInterval := func(d time.Duration) {
+		t.Helper()
+		srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+			send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 1}, EndpointReportInterval: d})
+		})
+		pollNetMap(t, c)
+	}
+
+	// Without a hint, endpoints can always be sent right away.
+	if err := c.SendUpdate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	wantDelay(0)
+
+	pollWithInterval(30 * time.Second)
+	wantDelay(30 * time.Second)
+	clk.Advance(10 * time.Second)
+	wantDelay(20 * time.Second)
+
+	// Sending endpoints restarts the interval.
+	if err := c.SendUpdate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	wantDelay(30 * time.Second)
+
+	// Neither a failed update nor one without endpoints restarts it.
+	clk.Advance(10 * time.Second)
+	srv.failNextMaps(http.StatusInternalServerError)
+	if err := c.SendUpdate(context.Background()); err == nil {
+		t.Fatal("SendUpdate succeeded; want error")
+	}
+	wantDelay(20 * time.Second)
+	c.SetEndpoints(nil)
+	if err := c.SendUpdate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	wantDelay(20 * time.Second)
+	c.SetEndpoints(fakeEndpoints(1, 2))
+
+	// A shorter interval takes effect immediately.
+	pollWithInterval(5 * time.Second)
+	wantDelay(5 * time.Second)
+	clk.Advance(5 * time.Second)
+	wantDelay(0)
+
+	// A response without the hint leaves it unchanged.
+	pollWithInterval(0)
+	wantDelay(5 * time.Second)
+
+	// A negative interval removes the limit.
+	pollWithInterval(-1)
+	wantDelay(0)
+
+	if want := []time.Duration{30 * time.Second, 5 * time.Second, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("OnEndpointReportInterval calls = %v; want %v", got, want)
+	}
+}
+
+func TestSetAcceptDNS(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{})
+
+	wantAcceptDNS := func(want opt.Bool) {
+		t.Helper()
+		if err := c.SendUpdate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := srv.lastRequest().Hostinfo.AcceptDNS; got != want {
+			t.Errorf("Hostinfo.AcceptDNS = %q; want %q", got, want)
+		}
+	}
+	wantAcceptDNS("")
+
+	if !c.SetAcceptDNS(true) {
+		t.Error("SetAcceptDNS(true) initially reported no change")
+	}
+	wantAcceptDNS("true")
+	if c.SetAcceptDNS(true) {
+		t.Error("SetAcceptDNS(true) again reported a change")
+	}
+
+	if !c.SetAcceptDNS(false) {
+		t.Error("SetAcceptDNS(false) reported no change")
+	}
+	wantAcceptDNS("false")
+
+	// A new Hostinfo from the caller keeps the setting.
+	c.SetHostinfo(&tailcfg.Hostinfo{BackendLogID: "test-backend-log-id", Hostname: "new"})
+	wantAcceptDNS("false")
+}
+
+func TestValidateDeltasRequestsFullMap(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{ValidateDeltas: true})
+	peers := []*tailcfg.Node{{ID: 2, Key: key.NewNode().Public(), Addresses: testPeerAddresses(2)}}
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 1}, Peers: peers})
+		send(&tailcfg.MapResponse{PeersChangedPatch: []*tailcfg.PeerChange{{NodeID: 404, DERPRegion: 1}}})
+		send(&tailcfg.MapResponse{Domain: "after-bad-delta.example"})
+	})
+
+	var nu recordingNetmapUpdater
+	err := c.PollNetMap(context.Background(), &nu)
+	if !errors.Is(err, errInvalidDelta) {
+		t.Fatalf("PollNetMap error = %v; want errInvalidDelta", err)
+	}
+	if len(nu.nms) != 1 {
+		t.Errorf("got %d netmaps; want only the full one before the bad delta", len(nu.nms))
+	}
+
+	// The caller's next poll starts over with a full netmap.
+	nreq := len(srv.requests())
+	nu = recordingNetmapUpdater{}
+	c.PollNetMap(context.Background(), &nu)
+	if got := len(srv.requests()); got != nreq+1 {
+		t.Errorf("got %d new map requests; want 1", got-nreq)
+	}
+	if len(nu.nms) == 0 || len(nu.nms[0].Peers) != 1 {
+		t.Errorf("next poll didn't start with a full netmap")
+	}
+}
+
+func TestReportPublicIP(t *testing.T) {
+	endpoints := []tailcfg.Endpoint{
+		{Addr: netip.MustParseAddrPort("192.168.1.5:41641"), Type: tailcfg.EndpointLocal},
+		{Addr: netip.MustParseAddrPort("203.0.113.7:41641"), Type: tailcfg.EndpointSTUN},
+		{Addr: netip.MustParseAddrPort("203.0.113.7:12345"), Type: tailcfg.EndpointSTUN4LocalPort},
+		{Addr: netip.MustParseAddrPort("[2001:db8:1:2::7]:41641"), Type: tailcfg.EndpointSTUN},
+		{Addr: netip.MustParseAddrPort("198.51.100.1:5000"), Type: tailcfg.EndpointPortmapped},
+	}
+	for _, tt := range []struct {
+		name string
+		full bool
+		want []netip.Prefix
+	}{
+		{
+			name: "masked",
+			want: []netip.Prefix{
+				netip.MustParsePrefix("203.0.113.0/24"),
+				netip.MustParsePrefix("2001:db8:1::/48"),
+			},
+		},
+		{
+			name: "full",
+			full: true,
+			want: []netip.Prefix{
+				netip.MustParsePrefix("203.0.113.7/32"),
+				netip.MustParsePrefix("2001:db8:1:2::7/128"),
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestMapServer(t)
+			c := srv.newDirect(Options{ReportPublicIP: tt.full})
+			c.SetNetInfo(&tailcfg.NetInfo{PreferredDERP: 1})
+			c.SetEndpoints(endpoints)
+			if err := c.SendUpdate(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := srv.lastRequest().Hostinfo.NetInfo.PublicIPs; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NetInfo.PublicIPs = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRediscoverEndpoints(t *testing.T) {
+	srv := newTestMapServer(t)
+	calls := 0
+	c := srv.newDirect(Options{
+		OnRediscoveryRequested: func() { calls++ },
+	})
+
+	pollWithIDs := func(ids ...string) {
+		t.Helper()
+		srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+			for _, id := range ids {
+				send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 1}, RediscoverEndpoints: id})
+			}
+		})
+		pollNetMap(t, c)
+	}
+	wantCalls := func(want int) {
+		t.Helper()
+		if calls != want {
+			t.Errorf("OnRediscoveryRequested calls = %d; want %d", calls, want)
+		}
+	}
+
+	pollWithIDs("")
+	wantCalls(0)
+
+	// A directive triggers rediscovery once, even if repeated in later
+	// responses.
+	pollWithIDs("a", "a", "")
+	wantCalls(1)
+
+	// Including on a new poll.
+	pollWithIDs("a")
+	wantCalls(1)
+
+	// A new directive triggers it again.
+	pollWithIDs("b", "b")
+	wantCalls(2)
+}
+
+func TestPeerScope(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{PeerScope: "team-a", ValidateDeltas: true})
+
+	nodes := func(ids ...tailcfg.NodeID) (ret []*tailcfg.Node) {
+		for _, id := range ids {
+			ret = append(ret, &tailcfg.Node{ID: id, Key: key.NewNode().Public(), Addresses: testPeerAddresses(id)})
+		}
+		return ret
+	}
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 1}, Peers: nodes(2, 3, 4, 5)})
+		// Control narrows the scope: peers 2 and 5 just aren't sent.
+		send(&tailcfg.MapResponse{Peers: nodes(3, 4)})
+		send(&tailcfg.MapResponse{PeersChanged: nodes(6)})
+		// And widens it again.
+		send(&tailcfg.MapResponse{Peers: nodes(2, 3, 6, 7, 8)})
+	})
+
+	type result struct{ netmapPeers, visible int }
+	var got []result
+	err := c.PollNetMap(context.Background(), netmapUpdaterFunc(func(nm *netmap.NetworkMap) {
+		got = append(got, result{len(nm.Peers), c.VisiblePeerCount()})
+	}))
+	if errors.Is(err, errInvalidDelta) {
+		t.Fatalf("scope change treated as an invalid delta: %v", err)
+	}
+	want := []result{{4, 4}, {2, 2}, {3, 3}, {5, 5}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("peer counts = %+v; want %+v", got, want)
+	}
+	if _, ok := c.PeerTags(5); ok {
+		t.Error("peer 5 still known after leaving the scope")
+	}
+
+	if got := srv.lastRequest().PeerScope; got != "team-a" {
+		t.Errorf("MapRequest.PeerScope = %q; want %q", got, "team-a")
+	}
+}
+
+func TestPaginatedPeers(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{})
+
+	nodes := func(ids ...tailcfg.NodeID) (ret []*tailcfg.Node) {
+		for _, id := range ids {
+			ret = append(ret, &tailcfg.Node{ID: id, Key: key.NewNode().Public(), Addresses: testPeerAddresses(id)})
+		}
+		return ret
+	}
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		// A full map in three pages.
+		send(&tailcfg.MapResponse{PeersPageToken: "a", PeersMorePages: true, Peers: nodes(2, 3)})
+		send(&tailcfg.MapResponse{PeersPageToken: "a", PeersMorePages: true, Peers: nodes(4)})
+		send(&tailcfg.MapResponse{PeersPageToken: "a", Node: &tailcfg.Node{ID: 1}, Peers: nodes(5)})
+
+		// A delta interrupts a pagination, which is discarded.
+		send(&tailcfg.MapResponse{PeersPageToken: "b", PeersMorePages: true, Peers: nodes(6)})
+		send(&tailcfg.MapResponse{PeersChanged: nodes(7)})
+
+		// A new pagination replaces an interrupted one.
+		send(&tailcfg.MapResponse{PeersPageToken: "c", PeersMorePages: true, Peers: nodes(8)})
+		send(&tailcfg.MapResponse{PeersPageToken: "d", PeersMorePages: true, Peers: nodes(9)})
+		send(&tailcfg.MapResponse{PeersPageToken: "d", Peers: nodes(10)})
+
+		// Pages that leave no peers remove the old ones, ignoring deltas.
+		send(&tailcfg.MapResponse{PeersPageToken: "f", PeersMorePages: true})
+		send(&tailcfg.MapResponse{PeersPageToken: "f", OnlineChange: map[tailcfg.NodeID]bool{9: true}})
+
+		// A pagination cut short by the end of the stream is never applied.
+		send(&tailcfg.MapResponse{PeersPageToken: "e", PeersMorePages: true, Peers: nodes(11)})
+	})
+
+	var got [][]tailcfg.NodeID
+	for _, nm := range pollNetMap(t, c) {
+		var ids []tailcfg.NodeID
+		for _, p := range nm.Peers {
+			ids = append(ids, p.ID())
+		}
+		got = append(got, ids)
+	}
+	want := [][]tailcfg.NodeID{
+		{2, 3, 4, 5},
+		{2, 3, 4, 5, 7},
+		{9, 10},
+		nil,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("netmap peers = %v; want %v", got, want)
+	}
+	if got := c.VisiblePeerCount(); got != 0 {
+		t.Errorf("VisiblePeerCount = %d; want 0", got)
+	}
+}
+
+func TestAttestation(t *testing.T) {
+	errUnavailable := errors.New("TPM unavailable")
+	for _, tt := range []struct {
+		name     string
+		provider func() ([]byte, error)
+		require  bool
+		want     []byte
+		wantErr  bool
+	}{
+		{"present", func() ([]byte, error) { return []byte("blob"), nil }, false, []byte("blob"), false},
+		{"present_required", func() ([]byte, error) { return []byte("blob"), nil }, true, []byte("blob"), false},
+		{"no_provider", nil, false, nil, false},
+		{"unavailable", func() ([]byte, error) { return nil, errUnavailable }, false, nil, false},
+		{"empty", func() ([]byte, error) { return nil, nil }, false, nil, false},
+		{"required_unavailable", func() ([]byte, error) { return nil, errUnavailable }, true, nil, true},
+		{"required_no_provider", nil, true, nil, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestMapServer(t)
+			c := srv.newDirect(Options{
+				AttestationProvider: tt.provider,
+				RequireAttestation:  tt.require,
+			})
+			err := c.SendUpdate(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("SendUpdate succeeded; want error")
+				}
+				if n := len(srv.requests()); n != 0 {
+					t.Errorf("sent %d MapRequests without required attestation", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := srv.lastRequest().Attestation; !bytes.Equal(got, tt.want) {
+				t.Errorf("MapRequest.Attestation = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetTKAKey(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{})
+
+	wantKey := func(want string) {
+		t.Helper()
+		if err := c.SendUpdate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := srv.lastRequest().Hostinfo.TKAKey; got != want {
+			t.Errorf("Hostinfo.TKAKey = %q; want %q", got, want)
+		}
+	}
+	keyText := func(k key.NLPublic) string {
+		b, _ := k.MarshalText()
+		return string(b)
+	}
+
+	wantKey("")
+	k1 := key.NewNLPrivate().Public()
+	if !c.SetTKAKey(k1) {
+		t.Error("SetTKAKey with new key reported no change")
+	}
+	if c.SetTKAKey(k1) {
+		t.Error("SetTKAKey with same key reported a change")
+	}
+	wantKey(keyText(k1))
+
+	// It survives later SetHostinfo calls.
+	c.SetHostinfo(&tailcfg.Hostinfo{BackendLogID: "test-backend-log-id"})
+	wantKey(keyText(k1))
+
+	k2 := key.NewNLPrivate().Public()
+	if !c.SetTKAKey(k2) {
+		t.Error("SetTKAKey with changed key reported no change")
+	}
+	wantKey(keyText(k2))
+
+	if !c.SetTKAKey(key.NLPublic{}) {
+		t.Error("SetTKAKey clearing key reported no change")
+	}
+	wantKey("")
+}
+
+func TestSetUsingExitNode(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{})
+	ms := newTestMapSession(t, nil)
+	ms.onPeersUpdated = c.updatePeers
+	ms.updateStateFromResponse(&tailcfg.MapResponse{
+		Peers: []*tailcfg.Node{
+			{ID: 2, StableID: "stable-2"},
+			{ID: 3, StableID: "stable-3"},
+		},
+	})
+
+	wantExitNode := func(want tailcfg.StableNodeID) {
+		t.Helper()
+		if err := c.SendUpdate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := srv.lastRequest().Hostinfo.ExitNodeID; got != want {
+			t.Errorf("Hostinfo.ExitNodeID = %q; want %q", got, want)
+		}
+	}
+	setExitNode := func(id tailcfg.NodeID, wantChanged bool) {
+		t.Helper()
+		changed, err := c.SetUsingExitNode(id)
+		if err != nil {
+			t.Fatalf("SetUsingExitNode(%v): %v", id, err)
+		}
+		if changed != wantChanged {
+			t.Errorf("SetUsingExitNode(%v) changed = %v; want %v", id, changed, wantChanged)
+		}
+	}
+
+	wantExitNode("")
+	setExitNode(2, true)
+	setExitNode(2, false)
+	wantExitNode("stable-2")
+
+	// It survives later SetHostinfo calls.
+	c.SetHostinfo(&tailcfg.Hostinfo{BackendLogID: "test-backend-log-id"})
+	wantExitNode("stable-2")
+
+	setExitNode(3, true)
+	wantExitNode("stable-3")
+
+	// Unknown nodes are rejected, leaving the current exit node.
+	if changed, err := c.SetUsingExitNode(404); err == nil || changed {
+		t.Errorf("SetUsingExitNode(unknown) = %v, %v; want error", changed, err)
+	}
+	wantExitNode("stable-3")
+
+	setExitNode(0, true)
+	wantExitNode("")
+}
+
+func TestTKAStateChange(t *testing.T) {
+	srv := newTestMapServer(t)
+	var got []TKAState
+	c := srv.newDirect(Options{
+		OnTKAStateChange: func(st TKAState) { got = append(got, st) },
+	})
+	self := &tailcfg.Node{ID: 1}
+
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Node: self})                                // lock off
+		send(&tailcfg.MapResponse{Domain: "unchanged.example"})               // no change
+		send(&tailcfg.MapResponse{TKAInfo: &tailcfg.TKAInfo{Head: "h1"}})     // enabled
+		send(&tailcfg.MapResponse{KeepAlive: true})                           // no change
+		send(&tailcfg.MapResponse{TKAInfo: &tailcfg.TKAInfo{Head: "h1"}})     // no change
+		send(&tailcfg.MapResponse{TKAInfo: &tailcfg.TKAInfo{Head: "h2"}})     // new head
+		send(&tailcfg.MapResponse{TKAInfo: &tailcfg.TKAInfo{Disabled: true}}) // disabled
+		send(&tailcfg.MapResponse{TKAInfo: &tailcfg.TKAInfo{Head: "h3"}})     // re-enabled
+	})
+	pollNetMap(t, c)
+	want := []TKAState{
+		{},
+		{Enabled: true, Head: "h1"},
+		{Enabled: true, Head: "h2"},
+		{},
+		{Enabled: true, Head: "h3"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("OnTKAStateChange calls = %+v; want %+v", got, want)
+	}
+
+	// A new poll starting with the same state doesn't report it again, but
+	// one whose initial response lacks TKAInfo reports lock as off.
+	got = nil
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Node: self, TKAInfo: &tailcfg.TKAInfo{Head: "h3"}})
+	})
+	pollNetMap(t, c)
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Node: self})
+	})
+	pollNetMap(t, c)
+	if want := []TKAState{{}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("OnTKAStateChange calls on new polls = %+v; want %+v", got, want)
+	}
+}
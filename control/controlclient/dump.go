@@ -0,0 +1,66 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+// setLastNetMap records nm as the latest full netmap for DumpNetMap.
+func (c *Direct) setLastNetMap(nm *netmap.NetworkMap) {
+	// Copy it, as the NetmapUpdater may modify nm's fields (such as Peers)
+	// as it applies later deltas.
+	nmCopy := *nm
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastNetMap = &nmCopy
+}
+
+// currentNetMap returns a shallow copy of the current netmap, or nil if there
+// isn't one yet. Its peers reflect any deltas since the last full netmap.
+func (c *Direct) currentNetMap() *netmap.NetworkMap {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lastNetMap == nil {
+		return nil
+	}
+	nm := *c.lastNetMap
+	nm.Peers = make([]tailcfg.NodeView, 0, len(c.peers))
+	for _, ps := range c.peers {
+		nm.Peers = append(nm.Peers, ps.node)
+	}
+	slices.SortFunc(nm.Peers, func(a, b tailcfg.NodeView) int {
+		return cmp.Compare(a.ID(), b.ID())
+	})
+	return &nm
+}
+
+// DumpNetMap writes the current netmap, including the self node, peers, DERP
+// map and DNS config, to the file path as indented JSON, replacing any
+// existing file. It's meant for capturing the client's state for debugging.
+//
+// It doesn't block the map poll while marshaling or writing. It returns an
+// error if no netmap has been received yet.
+func (c *Direct) DumpNetMap(path string) error {
+	nm := c.currentNetMap()
+	if nm == nil {
+		return errors.New("no netmap received yet")
+	}
+	b, err := json.MarshalIndent(nm, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling netmap: %w", err)
+	}
+	if err := atomicfile.WriteFile(path, b, 0600); err != nil {
+		return fmt.Errorf("writing netmap: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+)
+
+// deltaRecordingNetmapUpdater is a recordingNetmapUpdater that also accepts
+// delta updates.
+type deltaRecordingNetmapUpdater struct {
+	recordingNetmapUpdater
+	muts [][]netmap.NodeMutation
+}
+
+func (nu *deltaRecordingNetmapUpdater) UpdateNetmapDelta(muts []netmap.NodeMutation) bool {
+	nu.muts = append(nu.muts, muts)
+	return true
+}
+
+func TestDumpNetMap(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{})
+	path := filepath.Join(t.TempDir(), "netmap.json")
+
+	if err := c.DumpNetMap(path); err == nil {
+		t.Error("DumpNetMap before any netmap succeeded")
+	}
+
+	derpMap := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, RegionCode: "r1", Nodes: []*tailcfg.DERPNode{{Name: "1a", RegionID: 1}}},
+	}}
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{
+			Node:    &tailcfg.Node{ID: 1, Name: "self.example."},
+			Domain:  "example.com",
+			DERPMap: derpMap,
+			DNSConfig: &tailcfg.DNSConfig{
+				Domains: []string{"example.com"},
+			},
+			Peers: []*tailcfg.Node{
+				{ID: 2, Key: key.NewNode().Public(), Addresses: testPeerAddresses(2), Endpoints: eps("1.2.3.4:1")},
+				{ID: 3, Key: key.NewNode().Public(), Addresses: testPeerAddresses(3)},
+			},
+		})
+		// A delta, which the updater handles without a new full netmap.
+		send(&tailcfg.MapResponse{
+			PeersChangedPatch: []*tailcfg.PeerChange{{NodeID: 2, Endpoints: eps("1.2.3.4:99")}},
+		})
+	})
+	var nu deltaRecordingNetmapUpdater
+	c.PollNetMap(context.Background(), &nu)
+	if len(nu.nms) != 1 || len(nu.muts) != 1 {
+		t.Fatalf("got %d full netmaps and %d deltas; want 1 and 1", len(nu.nms), len(nu.muts))
+	}
+
+	if err := c.DumpNetMap(path); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got netmap.NetworkMap
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("unmarshaling dump: %v\n%s", err, b)
+	}
+	if got.SelfNode.ID() != 1 || got.SelfNode.Name() != "self.example." {
+		t.Errorf("SelfNode = %v", got.SelfNode)
+	}
+	if got.Domain != "example.com" {
+		t.Errorf("Domain = %q; want example.com", got.Domain)
+	}
+	if !reflect.DeepEqual(got.DERPMap, derpMap) {
+		t.Errorf("DERPMap = %+v; want %+v", got.DERPMap, derpMap)
+	}
+	if !reflect.DeepEqual(got.DNS.Domains, []string{"example.com"}) {
+		t.Errorf("DNS.Domains = %q", got.DNS.Domains)
+	}
+	if len(got.Peers) != 2 {
+		t.Fatalf("got %d peers; want 2", len(got.Peers))
+	}
+	if ids := []tailcfg.NodeID{got.Peers[0].ID(), got.Peers[1].ID()}; !reflect.DeepEqual(ids, []tailcfg.NodeID{2, 3}) {
+		t.Errorf("peer IDs = %v; want [2 3]", ids)
+	}
+	if got, want := got.Peers[0].Endpoints().AsSlice(), eps("1.2.3.4:99"); !reflect.DeepEqual(got, want) {
+		t.Errorf("peer 2 endpoints = %v; want delta-updated %v", got, want)
+	}
+}
+
+func TestDumpNetMapWriteError(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{})
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 1}})
+	})
+	pollNetMap(t, c)
+
+	path := filepath.Join(t.TempDir(), "no-such-dir", "netmap.json")
+	if err := c.DumpNetMap(path); err == nil {
+		t.Error("DumpNetMap to missing directory succeeded")
+	}
+}
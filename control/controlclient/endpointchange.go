@@ -0,0 +1,139 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/set"
+)
+
+// EndpointChangeReason is one way in which the endpoints passed to
+// Direct.SetEndpoints differed from the previous ones.
+type EndpointChangeReason string
+
+const (
+	// EndpointPortChanged means an IP is advertised with a different port,
+	// as when a NAT mapping changes.
+	EndpointPortChanged EndpointChangeReason = "port-changed"
+
+	// EndpointTypeChanged means an endpoint is advertised with a different
+	// type.
+	EndpointTypeChanged EndpointChangeReason = "type-changed"
+
+	// EndpointAdded means an endpoint was added with an IP that wasn't
+	// advertised before.
+	EndpointAdded EndpointChangeReason = "added"
+
+	// EndpointRemoved means an endpoint was removed whose IP is no longer
+	// advertised.
+	EndpointRemoved EndpointChangeReason = "removed"
+
+	// EndpointReordered means the same endpoints are advertised in a
+	// different order.
+	EndpointReordered EndpointChangeReason = "reordered"
+)
+
+// EndpointChange describes a change to the endpoints passed to
+// Direct.SetEndpoints. See Direct.LastEndpointChange.
+type EndpointChange struct {
+	Time    time.Time              // when the change was made
+	Reasons []EndpointChangeReason // in the order of the EndpointChangeReason constants
+	Added   []tailcfg.Endpoint     // endpoints not advertised before
+	Removed []tailcfg.Endpoint     // endpoints no longer advertised
+}
+
+func (ch EndpointChange) String() string {
+	var sb strings.Builder
+	for i, r := range ch.Reasons {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(string(r))
+	}
+	if len(ch.Added) > 0 || len(ch.Removed) > 0 {
+		fmt.Fprintf(&sb, " (+%v -%v)", ch.Added, ch.Removed)
+	}
+	return sb.String()
+}
+
+// diffEndpoints returns how the endpoints changed from old to new, which must
+// differ.
+func diffEndpoints(old, new []tailcfg.Endpoint) EndpointChange {
+	var ch EndpointChange
+	oldSet, newSet := set.Of(old...), set.Of(new...)
+	for _, ep := range new {
+		if !oldSet.Contains(ep) && !slices.Contains(ch.Added, ep) {
+			ch.Added = append(ch.Added, ep)
+		}
+	}
+	for _, ep := range old {
+		if !newSet.Contains(ep) && !slices.Contains(ch.Removed, ep) {
+			ch.Removed = append(ch.Removed, ep)
+		}
+	}
+	if len(ch.Added) == 0 && len(ch.Removed) == 0 {
+		ch.Reasons = []EndpointChangeReason{EndpointReordered}
+		return ch
+	}
+
+	removedAddrPorts := make(set.Set[netip.AddrPort])
+	removedIPs := make(set.Set[netip.Addr])
+	for _, ep := range ch.Removed {
+		removedAddrPorts.Add(ep.Addr)
+		removedIPs.Add(ep.Addr.Addr())
+	}
+	addedAddrPorts := make(set.Set[netip.AddrPort])
+	addedIPs := make(set.Set[netip.Addr])
+	for _, ep := range ch.Added {
+		addedAddrPorts.Add(ep.Addr)
+		addedIPs.Add(ep.Addr.Addr())
+	}
+
+	var portChanged, typeChanged, added, removed bool
+	for _, ep := range ch.Added {
+		switch {
+		case removedAddrPorts.Contains(ep.Addr):
+			typeChanged = true
+		case removedIPs.Contains(ep.Addr.Addr()):
+			portChanged = true
+		default:
+			added = true
+		}
+	}
+	for _, ep := range ch.Removed {
+		if !addedAddrPorts.Contains(ep.Addr) && !addedIPs.Contains(ep.Addr.Addr()) {
+			removed = true
+		}
+	}
+	for _, r := range []struct {
+		ok     bool
+		reason EndpointChangeReason
+	}{
+		{portChanged, EndpointPortChanged},
+		{typeChanged, EndpointTypeChanged},
+		{added, EndpointAdded},
+		{removed, EndpointRemoved},
+	} {
+		if r.ok {
+			ch.Reasons = append(ch.Reasons, r.reason)
+		}
+	}
+	return ch
+}
+
+// LastEndpointChange returns how the endpoints passed to SetEndpoints last
+// changed, or the zero value if they never have. It's meant for debugging
+// frequent endpoint updates, such as from behind a NAT that keeps changing
+// its port mappings.
+func (c *Direct) LastEndpointChange() EndpointChange {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastEndpointChange
+}
@@ -0,0 +1,134 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
+)
+
+func TestDiffEndpoints(t *testing.T) {
+	ep := func(s string, typ tailcfg.EndpointType) tailcfg.Endpoint {
+		return tailcfg.Endpoint{Addr: netip.MustParseAddrPort(s), Type: typ}
+	}
+	var (
+		local  = ep("192.168.1.2:41641", tailcfg.EndpointLocal)
+		stun   = ep("1.2.3.4:41641", tailcfg.EndpointSTUN)
+		stun2  = ep("1.2.3.4:50000", tailcfg.EndpointSTUN)
+		mapped = ep("1.2.3.4:41641", tailcfg.EndpointPortmapped)
+		other  = ep("5.6.7.8:41641", tailcfg.EndpointSTUN)
+	)
+	reasons := func(rs ...EndpointChangeReason) []EndpointChangeReason { return rs }
+	eps := func(eps ...tailcfg.Endpoint) []tailcfg.Endpoint { return eps }
+	tests := []struct {
+		name        string
+		old, new    []tailcfg.Endpoint
+		wantReasons []EndpointChangeReason
+		wantAdded   []tailcfg.Endpoint
+		wantRemoved []tailcfg.Endpoint
+	}{
+		{
+			name:        "first",
+			new:         eps(local, stun),
+			wantReasons: reasons(EndpointAdded),
+			wantAdded:   eps(local, stun),
+		},
+		{
+			name:        "added",
+			old:         eps(local),
+			new:         eps(local, stun),
+			wantReasons: reasons(EndpointAdded),
+			wantAdded:   eps(stun),
+		},
+		{
+			name:        "removed",
+			old:         eps(local, stun),
+			new:         eps(local),
+			wantReasons: reasons(EndpointRemoved),
+			wantRemoved: eps(stun),
+		},
+		{
+			name:        "port_changed",
+			old:         eps(local, stun),
+			new:         eps(local, stun2),
+			wantReasons: reasons(EndpointPortChanged),
+			wantAdded:   eps(stun2),
+			wantRemoved: eps(stun),
+		},
+		{
+			name:        "type_changed",
+			old:         eps(stun),
+			new:         eps(mapped),
+			wantReasons: reasons(EndpointTypeChanged),
+			wantAdded:   eps(mapped),
+			wantRemoved: eps(stun),
+		},
+		{
+			name:        "reordered",
+			old:         eps(local, stun),
+			new:         eps(stun, local),
+			wantReasons: reasons(EndpointReordered),
+		},
+		{
+			name:        "several",
+			old:         eps(local, stun),
+			new:         eps(stun2, other),
+			wantReasons: reasons(EndpointPortChanged, EndpointAdded, EndpointRemoved),
+			wantAdded:   eps(stun2, other),
+			wantRemoved: eps(local, stun),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffEndpoints(tt.old, tt.new)
+			if !reflect.DeepEqual(got.Reasons, tt.wantReasons) {
+				t.Errorf("Reasons = %v; want %v", got.Reasons, tt.wantReasons)
+			}
+			if !reflect.DeepEqual(got.Added, tt.wantAdded) {
+				t.Errorf("Added = %v; want %v", got.Added, tt.wantAdded)
+			}
+			if !reflect.DeepEqual(got.Removed, tt.wantRemoved) {
+				t.Errorf("Removed = %v; want %v", got.Removed, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+func TestLastEndpointChange(t *testing.T) {
+	clk := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1000, 0)})
+	c := newTestMapServer(t).newDirect(Options{Clock: clk})
+	if got := c.LastEndpointChange(); !reflect.DeepEqual(got, EndpointChange{}) {
+		t.Errorf("LastEndpointChange before SetEndpoints = %v; want zero", got)
+	}
+
+	c.SetEndpoints(fakeEndpoints(1, 2))
+	clk.Advance(time.Minute)
+	c.SetEndpoints(fakeEndpoints(1, 3))
+	want := EndpointChange{
+		Time:    clk.Now(),
+		Reasons: []EndpointChangeReason{EndpointPortChanged},
+		Added:   fakeEndpoints(3),
+		Removed: fakeEndpoints(2),
+	}
+	got := c.LastEndpointChange()
+	if !got.Time.Equal(want.Time) {
+		t.Errorf("LastEndpointChange().Time = %v; want %v", got.Time, want.Time)
+	}
+	got.Time = want.Time
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LastEndpointChange() = %v; want %v", got, want)
+	}
+
+	// Unchanged endpoints keep the last change.
+	clk.Advance(time.Minute)
+	c.SetEndpoints(fakeEndpoints(1, 3))
+	if got := c.LastEndpointChange(); !got.Time.Equal(want.Time) {
+		t.Errorf("LastEndpointChange().Time after no change = %v; want %v", got.Time, want.Time)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+const (
+	defaultEndpointMaxRetries  = 3
+	defaultEndpointMaxDuration = 30 * time.Second
+
+	// endpointRetryBase is the delay before the first retry of a failed
+	// endpoint update. It doubles for each further retry, before jitter.
+	endpointRetryBase = time.Second
+)
+
+// EndpointUpdateError is the error returned by Direct.PushEndpoints when it
+// couldn't send the endpoint update to control.
+type EndpointUpdateError struct {
+	Err      error // the last error
+	Attempts int   // number of update requests made
+
+	// Permanent is whether Err is a permanent failure (such as control
+	// rejecting the request), as opposed to a transient one that was
+	// retried until the retries or time ran out, or the context was done.
+	Permanent bool
+}
+
+func (e *EndpointUpdateError) Error() string {
+	if e.Permanent {
+		return fmt.Sprintf("endpoint update rejected: %v", e.Err)
+	}
+	return fmt.Sprintf("endpoint update failed after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *EndpointUpdateError) Unwrap() error { return e.Err }
+
+// isPermanentMapError reports whether err, from sendMapRequest, is a client
+// error response from control that a retry won't fix.
+func isPermanentMapError(err error) bool {
+	var se mapStatusError
+	if !errors.As(err, &se) {
+		return false
+	}
+	// Too Many Requests is a 4xx but is worth retrying after a backoff.
+	return se.code >= 400 && se.code < 500 && se.code != http.StatusTooManyRequests
+}
+
+// PushEndpoints updates the locally advertised endpoints, like SetEndpoints,
+// and if they changed, immediately sends them to control in a lite map
+// update. Transient failures are retried with jittered exponential backoff,
+// up to Options.EndpointUpdateMaxRetries times and within
+// Options.EndpointUpdateMaxDuration.
+//
+// If endpoints were sent to control within Options.EndpointPushMinInterval
+// (or the interval control asked for), they're sent once it has elapsed.
+// Changes made in the meantime, by this or Auto.UpdateEndpoints, are sent
+// in the same update, and each PushEndpoints call waiting on it gets its
+// result. If that update was scheduled by Auto.UpdateEndpoints, which sends
+// and retries it in the background, the result is nil once it's queued.
+//
+// It reports whether the endpoints changed. A failed update returns an
+// *EndpointUpdateError.
+func (c *Direct) PushEndpoints(ctx context.Context, endpoints []tailcfg.Endpoint) (changed bool, err error) {
+	if !c.newEndpoints(endpoints) {
+		return false, nil
+	}
+	r := c.reportEndpoints(ctx, c.sendEndpointUpdate)
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		select {
+		case <-r.done: // prefer the result if it's already in
+		default:
+			return true, &EndpointUpdateError{Err: ctx.Err()}
+		}
+	}
+	return true, r.err
+}
+
+// sendEndpointUpdate sends the current endpoints to control in a lite map
+// update, retrying transient failures as described by PushEndpoints.
+func (c *Direct) sendEndpointUpdate(ctx context.Context) error {
+	maxRetries := c.endpointMaxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultEndpointMaxRetries
+	}
+	maxDuration := c.endpointMaxDuration
+	if maxDuration == 0 {
+		maxDuration = defaultEndpointMaxDuration
+	}
+
+	start := c.clock.Now()
+	delay := endpointRetryBase
+	for attempt := 1; ; attempt++ {
+		err := c.SendUpdate(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return &EndpointUpdateError{Err: ctx.Err(), Attempts: attempt}
+		}
+		if isPermanentMapError(err) {
+			return &EndpointUpdateError{Err: err, Attempts: attempt, Permanent: true}
+		}
+		// Randomize the delay between 0.5-1.5x to avoid thundering herds.
+		d := time.Duration(float64(delay) * (rand.Float64() + 0.5))
+		if attempt > maxRetries || c.clock.Since(start)+d > maxDuration {
+			return &EndpointUpdateError{Err: err, Attempts: attempt}
+		}
+		c.logf("endpoint update failed, retrying in %v: %v", d.Round(time.Millisecond), err)
+		t, ch := c.clock.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return &EndpointUpdateError{Err: ctx.Err(), Attempts: attempt}
+		case <-ch:
+		}
+		delay *= 2
+	}
+}
+
+// endpointReport is a report of changed endpoints to control. While it waits
+// for endpointReportDelay, further changes are sent with it rather than
+// separately.
+type endpointReport struct {
+	cancel context.CancelFunc // stops the wait; nil if it didn't wait
+	done   chan struct{}      // closed once the report is sent or has failed
+	err    error              // the report's result, once done is closed
+}
+
+// reportEndpoints arranges for send to be called to report changed endpoints
+// to control once endpointReportDelay allows: at once, in the caller's
+// goroutine, if it allows it now, or else from a new goroutine after the
+// delay, unless ctx is done or c is closed first.
+//
+// If an earlier report is still waiting, send isn't called: that report
+// sends the latest endpoints, including the caller's. Either way, the
+// returned report is the one carrying the caller's endpoints.
+func (c *Direct) reportEndpoints(ctx context.Context, send func(context.Context) error) *endpointReport {
+	r := &endpointReport{done: make(chan struct{})}
+	c.mu.Lock()
+	if pending := c.endpointReport; pending != nil {
+		c.mu.Unlock()
+		c.logf("[v1] endpoint update coalesced with a pending one")
+		return pending
+	}
+	d := c.endpointReportDelayLocked()
+	if d > 0 {
+		ctx, r.cancel = context.WithCancel(ctx)
+		c.endpointReport = r
+	}
+	c.mu.Unlock()
+
+	if d <= 0 {
+		r.err = send(ctx)
+		close(r.done)
+		return r
+	}
+	go func() {
+		defer r.cancel()
+		defer close(r.done)
+		for ; d > 0; d = c.endpointReportDelay() {
+			t, ch := c.clock.NewTimer(d)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				c.mu.Lock()
+				c.endpointReport = nil
+				c.mu.Unlock()
+				r.err = &EndpointUpdateError{Err: ctx.Err()}
+				return
+			case <-ch:
+			}
+		}
+		// Changes from now on might not make it into this report, so
+		// they start another.
+		c.mu.Lock()
+		c.endpointReport = nil
+		c.mu.Unlock()
+		r.err = send(ctx)
+	}()
+	return r
+}
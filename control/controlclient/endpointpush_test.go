@@ -0,0 +1,346 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tailscale.com/tstest"
+	"tailscale.com/tstime"
+)
+
+// retryClock is a tstest.Clock that reports the timers created with it, other
+// than map request watchdogs, so that tests can advance time past them.
+type retryClock struct {
+	*tstest.Clock
+	timers chan time.Duration
+}
+
+func newRetryClock() *retryClock {
+	return &retryClock{
+		Clock:  tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1000, 0)}),
+		timers: make(chan time.Duration),
+	}
+}
+
+func (c *retryClock) NewTimer(d time.Duration) (tstime.TimerController, <-chan time.Time) {
+	t, ch := c.Clock.NewTimer(d)
+	if d < watchdogTimeout {
+		c.timers <- d
+	}
+	return t, ch
+}
+
+// run runs f, advancing the clock past each timer it creates, and returns the
+// durations of those timers.
+func (c *retryClock) run(f func()) (timers []time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	for {
+		select {
+		case d := <-c.timers:
+			timers = append(timers, d)
+			c.Advance(d)
+		case <-done:
+			return timers
+		}
+	}
+}
+
+func TestPushEndpoints(t *testing.T) {
+	const failed = http.StatusInternalServerError
+	tests := []struct {
+		name          string
+		opts          Options
+		fails         []int
+		wantErr       bool
+		wantPermanent bool
+		wantAttempts  int
+	}{
+		{
+			name:         "ok",
+			wantAttempts: 1,
+		},
+		{
+			name:         "transient",
+			fails:        []int{failed, http.StatusBadGateway},
+			wantAttempts: 3,
+		},
+		{
+			name:         "too_many_requests",
+			fails:        []int{http.StatusTooManyRequests},
+			wantAttempts: 2,
+		},
+		{
+			name:         "retries_exhausted",
+			fails:        []int{failed, failed, failed, failed, failed},
+			wantErr:      true,
+			wantAttempts: 4,
+		},
+		{
+			name:         "custom_retries",
+			opts:         Options{EndpointUpdateMaxRetries: 1},
+			fails:        []int{failed, failed, failed},
+			wantErr:      true,
+			wantAttempts: 2,
+		},
+		{
+			name:         "no_retries",
+			opts:         Options{EndpointUpdateMaxRetries: -1},
+			fails:        []int{failed},
+			wantErr:      true,
+			wantAttempts: 1,
+		},
+		{
+			// The first retry waits at most 1.5s, but the second would
+			// exceed it.
+			name:         "max_duration",
+			opts:         Options{EndpointUpdateMaxRetries: 10, EndpointUpdateMaxDuration: 1500 * time.Millisecond},
+			fails:        []int{failed, failed, failed, failed, failed},
+			wantErr:      true,
+			wantAttempts: 2,
+		},
+		{
+			name:          "permanent",
+			fails:         []int{http.StatusForbidden},
+			wantErr:       true,
+			wantPermanent: true,
+			wantAttempts:  1,
+		},
+		{
+			name:          "permanent_after_transient",
+			fails:         []int{failed, http.StatusBadRequest},
+			wantErr:       true,
+			wantPermanent: true,
+			wantAttempts:  2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestMapServer(t)
+			clk := newRetryClock()
+			tt.opts.Clock = clk
+			c := srv.newDirect(tt.opts)
+			srv.failNextMaps(tt.fails...)
+
+			var changed bool
+			var err error
+			timers := clk.run(func() {
+				changed, err = c.PushEndpoints(context.Background(), testEndpoints("1.2.3.4:41641"))
+			})
+			if !changed {
+				t.Error("PushEndpoints reported unchanged endpoints")
+			}
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("PushEndpoints error = %v; want error: %v", err, tt.wantErr)
+			}
+			if got := len(srv.requests()); got != tt.wantAttempts {
+				t.Errorf("got %d map requests; want %d", got, tt.wantAttempts)
+			}
+			for _, req := range srv.requests() {
+				if len(req.Endpoints) != 1 {
+					t.Errorf("map request has endpoints %v; want the new one", req.Endpoints)
+				}
+			}
+
+			// Each retry waits 2^n seconds, jittered by 0.5-1.5x.
+			if len(timers) != tt.wantAttempts-1 {
+				t.Errorf("waited %d times (%v); want %d", len(timers), timers, tt.wantAttempts-1)
+			}
+			for i, d := range timers {
+				base := time.Second << i
+				if d < base/2 || d > base*3/2 {
+					t.Errorf("retry %d waited %v; want %v +/- 50%%", i, d, base)
+				}
+			}
+
+			if !tt.wantErr {
+				return
+			}
+			var ue *EndpointUpdateError
+			if !errors.As(err, &ue) {
+				t.Fatalf("error %v (%T) isn't an *EndpointUpdateError", err, err)
+			}
+			if ue.Permanent != tt.wantPermanent {
+				t.Errorf("Permanent = %v; want %v", ue.Permanent, tt.wantPermanent)
+			}
+			if ue.Attempts != tt.wantAttempts {
+				t.Errorf("Attempts = %d; want %d", ue.Attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestPushEndpointsUnchanged(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{})
+	eps := testEndpoints("1.2.3.4:41641")
+	c.SetEndpoints(eps)
+
+	changed, err := c.PushEndpoints(context.Background(), eps)
+	if changed || err != nil {
+		t.Errorf("PushEndpoints = %v, %v; want false, nil", changed, err)
+	}
+	if got := len(srv.requests()); got != 0 {
+		t.Errorf("got %d map requests; want none", got)
+	}
+}
+
+func TestPushEndpointsCanceled(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{})
+	srv.failNextMaps(http.StatusInternalServerError)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.PushEndpoints(ctx, testEndpoints("1.2.3.4:41641"))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("PushEndpoints error = %v; want context.Canceled", err)
+	}
+	var ue *EndpointUpdateError
+	if !errors.As(err, &ue) || ue.Permanent || ue.Attempts != 1 {
+		t.Errorf("PushEndpoints error = %#v; want a non-permanent *EndpointUpdateError after 1 attempt", err)
+	}
+}
+
+func TestPushEndpointsMinInterval(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		failure int // HTTP status for the delayed update, or 0
+	}{
+		{"ok", 0},
+		{"failed", http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			const interval = 10 * time.Second
+			srv := newTestMapServer(t)
+			clk := newRetryClock()
+			var joined atomic.Int32
+			c := srv.newDirect(Options{
+				Clock:                   clk,
+				EndpointPushMinInterval: interval,
+				Logf: func(format string, args ...any) {
+					if strings.Contains(format, "coalesced") {
+						joined.Add(1)
+					}
+					t.Logf(format, args...)
+				},
+			})
+			ctx := context.Background()
+
+			// Nothing has been sent yet, so the first push goes out at once.
+			if _, err := c.PushEndpoints(ctx, testEndpoints("1.2.3.4:1")); err != nil {
+				t.Fatal(err)
+			}
+
+			// The next change waits for the interval, and the two after it
+			// are sent along with it and get its result.
+			done := make(chan error)
+			push := func(ep string) {
+				changed, err := c.PushEndpoints(ctx, testEndpoints(ep))
+				if !changed {
+					t.Errorf("PushEndpoints(%v) = false; want true", ep)
+				}
+				done <- err
+			}
+			go push("1.2.3.4:2")
+			if d := <-clk.timers; d != interval {
+				t.Errorf("waited %v; want %v", d, interval)
+			}
+			for i, ep := range []string{"1.2.3.4:3", "1.2.3.4:4"} {
+				go push(ep)
+				if err := tstest.WaitFor(5*time.Second, func() error {
+					if joined.Load() != int32(i+1) {
+						return errors.New("push not merged yet")
+					}
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := len(srv.requests()); got != 1 {
+				t.Errorf("got %d map requests before the interval; want 1", got)
+			}
+			if tt.failure != 0 {
+				srv.failNextMaps(tt.failure)
+			}
+			clk.Advance(interval)
+			for range 3 {
+				err := <-done
+				if tt.failure == 0 {
+					if err != nil {
+						t.Errorf("PushEndpoints: %v", err)
+					}
+					continue
+				}
+				var ue *EndpointUpdateError
+				if !errors.As(err, &ue) || !ue.Permanent {
+					t.Errorf("PushEndpoints error = %v; want permanent *EndpointUpdateError", err)
+				}
+			}
+
+			reqs := srv.requests()
+			if len(reqs) != 2 {
+				t.Fatalf("got %d map requests; want 2", len(reqs))
+			}
+			if got, want := reqs[1].Endpoints, testEndpoints("1.2.3.4:4"); len(got) != 1 || got[0] != want[0].Addr {
+				t.Errorf("sent endpoints %v; want only the last, %v", got, want[0].Addr)
+			}
+		})
+	}
+}
+
+// TestPushEndpointsJoinsPendingReport tests that PushEndpoints doesn't send
+// its own update while one scheduled elsewhere (as by Auto.UpdateEndpoints)
+// is waiting for the minimum interval.
+func TestPushEndpointsJoinsPendingReport(t *testing.T) {
+	const interval = 10 * time.Second
+	srv := newTestMapServer(t)
+	clk := newRetryClock()
+	c := srv.newDirect(Options{Clock: clk, EndpointPushMinInterval: interval})
+	ctx := context.Background()
+
+	if _, err := c.PushEndpoints(ctx, testEndpoints("1.2.3.4:1")); err != nil {
+		t.Fatal(err)
+	}
+	var sends atomic.Int32
+	c.SetEndpoints(testEndpoints("1.2.3.4:2"))
+	c.reportEndpoints(ctx, func(context.Context) error {
+		sends.Add(1)
+		return nil
+	})
+	if d := <-clk.timers; d != interval {
+		t.Errorf("waited %v; want %v", d, interval)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := c.PushEndpoints(ctx, testEndpoints("1.2.3.4:3"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("PushEndpoints returned before the interval: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clk.Advance(interval)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := sends.Load(); got != 1 {
+		t.Errorf("pending report sent %d times; want 1", got)
+	}
+	if got := len(srv.requests()); got != 1 {
+		t.Errorf("got %d map requests; want 1 (the first push only)", got)
+	}
+}
@@ -0,0 +1,9 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !(linux || (darwin && !ios) || freebsd || openbsd)
+
+package controlclient
+
+// sshServerBuilt is false on platforms without the Tailscale SSH server.
+const sshServerBuilt = false
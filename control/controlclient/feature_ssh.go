@@ -0,0 +1,11 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || (darwin && !ios) || freebsd || openbsd
+
+package controlclient
+
+// sshServerBuilt is whether the Tailscale SSH server (tailscale.com/ssh/tailssh)
+// builds for this platform, so tailcfg.ClientFeatureSSH is advertised unless
+// envknob.CanSSHD says otherwise.
+const sshServerBuilt = true
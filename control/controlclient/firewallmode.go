@@ -0,0 +1,40 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import "strings"
+
+// firewallMode returns the NetInfo.FirewallMode value to report from
+// Options.FirewallModeFunc, or the empty string if the mode is unknown or the
+// platform's firewall isn't managed by the client. It must only be called if
+// c.firewallModeFunc is non-nil.
+func (c *Direct) firewallMode() string {
+	m := c.firewallModeFunc()
+	if strings.HasPrefix(m, "nft-") || strings.HasPrefix(m, "ipt-") {
+		return m
+	}
+	return ""
+}
+
+// RefreshFirewallMode re-evaluates Options.FirewallModeFunc and reports
+// whether the NetInfo.FirewallMode value changed, in which case the new
+// NetInfo should be sent to control. It does nothing if there's no
+// FirewallModeFunc or no NetInfo yet.
+func (c *Direct) RefreshFirewallMode() (changed bool) {
+	if c.firewallModeFunc == nil {
+		return false
+	}
+	mode := c.firewallMode()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.netinfo == nil || c.netinfo.FirewallMode == mode {
+		return false
+	}
+	ni := c.netinfo.Clone()
+	ni.FirewallMode = mode
+	c.netinfo = ni
+	c.netinfoChanged = c.clock.Now()
+	c.logf("[v1] NetInfo.FirewallMode: %q", mode)
+	return true
+}
@@ -0,0 +1,80 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"time"
+
+	"tailscale.com/tstime"
+)
+
+// defaultKeyExpiryWarning is how long before the node key expires that
+// Options.OnKeyExpiry is called, if Options.KeyExpiryWarning is zero.
+const defaultKeyExpiryWarning = 24 * time.Hour
+
+// keyExpiryState is the state of the Options.OnKeyExpiry warning, guarded by
+// Direct.mu.
+type keyExpiryState struct {
+	armed  time.Time              // the key expiry that timer is for, if any
+	warned time.Time              // the last key expiry OnKeyExpiry was called for
+	timer  tstime.TimerController // or nil
+}
+
+// noteKeyExpiry arms the Options.OnKeyExpiry warning for the node key expiry
+// exp, as learned from control. The zero value means the key doesn't expire.
+func (c *Direct) noteKeyExpiry(exp time.Time) {
+	if c.onKeyExpiry == nil {
+		return
+	}
+	c.mu.Lock()
+	ke := &c.keyExpiry
+	if exp.Equal(ke.armed) {
+		c.mu.Unlock()
+		return
+	}
+	if ke.timer != nil {
+		ke.timer.Stop()
+		ke.timer = nil
+	}
+	ke.armed = exp
+	if exp.IsZero() || exp.Equal(ke.warned) {
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+
+	warning := c.keyExpiryWarning
+	if warning == 0 {
+		warning = defaultKeyExpiryWarning
+	}
+	d := max(exp.Sub(c.clock.Now())-warning, 0)
+	// The timer may fire before AfterFunc returns, so create it without
+	// holding c.mu.
+	t := c.clock.AfterFunc(d, func() { c.warnKeyExpiry(exp) })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if exp.Equal(ke.armed) && !exp.Equal(ke.warned) && ke.timer == nil {
+		ke.timer = t
+	} else {
+		t.Stop()
+	}
+}
+
+// warnKeyExpiry calls Options.OnKeyExpiry for the node key expiry exp, if it
+// hasn't been already and exp is still current.
+func (c *Direct) warnKeyExpiry(exp time.Time) {
+	c.mu.Lock()
+	ke := &c.keyExpiry
+	if !exp.Equal(ke.armed) || exp.Equal(ke.warned) {
+		c.mu.Unlock()
+		return
+	}
+	ke.warned = exp
+	ke.timer = nil
+	c.mu.Unlock()
+
+	c.logf("node key expires soon, at %v", exp.UTC())
+	c.onKeyExpiry(exp)
+}
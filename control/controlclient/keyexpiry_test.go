@@ -0,0 +1,96 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
+)
+
+func TestOnKeyExpiry(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clk := tstest.NewClock(tstest.ClockOpts{Start: start})
+	srv := newTestMapServer(t)
+	var got []time.Time
+	c := srv.newDirect(Options{
+		Clock:       clk,
+		OnKeyExpiry: func(exp time.Time) { got = append(got, exp) },
+	})
+
+	// pollExpiry runs a map poll in which control reports the key expiry exp.
+	pollExpiry := func(exp time.Time) {
+		t.Helper()
+		srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+			send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 1, KeyExpiry: exp}})
+		})
+		pollNetMap(t, c)
+	}
+	wantWarnings := func(want ...time.Time) {
+		t.Helper()
+		if !slices.EqualFunc(got, want, time.Time.Equal) {
+			t.Errorf("OnKeyExpiry calls = %v; want %v", got, want)
+		}
+	}
+
+	exp1 := start.Add(48 * time.Hour)
+	pollExpiry(exp1)
+	clk.Advance(23 * time.Hour)
+	wantWarnings()
+	clk.Advance(time.Hour)
+	wantWarnings(exp1)
+
+	// The same expiry doesn't warn again.
+	pollExpiry(exp1)
+	clk.Advance(time.Hour)
+	wantWarnings(exp1)
+
+	// A later expiry re-arms the warning.
+	exp2 := start.Add(100 * time.Hour)
+	pollExpiry(exp2)
+	clk.AdvanceTo(exp2.Add(-24*time.Hour - time.Second))
+	wantWarnings(exp1)
+	clk.Advance(time.Second)
+	wantWarnings(exp1, exp2)
+
+	// An expiry already within the warning period warns right away.
+	exp3 := clk.Now().Add(time.Hour)
+	pollExpiry(exp3)
+	clk.Advance(0)
+	wantWarnings(exp1, exp2, exp3)
+
+	// A key that doesn't expire never warns.
+	pollExpiry(time.Time{})
+	clk.Advance(1000 * time.Hour)
+	wantWarnings(exp1, exp2, exp3)
+}
+
+func TestOnKeyExpiryCustomWarning(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clk := tstest.NewClock(tstest.ClockOpts{Start: start})
+	srv := newTestMapServer(t)
+	var got []time.Time
+	c := srv.newDirect(Options{
+		Clock:            clk,
+		OnKeyExpiry:      func(exp time.Time) { got = append(got, exp) },
+		KeyExpiryWarning: time.Hour,
+	})
+	exp := start.Add(48 * time.Hour)
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 1, KeyExpiry: exp}})
+	})
+	pollNetMap(t, c)
+
+	clk.AdvanceTo(exp.Add(-time.Hour - time.Second))
+	if len(got) != 0 {
+		t.Fatalf("OnKeyExpiry called %v before the warning period", got)
+	}
+	clk.Advance(time.Second)
+	if want := []time.Time{exp}; !slices.EqualFunc(got, want, time.Time.Equal) {
+		t.Errorf("OnKeyExpiry calls = %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/mak"
+)
+
+const (
+	// maxLatencySamplesPerPeer is the most latency samples kept per peer
+	// between uploads. Older samples are dropped first.
+	maxLatencySamplesPerPeer = 32
+
+	// maxLatencyPeers is the most peers whose latency samples are kept
+	// between uploads. Samples for further peers are dropped.
+	maxLatencyPeers = 256
+
+	// maxLatencyReports is the most PeerLatency entries sent in a single
+	// MapRequest. The peers with the most samples are preferred.
+	maxLatencyReports = 64
+)
+
+// ReportPeerLatency records a measured round-trip time to the peer with the
+// given node ID, to be aggregated and sent to control in a later MapRequest.
+// It's a no-op unless Options.ReportPeerLatency is set.
+//
+// Samples are only uploaded if the node has the
+// tailcfg.NodeAttrReportPeerLatency capability. They're sent with the next
+// lite map update and discarded once control has accepted it.
+func (c *Direct) ReportPeerLatency(id tailcfg.NodeID, rtt time.Duration) {
+	if !c.reportPeerLatency || rtt <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	samples, ok := c.peerLatency[id]
+	if !ok && len(c.peerLatency) >= maxLatencyPeers {
+		return
+	}
+	if len(samples) == maxLatencySamplesPerPeer {
+		samples = append(samples[:0], samples[1:]...)
+	}
+	if c.peerLatency == nil {
+		c.peerLatency = make(map[tailcfg.NodeID][]time.Duration)
+	}
+	c.peerLatency[id] = append(samples, rtt)
+}
+
+// takePeerLatencies returns the aggregated peer latencies to send in the next
+// MapRequest, if reporting them is enabled and allowed, and resets them. It
+// also returns the samples taken, to be passed to restorePeerLatencies if the
+// MapRequest fails.
+func (c *Direct) takePeerLatencies() ([]tailcfg.PeerLatency, map[tailcfg.NodeID][]time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.peerLatencyAllowed || len(c.peerLatency) == 0 {
+		return nil, nil
+	}
+	taken := c.peerLatency
+	c.peerLatency = nil
+	ret := make([]tailcfg.PeerLatency, 0, len(taken))
+	for id, samples := range taken {
+		ret = append(ret, aggregateLatency(id, slices.Clone(samples)))
+	}
+
+	if len(ret) > maxLatencyReports {
+		slices.SortFunc(ret, func(a, b tailcfg.PeerLatency) int {
+			return cmp.Or(cmp.Compare(b.Samples, a.Samples), cmp.Compare(a.NodeID, b.NodeID))
+		})
+		ret = ret[:maxLatencyReports]
+	}
+	slices.SortFunc(ret, func(a, b tailcfg.PeerLatency) int {
+		return cmp.Compare(a.NodeID, b.NodeID)
+	})
+	return ret, taken
+}
+
+// restorePeerLatencies puts back samples returned by takePeerLatencies for a
+// MapRequest that control didn't accept, ahead of any recorded since, so
+// that they're sent with the next one.
+func (c *Direct) restorePeerLatencies(taken map[tailcfg.NodeID][]time.Duration) {
+	if len(taken) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, old := range taken {
+		cur, ok := c.peerLatency[id]
+		if !ok && len(c.peerLatency) >= maxLatencyPeers {
+			continue
+		}
+		samples := append(old, cur...)
+		if n := len(samples) - maxLatencySamplesPerPeer; n > 0 {
+			samples = samples[n:]
+		}
+		mak.Set(&c.peerLatency, id, samples)
+	}
+}
+
+// aggregateLatency summarizes the non-empty samples measured for peer id.
+// It sorts samples in place.
+func aggregateLatency(id tailcfg.NodeID, samples []time.Duration) tailcfg.PeerLatency {
+	slices.Sort(samples)
+	n := len(samples)
+	return tailcfg.PeerLatency{
+		NodeID:  id,
+		Samples: n,
+		P50:     samples[(n-1)*50/100],
+		P95:     samples[(n-1)*95/100],
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestAggregateLatency(t *testing.T) {
+	var samples []time.Duration
+	for i := 20; i >= 1; i-- {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+	got := aggregateLatency(7, samples)
+	want := tailcfg.PeerLatency{
+		NodeID:  7,
+		Samples: 20,
+		P50:     10 * time.Millisecond,
+		P95:     19 * time.Millisecond,
+	}
+	if got != want {
+		t.Errorf("aggregateLatency = %+v; want %+v", got, want)
+	}
+
+	got = aggregateLatency(8, []time.Duration{5 * time.Millisecond})
+	want = tailcfg.PeerLatency{NodeID: 8, Samples: 1, P50: 5 * time.Millisecond, P95: 5 * time.Millisecond}
+	if got != want {
+		t.Errorf("aggregateLatency single sample = %+v; want %+v", got, want)
+	}
+}
+
+// pollWithPeerLatencyCap polls a netmap in which the self node has the
+// NodeAttrReportPeerLatency capability if allowed.
+func pollWithPeerLatencyCap(t *testing.T, srv *testMapServer, c *Direct, allowed bool) {
+	t.Helper()
+	self := &tailcfg.Node{ID: 1}
+	if allowed {
+		self.CapMap = tailcfg.NodeCapMap{tailcfg.NodeAttrReportPeerLatency: nil}
+	}
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Node: self})
+	})
+	pollNetMap(t, c)
+}
+
+// sentPeerLatencies sends a map update and returns the peer latencies in it.
+func sentPeerLatencies(t *testing.T, srv *testMapServer, c *Direct) []tailcfg.PeerLatency {
+	t.Helper()
+	if err := c.SendUpdate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return srv.lastRequest().PeerLatencies
+}
+
+func TestReportPeerLatency(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{ReportPeerLatency: true})
+
+	c.ReportPeerLatency(2, 10*time.Millisecond)
+	c.ReportPeerLatency(2, 30*time.Millisecond)
+	c.ReportPeerLatency(2, 20*time.Millisecond)
+	c.ReportPeerLatency(3, 0) // ignored
+
+	// Nothing is sent without the capability.
+	if got := sentPeerLatencies(t, srv, c); got != nil {
+		t.Errorf("PeerLatencies without capability = %+v; want none", got)
+	}
+	pollWithPeerLatencyCap(t, srv, c, false)
+	if got := sentPeerLatencies(t, srv, c); got != nil {
+		t.Errorf("PeerLatencies without capability = %+v; want none", got)
+	}
+
+	// Once allowed, samples (including those from before) are sent once.
+	pollWithPeerLatencyCap(t, srv, c, true)
+	c.ReportPeerLatency(1, 5*time.Millisecond)
+	want := []tailcfg.PeerLatency{
+		{NodeID: 1, Samples: 1, P50: 5 * time.Millisecond, P95: 5 * time.Millisecond},
+		{NodeID: 2, Samples: 3, P50: 20 * time.Millisecond, P95: 20 * time.Millisecond},
+	}
+	if got := sentPeerLatencies(t, srv, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("PeerLatencies = %+v; want %+v", got, want)
+	}
+	if got := sentPeerLatencies(t, srv, c); got != nil {
+		t.Errorf("PeerLatencies after upload = %+v; want none", got)
+	}
+
+	// Losing the capability stops reporting.
+	pollWithPeerLatencyCap(t, srv, c, false)
+	c.ReportPeerLatency(1, 5*time.Millisecond)
+	if got := sentPeerLatencies(t, srv, c); got != nil {
+		t.Errorf("PeerLatencies after capability removed = %+v; want none", got)
+	}
+}
+
+func TestReportPeerLatencyRetried(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{ReportPeerLatency: true})
+	pollWithPeerLatencyCap(t, srv, c, true)
+	c.ReportPeerLatency(2, 10*time.Millisecond)
+
+	// Reopening the streaming poll doesn't send them.
+	pollWithPeerLatencyCap(t, srv, c, true)
+	if got := srv.lastRequest().PeerLatencies; got != nil {
+		t.Errorf("streaming MapRequest PeerLatencies = %+v; want none", got)
+	}
+
+	// A failed update keeps them for the next, along with newer samples.
+	srv.failNextMaps(http.StatusInternalServerError)
+	if err := c.SendUpdate(context.Background()); err == nil {
+		t.Fatal("SendUpdate succeeded; want error")
+	}
+	if got := srv.lastRequest().PeerLatencies; len(got) != 1 {
+		t.Errorf("failed MapRequest PeerLatencies = %+v; want peer 2", got)
+	}
+	c.ReportPeerLatency(2, 30*time.Millisecond)
+	want := []tailcfg.PeerLatency{
+		{NodeID: 2, Samples: 2, P50: 10 * time.Millisecond, P95: 10 * time.Millisecond},
+	}
+	if got := sentPeerLatencies(t, srv, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("PeerLatencies after failure = %+v; want %+v", got, want)
+	}
+	if got := sentPeerLatencies(t, srv, c); got != nil {
+		t.Errorf("PeerLatencies after upload = %+v; want none", got)
+	}
+}
+
+func TestReportPeerLatencyNotOptedIn(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{})
+	pollWithPeerLatencyCap(t, srv, c, true)
+	c.ReportPeerLatency(2, 10*time.Millisecond)
+	if got := sentPeerLatencies(t, srv, c); got != nil {
+		t.Errorf("PeerLatencies without opt-in = %+v; want none", got)
+	}
+}
+
+func TestReportPeerLatencyBounded(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{ReportPeerLatency: true})
+	pollWithPeerLatencyCap(t, srv, c, true)
+
+	// Peer 1 has more samples than are kept; only the most recent count.
+	for i := range maxLatencySamplesPerPeer + 10 {
+		c.ReportPeerLatency(1, time.Duration(i+1)*time.Millisecond)
+	}
+	// Peers beyond maxLatencyPeers are dropped.
+	for id := range tailcfg.NodeID(maxLatencyPeers + 50) {
+		c.ReportPeerLatency(id+2, time.Millisecond)
+	}
+	// Among the rest, peers with more samples are preferred.
+	c.ReportPeerLatency(200, time.Millisecond)
+
+	c.mu.Lock()
+	if n := len(c.peerLatency); n != maxLatencyPeers {
+		t.Errorf("tracking %d peers; want %d", n, maxLatencyPeers)
+	}
+	c.mu.Unlock()
+
+	got := sentPeerLatencies(t, srv, c)
+	if len(got) != maxLatencyReports {
+		t.Fatalf("got %d PeerLatencies; want %d", len(got), maxLatencyReports)
+	}
+	if got[0].NodeID != 1 || got[0].Samples != maxLatencySamplesPerPeer || got[0].P50 < 10*time.Millisecond {
+		t.Errorf("PeerLatencies[0] = %+v; want peer 1 with %d recent samples", got[0], maxLatencySamplesPerPeer)
+	}
+	var found200 bool
+	for i, pl := range got {
+		if i > 0 && pl.NodeID <= got[i-1].NodeID {
+			t.Errorf("PeerLatencies not sorted by NodeID at %d: %v after %v", i, pl.NodeID, got[i-1].NodeID)
+		}
+		if pl.NodeID == 200 {
+			found200 = pl.Samples == 2
+		}
+	}
+	if !found200 {
+		t.Error("peer with extra samples not preferred")
+	}
+}
@@ -7,6 +7,7 @@
 	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"maps"
 	"net"
@@ -24,6 +25,7 @@
 	"tailscale.com/envknob"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstime"
+	"tailscale.com/types/dnstype"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
@@ -45,15 +47,22 @@
 // one MapRequest).
 type mapSession struct {
 	// Immutable fields.
-	netmapUpdater  NetmapUpdater       // called on changes (in addition to the optional hooks below)
-	controlKnobs   *controlknobs.Knobs // or nil
-	privateNodeKey key.NodePrivate
-	publicNodeKey  key.NodePublic
-	logf           logger.Logf
-	vlogf          logger.Logf
-	machinePubKey  key.MachinePublic
-	altClock       tstime.Clock       // if nil, regular time is used
-	cancel         context.CancelFunc // always non-nil, shuts down caller's base long poll context
+	netmapUpdater       NetmapUpdater       // called on changes (in addition to the optional hooks below)
+	controlKnobs        *controlknobs.Knobs // or nil
+	privateNodeKey      key.NodePrivate
+	publicNodeKey       key.NodePublic
+	logf                logger.Logf
+	vlogf               logger.Logf
+	machinePubKey       key.MachinePublic
+	altClock            tstime.Clock        // if nil, regular time is used
+	quarantinePeers     bool                // whether to exclude peers that fail validatePeer
+	malformedPeerPolicy MalformedPeerPolicy // for peers failing checkRequiredPeerFields
+	validateDeltas      bool                // whether to reject deltas that fail validateDelta
+	cancel              context.CancelFunc  // always non-nil, shuts down caller's base long poll context
+
+	// peerFilter, if non-nil, reports whether to keep a full peer node from
+	// control. See filterPeers.
+	peerFilter func(*tailcfg.Node) bool
 
 	// sessionAliveCtx is a Background-based context that's alive for the
 	// duration of the mapSession that we own the lifetime of. It's closed by
@@ -72,6 +81,34 @@ type mapSession struct {
 	// changed.
 	onSelfNodeChanged func(*netmap.NetworkMap)
 
+	// onPeersUpdated is called after the session's peers are updated from a
+	// MapResponse. If full is true, the response contained the complete peer
+	// list and changed holds every peer. Otherwise changed holds the current
+	// state of each added or modified peer, and removed holds the IDs of
+	// peers that were removed.
+	onPeersUpdated func(full bool, changed []tailcfg.NodeView, removed []tailcfg.NodeID)
+
+	// onEmptyDERPMap is called when a full MapResponse contains an empty
+	// DERPMap, which is otherwise ignored.
+	onEmptyDERPMap func()
+
+	// onQuarantinedPeers is called with the peers of a MapResponse that
+	// failed validation, if quarantinePeers is set.
+	onQuarantinedPeers func([]QuarantinedPeer)
+
+	// onInvalidNode is called with each peer entry of a MapResponse that's
+	// skipped for having a zero or duplicate node ID, and why.
+	onInvalidNode func(tailcfg.NodeView, error)
+
+	// onPeerDelta, if non-nil, is called with how each MapResponse that
+	// touches peers changed them. It's nil by default, as computing the
+	// stats requires copying the affected peers.
+	onPeerDelta func(PeerDeltaStats)
+
+	// peerSortLess, if non-nil, orders the peers of each netmap instead of
+	// their node IDs. See Options.PeerSortLess.
+	peerSortLess func(a, b tailcfg.NodeView) bool
+
 	// Fields storing state over the course of multiple MapResponses.
 	lastPrintMap           time.Time
 	lastNode               tailcfg.NodeView
@@ -93,6 +130,15 @@ type mapSession struct {
 	lastTKAInfo            *tailcfg.TKAInfo
 	lastNetmapSummary      string // from NetworkMap.VeryConcise
 	lastMaxExpiry          time.Duration
+
+	// The paginated full peer list being assembled, if peersPageToken is
+	// non-empty. See addPeersPage.
+	peersPageToken string
+	pagedPeers     []*tailcfg.Node
+
+	// filteredPeers are the IDs of peers rejected by peerFilter that aren't
+	// in peers, so deltas referencing them can be ignored. See filterPeers.
+	filteredPeers set.Set[tailcfg.NodeID]
 }
 
 // newMapSession returns a mostly unconfigured new mapSession.
@@ -110,11 +156,15 @@ func newMapSession(privateNodeKey key.NodePrivate, nu NetmapUpdater, controlKnob
 		lastUserProfile: map[tailcfg.UserID]tailcfg.UserProfile{},
 
 		// Non-nil no-op defaults, to be optionally overridden by the caller.
-		logf:              logger.Discard,
-		vlogf:             logger.Discard,
-		cancel:            func() {},
-		onDebug:           func(context.Context, *tailcfg.Debug) error { return nil },
-		onSelfNodeChanged: func(*netmap.NetworkMap) {},
+		logf:               logger.Discard,
+		vlogf:              logger.Discard,
+		cancel:             func() {},
+		onDebug:            func(context.Context, *tailcfg.Debug) error { return nil },
+		onSelfNodeChanged:  func(*netmap.NetworkMap) {},
+		onPeersUpdated:     func(bool, []tailcfg.NodeView, []tailcfg.NodeID) {},
+		onEmptyDERPMap:     func() {},
+		onQuarantinedPeers: func([]QuarantinedPeer) {},
+		onInvalidNode:      func(tailcfg.NodeView, error) {},
 	}
 	ms.sessionAliveCtx, ms.sessionAliveCtxClose = context.WithCancel(context.Background())
 	return ms
@@ -166,6 +216,29 @@ func (ms *mapSession) HandleNonKeepAliveMapResponse(ctx context.Context, resp *t
 		}
 	}
 
+	if ms.malformedPeerPolicy == MalformedPeerReject {
+		if err := rejectMalformedPeers(resp); err != nil {
+			ms.logf("netmap: rejecting response: %v", err)
+			return err
+		}
+	}
+	if ms.quarantinePeers {
+		ms.quarantineInvalidPeers(resp)
+	}
+	// Quarantining may have handled some malformed peers already, reporting
+	// them; drop any others.
+	ms.dropMalformedPeers(resp)
+	if ms.peerFilter != nil {
+		ms.filterPeers(resp)
+	}
+	if ms.validateDeltas {
+		if err := ms.validateDelta(resp); err != nil {
+			metricRejectedDeltas.Add(1)
+			ms.logf("netmap: rejecting delta: %v", err)
+			return fmt.Errorf("%w: %v", errInvalidDelta, err)
+		}
+	}
+
 	// For responses that mutate the self node, check for updated nodeAttrs.
 	if resp.Node != nil {
 		if DevKnob.StripCaps() {
@@ -222,6 +295,11 @@ func (ms *mapSession) tryHandleIncrementally(res *tailcfg.MapResponse) bool {
 	if ms.controlKnobs != nil && ms.controlKnobs.DisableDeltaUpdates.Load() {
 		return false
 	}
+	if ms.peerSortLess != nil {
+		// Deltas are applied to a netmap's peers assuming node ID order
+		// (see netmap.NetworkMap.PeerIndexByNodeID).
+		return false
+	}
 	nud, ok := ms.netmapUpdater.(NetmapDeltaUpdater)
 	if !ok {
 		return false
@@ -243,9 +321,93 @@ type updateStats struct {
 	changed int
 }
 
+// PeerDeltaStats counts how a MapResponse changed the peers, once merged
+// with the previous ones. Peers the response mentions without actually
+// changing them (such as an OnlineChange to the current value) aren't
+// counted. See Options.OnPeerDelta.
+type PeerDeltaStats struct {
+	Added         int // peers not present before
+	Updated       int // peers present before that changed in any way
+	Removed       int // peers no longer present
+	OnlineChanged int // of Updated, those whose Online value changed
+	SeenChanged   int // of Updated, those whose LastSeen value changed
+}
+
+// touchedPeers returns the peers that resp may change, as they are before
+// it's applied, keyed by node ID. IDs of peers not yet present map to the
+// zero NodeView. For a full peer list, that's all current and new peers.
+func (ms *mapSession) touchedPeers(resp *tailcfg.MapResponse) map[tailcfg.NodeID]tailcfg.NodeView {
+	touched := make(map[tailcfg.NodeID]tailcfg.NodeView)
+	add := func(id tailcfg.NodeID) {
+		var v tailcfg.NodeView
+		if vp, ok := ms.peers[id]; ok {
+			v = *vp
+		}
+		touched[id] = v
+	}
+	if len(resp.Peers) > 0 {
+		for id := range ms.peers {
+			add(id)
+		}
+		for _, n := range resp.Peers {
+			add(n.ID)
+		}
+		return touched
+	}
+	for _, id := range resp.PeersRemoved {
+		add(id)
+	}
+	for _, n := range resp.PeersChanged {
+		add(n.ID)
+	}
+	for id := range resp.PeerSeenChange {
+		add(id)
+	}
+	for id := range resp.OnlineChange {
+		add(id)
+	}
+	for id := range resp.PeerCapabilityChange {
+		add(id)
+	}
+	for _, pc := range resp.PeersChangedPatch {
+		add(pc.NodeID)
+	}
+	return touched
+}
+
+// peerDeltaStats returns how ms.peers changed from before, as returned by
+// touchedPeers.
+func (ms *mapSession) peerDeltaStats(before map[tailcfg.NodeID]tailcfg.NodeView) (stats PeerDeltaStats) {
+	for id, old := range before {
+		var cur tailcfg.NodeView
+		if vp, ok := ms.peers[id]; ok {
+			cur = *vp
+		}
+		switch {
+		case !old.Valid() && !cur.Valid():
+			// Unknown peer, or one that was skipped.
+		case !old.Valid():
+			stats.Added++
+		case !cur.Valid():
+			stats.Removed++
+		case !old.Equal(cur):
+			stats.Updated++
+			if o, c := old.Online(), cur.Online(); (o == nil) != (c == nil) || (o != nil && *o != *c) {
+				stats.OnlineChanged++
+			}
+			if o, c := old.LastSeen(), cur.LastSeen(); (o == nil) != (c == nil) || (o != nil && !o.Equal(*c)) {
+				stats.SeenChanged++
+			}
+		}
+	}
+	return stats
+}
+
 // updateStateFromResponse updates ms from res. It takes ownership of res.
 func (ms *mapSession) updateStateFromResponse(resp *tailcfg.MapResponse) {
-	ms.updatePeersStateFromResponse(resp)
+	if stats := ms.updatePeersStateFromResponse(resp); stats.allNew || stats.added > 0 || stats.changed > 0 || stats.removed > 0 {
+		ms.notifyPeersUpdated(resp, stats.allNew)
+	}
 
 	if resp.Node != nil {
 		ms.lastNode = resp.Node.View()
@@ -265,6 +427,17 @@ func (ms *mapSession) updateStateFromResponse(resp *tailcfg.MapResponse) {
 	}
 	// TODO(bradfitz): clean up old user profiles? maybe not worth it.
 
+	if dm := resp.DERPMap; dm != nil && ms.isEmptyDERPMap(dm) {
+		// Using an empty DERP map would drop all our relays, which is
+		// never what control meant. Keep the previous one (if any) instead.
+		if resp.Peers != nil {
+			ms.logf("netmap: [unexpected] full map contains empty DERP map; ignoring")
+			ms.onEmptyDERPMap()
+		} else {
+			ms.vlogf("netmap: ignoring empty DERP map in delta")
+		}
+		resp.DERPMap = nil
+	}
 	if dm := resp.DERPMap; dm != nil {
 		ms.vlogf("netmap: new map contains DERP map")
 
@@ -326,6 +499,11 @@ func (ms *mapSession) updateStateFromResponse(resp *tailcfg.MapResponse) {
 			ms.logf("parsePacketFilter: %v", err)
 		}
 	}
+	if len(resp.DNSRoutesChanged) > 0 || len(resp.DNSRoutesRemoved) > 0 {
+		// Leave resp with the resulting full config, as if control had
+		// sent it, for the rest of the response handling.
+		resp.DNSConfig = undeltaDNS(cmp.Or(resp.DNSConfig, ms.lastDNSConfig), resp.DNSRoutesChanged, resp.DNSRoutesRemoved)
+	}
 	if c := resp.DNSConfig; c != nil {
 		ms.lastDNSConfig = c
 	}
@@ -353,6 +531,30 @@ func (ms *mapSession) updateStateFromResponse(resp *tailcfg.MapResponse) {
 	}
 }
 
+// undeltaDNS returns the result of applying a DNS routes delta (see
+// MapResponse.DNSRoutesChanged and DNSRoutesRemoved) to prev. Routes not
+// mentioned in the delta are left untouched. An empty delta returns prev
+// itself; otherwise prev isn't modified.
+func undeltaDNS(prev *tailcfg.DNSConfig, changed map[string][]*dnstype.Resolver, removed []string) *tailcfg.DNSConfig {
+	if len(changed) == 0 && len(removed) == 0 {
+		return prev
+	}
+	ret := prev.Clone()
+	if ret == nil {
+		ret = new(tailcfg.DNSConfig)
+	}
+	for suffix, resolvers := range changed {
+		mak.Set(&ret.Routes, suffix, resolvers)
+	}
+	for _, suffix := range removed {
+		delete(ret.Routes, suffix)
+	}
+	if len(ret.Routes) == 0 {
+		ret.Routes = nil
+	}
+	return ret
+}
+
 var (
 	patchDERPRegion   = clientmetric.NewCounter("controlclient_patch_derp")
 	patchEndpoints    = clientmetric.NewCounter("controlclient_patch_endpoints")
@@ -365,6 +567,12 @@ func (ms *mapSession) updateStateFromResponse(resp *tailcfg.MapResponse) {
 	patchCapMap       = clientmetric.NewCounter("controlclient_patch_capmap")
 	patchKeySignature = clientmetric.NewCounter("controlclient_patch_keysig")
 
+	metricQuarantinedPeers = clientmetric.NewCounter("controlclient_quarantined_peers")
+	metricRejectedDeltas   = clientmetric.NewCounter("controlclient_rejected_deltas")
+	metricMalformedPeers   = clientmetric.NewCounter("controlclient_malformed_peers")
+	metricAbortedPeerPages = clientmetric.NewCounter("controlclient_aborted_peer_pages")
+	metricInvalidNodes     = clientmetric.NewCounter("controlclient_invalid_nodes")
+
 	patchifiedPeer      = clientmetric.NewCounter("controlclient_patchified_peer")
 	patchifiedPeerEqual = clientmetric.NewCounter("controlclient_patchified_peer_equal")
 )
@@ -381,7 +589,17 @@ func (ms *mapSession) updatePeersStateFromResponse(resp *tailcfg.MapResponse) (s
 		ms.peers = make(map[tailcfg.NodeID]*tailcfg.NodeView)
 	}
 
-	if len(resp.Peers) > 0 {
+	if ms.onPeerDelta != nil {
+		if before := ms.touchedPeers(resp); len(before) > 0 {
+			defer func() { ms.onPeerDelta(ms.peerDeltaStats(before)) }()
+		}
+	}
+
+	full := len(resp.Peers) > 0
+	resp.Peers = ms.dropInvalidNodes(resp.Peers)
+	resp.PeersChanged = ms.dropInvalidNodes(resp.PeersChanged)
+
+	if full {
 		// Not delta encoded.
 		stats.allNew = true
 		keep := make(map[tailcfg.NodeID]bool, len(resp.Peers))
@@ -444,6 +662,19 @@ func (ms *mapSession) updatePeersStateFromResponse(resp *tailcfg.MapResponse) (s
 		}
 	}
 
+	for nodeID, caps := range resp.PeerCapabilityChange {
+		if vp, ok := ms.peers[nodeID]; ok {
+			mut := vp.AsStruct()
+			var cm tailcfg.NodeCapMap
+			for _, c := range caps {
+				mak.Set(&cm, c, mut.CapMap[c])
+			}
+			mut.CapMap = cm
+			*vp = mut.View()
+			stats.changed++
+		}
+	}
+
 	for _, pc := range resp.PeersChangedPatch {
 		vp, ok := ms.peers[pc.NodeID]
 		if !ok {
@@ -497,6 +728,344 @@ func (ms *mapSession) updatePeersStateFromResponse(resp *tailcfg.MapResponse) (s
 	return
 }
 
+// notifyPeersUpdated calls ms.onPeersUpdated with the peers touched by resp,
+// which must have already been applied to ms.peers.
+func (ms *mapSession) notifyPeersUpdated(resp *tailcfg.MapResponse, full bool) {
+	var changed []tailcfg.NodeView
+	if full {
+		changed = make([]tailcfg.NodeView, len(ms.sortedPeers))
+		for i, vp := range ms.sortedPeers {
+			changed[i] = *vp
+		}
+		ms.onPeersUpdated(true, changed, nil)
+		return
+	}
+	add := func(id tailcfg.NodeID) {
+		if vp, ok := ms.peers[id]; ok {
+			changed = append(changed, *vp)
+		}
+	}
+	for _, n := range resp.PeersChanged {
+		add(n.ID)
+	}
+	for _, pc := range resp.PeersChangedPatch {
+		add(pc.NodeID)
+	}
+	for id := range resp.PeerSeenChange {
+		add(id)
+	}
+	for id := range resp.OnlineChange {
+		add(id)
+	}
+	for id := range resp.PeerCapabilityChange {
+		add(id)
+	}
+	ms.onPeersUpdated(false, changed, resp.PeersRemoved)
+}
+
+// errInvalidDelta is returned by HandleNonKeepAliveMapResponse for a delta
+// MapResponse that fails validateDelta. Ending the map poll with it makes the
+// caller start a new one, which begins with a full netmap.
+var errInvalidDelta = errors.New("invalid delta MapResponse")
+
+// validateDelta returns an error if applying resp, a MapResponse that isn't a
+// full netmap, to the session's current state wouldn't result in a
+// self-consistent netmap: if there's no self node, or if resp refers to
+// peers that don't exist.
+func (ms *mapSession) validateDelta(resp *tailcfg.MapResponse) error {
+	if len(resp.Peers) > 0 {
+		return nil // a full netmap; nothing to check against
+	}
+	if !ms.lastNode.Valid() && resp.Node == nil {
+		return errors.New("no self node")
+	}
+	exists := func(id tailcfg.NodeID) bool {
+		if _, ok := ms.peers[id]; ok {
+			return true
+		}
+		return slices.ContainsFunc(resp.PeersChanged, func(n *tailcfg.Node) bool { return n.ID == id })
+	}
+	for _, id := range resp.PeersRemoved {
+		if _, ok := ms.peers[id]; !ok {
+			return fmt.Errorf("removal of unknown peer %v", id)
+		}
+	}
+	for _, pc := range resp.PeersChangedPatch {
+		if !exists(pc.NodeID) {
+			return fmt.Errorf("patch of unknown peer %v", pc.NodeID)
+		}
+	}
+	for id := range resp.OnlineChange {
+		if !exists(id) {
+			return fmt.Errorf("online change of unknown peer %v", id)
+		}
+	}
+	for id := range resp.PeerSeenChange {
+		if !exists(id) {
+			return fmt.Errorf("seen change of unknown peer %v", id)
+		}
+	}
+	for id := range resp.PeerCapabilityChange {
+		if !exists(id) {
+			return fmt.Errorf("capability change of unknown peer %v", id)
+		}
+	}
+	return nil
+}
+
+var (
+	errZeroNodeID      = errors.New("zero node ID")
+	errDuplicateNodeID = errors.New("duplicate node ID in MapResponse")
+)
+
+// dropInvalidNodes returns nodes, a peer list from a MapResponse, without the
+// entries that have a zero node ID, and with only the last of the entries for
+// each node ID. Dropped entries are reported to ms.onInvalidNode.
+func (ms *mapSession) dropInvalidNodes(nodes []*tailcfg.Node) []*tailcfg.Node {
+	var index map[tailcfg.NodeID]int // node ID to index in ret, if len(nodes) > 1
+	ret := nodes[:0]
+	for _, n := range nodes {
+		if n.ID == 0 {
+			ms.invalidNode(n, errZeroNodeID)
+			continue
+		}
+		if i, ok := index[n.ID]; ok {
+			ms.invalidNode(ret[i], errDuplicateNodeID)
+			ret[i] = n
+			continue
+		}
+		if len(nodes) > 1 {
+			mak.Set(&index, n.ID, len(ret))
+		}
+		ret = append(ret, n)
+	}
+	return ret
+}
+
+func (ms *mapSession) invalidNode(n *tailcfg.Node, err error) {
+	ms.logf("netmap: skipping peer %v (%q): %v", n.ID, n.Name, err)
+	metricInvalidNodes.Add(1)
+	ms.onInvalidNode(n.View(), err)
+}
+
+// QuarantinedPeer is a peer that was excluded from the netmap because it
+// failed validation. See Options.OnQuarantinedPeers.
+type QuarantinedPeer struct {
+	ID  tailcfg.NodeID
+	Err error // why the peer failed validation
+}
+
+// validatePeer returns an error if n, a full peer node from a MapResponse, is
+// malformed in a way that could break or confuse the rest of the client.
+func validatePeer(n *tailcfg.Node) error {
+	if n.ID == 0 {
+		return errors.New("missing node ID")
+	}
+	if n.Key.IsZero() {
+		return errors.New("missing node key")
+	}
+	for _, p := range n.Addresses {
+		if !p.IsValid() || !p.IsSingleIP() {
+			return fmt.Errorf("invalid address %v", p)
+		}
+	}
+	for _, p := range n.AllowedIPs {
+		if !p.IsValid() {
+			return fmt.Errorf("invalid allowed IP %v", p)
+		}
+	}
+	return nil
+}
+
+// quarantineInvalidPeers removes the peers in resp that fail validatePeer, so
+// the rest of the netmap is still usable, and reports them to
+// ms.onQuarantinedPeers. A changed peer that fails validation is removed from
+// the netmap.
+func (ms *mapSession) quarantineInvalidPeers(resp *tailcfg.MapResponse) {
+	bad := ms.removePeers(resp, validatePeer)
+	if len(bad) == 0 {
+		return
+	}
+	for _, q := range bad {
+		ms.logf("netmap: quarantining invalid peer %v: %v", q.ID, q.Err)
+	}
+	metricQuarantinedPeers.Add(int64(len(bad)))
+	ms.onQuarantinedPeers(bad)
+}
+
+// removePeers removes the full peer nodes in resp for which check returns an
+// error, returning them. A changed peer that's removed is also removed from
+// the netmap.
+func (ms *mapSession) removePeers(resp *tailcfg.MapResponse, check func(*tailcfg.Node) error) []QuarantinedPeer {
+	var bad []QuarantinedPeer
+	filter := func(nodes []*tailcfg.Node) []*tailcfg.Node {
+		ret := nodes[:0]
+		for _, n := range nodes {
+			if err := check(n); err != nil {
+				bad = append(bad, QuarantinedPeer{ID: n.ID, Err: err})
+				continue
+			}
+			ret = append(ret, n)
+		}
+		return ret
+	}
+	if len(resp.Peers) > 0 {
+		resp.Peers = filter(resp.Peers)
+		if len(resp.Peers) == 0 {
+			// Everything was removed. An empty Peers wouldn't be
+			// treated as a full map, so remove the old peers explicitly.
+			for id := range ms.peers {
+				resp.PeersRemoved = append(resp.PeersRemoved, id)
+			}
+		}
+	}
+	if len(resp.PeersChanged) > 0 {
+		resp.PeersChanged = filter(resp.PeersChanged)
+	}
+	for _, q := range bad {
+		if _, ok := ms.peers[q.ID]; ok && len(resp.Peers) == 0 && !slices.Contains(resp.PeersRemoved, q.ID) {
+			resp.PeersRemoved = append(resp.PeersRemoved, q.ID)
+		}
+	}
+	return bad
+}
+
+// MalformedPeerPolicy is how the client handles peers that arrive from control
+// without the fields needed to use them at all: a node key and addresses.
+type MalformedPeerPolicy int
+
+const (
+	// MalformedPeerDrop drops malformed peers from the netmap, logging them,
+	// and uses the rest of the MapResponse. It's the default.
+	MalformedPeerDrop MalformedPeerPolicy = iota
+
+	// MalformedPeerReject rejects a MapResponse containing any malformed
+	// peers, ending the map poll so that the next one starts over.
+	MalformedPeerReject
+)
+
+// errMalformedPeer is returned by HandleNonKeepAliveMapResponse for a
+// MapResponse with a malformed peer under MalformedPeerReject.
+var errMalformedPeer = errors.New("MapResponse has malformed peer")
+
+// checkRequiredPeerFields returns an error if n, a full peer node from a
+// MapResponse, lacks a node key or addresses, without which it's unusable.
+func checkRequiredPeerFields(n *tailcfg.Node) error {
+	if n.Key.IsZero() {
+		return errors.New("missing node key")
+	}
+	if len(n.Addresses) == 0 {
+		return errors.New("missing addresses")
+	}
+	return nil
+}
+
+// rejectMalformedPeers returns an error wrapping errMalformedPeer if any peer
+// in resp fails checkRequiredPeerFields.
+func rejectMalformedPeers(resp *tailcfg.MapResponse) error {
+	for _, n := range slices.Concat(resp.Peers, resp.PeersChanged) {
+		if err := checkRequiredPeerFields(n); err != nil {
+			metricMalformedPeers.Add(1)
+			return fmt.Errorf("%w %v: %v", errMalformedPeer, n.ID, err)
+		}
+	}
+	return nil
+}
+
+// dropMalformedPeers removes the peers in resp that fail
+// checkRequiredPeerFields, logging them.
+func (ms *mapSession) dropMalformedPeers(resp *tailcfg.MapResponse) {
+	bad := ms.removePeers(resp, checkRequiredPeerFields)
+	for _, q := range bad {
+		ms.logf("netmap: dropping malformed peer %v: %v", q.ID, q.Err)
+	}
+	metricMalformedPeers.Add(int64(len(bad)))
+}
+
+// errPeerFiltered is the reason recorded for peers rejected by
+// mapSession.peerFilter.
+var errPeerFiltered = errors.New("rejected by peer filter")
+
+// filterPeers removes the peers in resp rejected by ms.peerFilter, so they're
+// never stored. A changed peer that's now rejected is removed from the
+// netmap. Deltas for previously rejected peers are removed from resp, making
+// them no-ops rather than changes to unknown peers.
+func (ms *mapSession) filterPeers(resp *tailcfg.MapResponse) {
+	if len(resp.Peers) > 0 {
+		clear(ms.filteredPeers)
+	}
+	rejected := ms.removePeers(resp, func(n *tailcfg.Node) error {
+		if !ms.peerFilter(n) {
+			return errPeerFiltered
+		}
+		ms.filteredPeers.Delete(n.ID)
+		return nil
+	})
+	for _, q := range rejected {
+		mak.Set(&ms.filteredPeers, q.ID, struct{}{})
+	}
+	if len(ms.filteredPeers) == 0 {
+		return
+	}
+
+	// A peer rejected by this response may still be in ms.peers, in which
+	// case removePeers arranged for its removal and its deltas still apply.
+	filtered := func(id tailcfg.NodeID) bool {
+		_, known := ms.peers[id]
+		return !known && ms.filteredPeers.Contains(id)
+	}
+	resp.PeersChangedPatch = slices.DeleteFunc(resp.PeersChangedPatch, func(pc *tailcfg.PeerChange) bool {
+		return filtered(pc.NodeID)
+	})
+	for id := range resp.OnlineChange {
+		if filtered(id) {
+			delete(resp.OnlineChange, id)
+		}
+	}
+	for id := range resp.PeerSeenChange {
+		if filtered(id) {
+			delete(resp.PeerSeenChange, id)
+		}
+	}
+	for id := range resp.PeerCapabilityChange {
+		if filtered(id) {
+			delete(resp.PeerCapabilityChange, id)
+		}
+	}
+	// Removals go last, since they forget the peer.
+	resp.PeersRemoved = slices.DeleteFunc(resp.PeersRemoved, func(id tailcfg.NodeID) bool {
+		if filtered(id) {
+			ms.filteredPeers.Delete(id)
+			return true
+		}
+		return false
+	})
+}
+
+// isEmptyDERPMap reports whether dm, a DERPMap from a MapResponse, would leave
+// the session with no DERP regions. A nil Regions means no change, so it's
+// only empty if there's no previous DERPMap.
+func (ms *mapSession) isEmptyDERPMap(dm *tailcfg.DERPMap) bool {
+	if len(dm.Regions) > 0 {
+		return false
+	}
+	return dm.Regions != nil || ms.lastDERPMap == nil
+}
+
+// seedPeers sets the session's peers to nodes, as if control had sent them as
+// the full peer list of a previous MapResponse, so that deltas apply to them.
+// The session takes ownership of nodes.
+func (ms *mapSession) seedPeers(nodes []*tailcfg.Node) {
+	if len(nodes) == 0 {
+		return
+	}
+	ms.peers = make(map[tailcfg.NodeID]*tailcfg.NodeView, len(nodes))
+	for _, n := range nodes {
+		ms.peers[n.ID] = ptr.To(n.View())
+	}
+	ms.rebuildSorted()
+}
+
 // rebuildSorted rebuilds ms.sortedPeers from ms.peers. It should be called
 // after any additions or removals from peers.
 func (ms *mapSession) rebuildSorted() {
@@ -760,6 +1329,14 @@ func peerChangeDiff(was tailcfg.NodeView, n *tailcfg.Node) (_ *tailcfg.PeerChang
 			if va == nil || vb == nil || *va != *vb {
 				return nil, false
 			}
+		case "PreferredEndpoint":
+			va, vb := was.PreferredEndpoint(), n.PreferredEndpoint
+			if va == nil && vb == nil {
+				continue
+			}
+			if va == nil || vb == nil || *va != *vb {
+				return nil, false
+			}
 		case "ExitNodeDNSResolvers":
 			va, vb := was.ExitNodeDNSResolvers(), views.SliceOfViews(n.ExitNodeDNSResolvers)
 
@@ -789,6 +1366,9 @@ func (ms *mapSession) netmap() *netmap.NetworkMap {
 	for i, vp := range ms.sortedPeers {
 		peerViews[i] = *vp
 	}
+	if ms.peerSortLess != nil {
+		sortPeersStable(peerViews, ms.peerSortLess)
+	}
 
 	nm := &netmap.NetworkMap{
 		NodeKey:           ms.publicNodeKey,
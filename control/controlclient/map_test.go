@@ -4,11 +4,14 @@
 package controlclient
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/netip"
 	"reflect"
+	"slices"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -55,6 +58,11 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 			n.DERP = d
 		}
 	}
+	withCaps := func(cm tailcfg.NodeCapMap) func(*tailcfg.Node) {
+		return func(n *tailcfg.Node) {
+			n.CapMap = cm
+		}
+	}
 	withEP := func(ep string) func(*tailcfg.Node) {
 		return func(n *tailcfg.Node) {
 			n.Endpoints = []netip.AddrPort{netip.MustParseAddrPort(ep)}
@@ -75,6 +83,11 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 		prev      []*tailcfg.Node
 		want      []*tailcfg.Node
 		wantStats updateStats
+		wantDelta PeerDeltaStats
+
+		// wantInvalid are the names of the nodes reported to
+		// onInvalidNode, if any.
+		wantInvalid []string
 	}{
 		{
 			name: "full_peers",
@@ -86,6 +99,7 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 				allNew: true,
 				added:  2,
 			},
+			wantDelta: PeerDeltaStats{Added: 2},
 		},
 		{
 			name: "full_peers_ignores_deltas",
@@ -98,18 +112,71 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 				allNew: true,
 				added:  2,
 			},
+			wantDelta: PeerDeltaStats{Added: 2},
 		},
 		{
 			name: "add_and_update",
 			prev: peers(n(1, "foo"), n(2, "bar")),
 			mapRes: &tailcfg.MapResponse{
-				PeersChanged: peers(n(0, "zero"), n(2, "bar2"), n(3, "three")),
+				PeersChanged: peers(n(2, "bar2"), n(3, "three")),
+			},
+			want: peers(n(1, "foo"), n(2, "bar2"), n(3, "three")),
+			wantStats: updateStats{
+				added:   1, // added ID 3
+				changed: 1, // changed ID 2
+			},
+			wantDelta: PeerDeltaStats{Added: 1, Updated: 1},
+		},
+		{
+			name: "changed_zero_id",
+			prev: peers(n(1, "foo")),
+			mapRes: &tailcfg.MapResponse{
+				PeersChanged: peers(n(0, "zero"), n(3, "three")),
+			},
+			want:        peers(n(1, "foo"), n(3, "three")),
+			wantStats:   updateStats{added: 1},
+			wantDelta:   PeerDeltaStats{Added: 1},
+			wantInvalid: []string{"zero"},
+		},
+		{
+			name: "full_zero_id",
+			prev: peers(n(1, "foo")),
+			mapRes: &tailcfg.MapResponse{
+				Peers: peers(n(0, "zero")),
+			},
+			want:        []*tailcfg.Node{},
+			wantStats:   updateStats{allNew: true, removed: 1},
+			wantDelta:   PeerDeltaStats{Removed: 1},
+			wantInvalid: []string{"zero"},
+		},
+		{
+			name: "changed_duplicate_id",
+			prev: peers(n(1, "foo"), n(2, "bar")),
+			mapRes: &tailcfg.MapResponse{
+				PeersChanged: peers(n(2, "bar2"), n(3, "three"), n(2, "bar3"), n(3, "three2"), n(2, "bar4")),
 			},
-			want: peers(n(0, "zero"), n(1, "foo"), n(2, "bar2"), n(3, "three")),
+			want: peers(n(1, "foo"), n(2, "bar4"), n(3, "three2")),
 			wantStats: updateStats{
-				added:   2, // added IDs 0 and 3
+				added:   1, // added ID 3
 				changed: 1, // changed ID 2
 			},
+			wantDelta:   PeerDeltaStats{Added: 1, Updated: 1},
+			wantInvalid: []string{"bar2", "three", "bar3"},
+		},
+		{
+			name: "full_duplicate_id",
+			prev: peers(n(1, "foo")),
+			mapRes: &tailcfg.MapResponse{
+				Peers: peers(n(1, "foo2"), n(2, "bar"), n(1, "foo3")),
+			},
+			want: peers(n(1, "foo3"), n(2, "bar")),
+			wantStats: updateStats{
+				allNew:  true,
+				added:   1,
+				changed: 1,
+			},
+			wantDelta:   PeerDeltaStats{Added: 1, Updated: 1},
+			wantInvalid: []string{"foo2"},
 		},
 		{
 			name: "remove",
@@ -121,6 +188,7 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 			wantStats: updateStats{
 				removed: 1, // ID 1
 			},
+			wantDelta: PeerDeltaStats{Removed: 1},
 		},
 		{
 			name: "add_and_remove",
@@ -134,6 +202,7 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 				changed: 1,
 				removed: 1,
 			},
+			wantDelta: PeerDeltaStats{Updated: 1, Removed: 1},
 		},
 		{
 			name:   "unchanged",
@@ -155,6 +224,35 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 				n(2, "bar"),
 			),
 			wantStats: updateStats{changed: 1},
+			wantDelta: PeerDeltaStats{Updated: 1, OnlineChanged: 1},
+		},
+		{
+			name: "full_peers_unchanged",
+			prev: peers(n(1, "foo"), n(2, "bar")),
+			mapRes: &tailcfg.MapResponse{
+				Peers: peers(n(1, "foo"), n(2, "bar")),
+			},
+			want: peers(n(1, "foo"), n(2, "bar")),
+			wantStats: updateStats{
+				allNew:  true,
+				changed: 2,
+			},
+		},
+		{
+			name: "online_change_same_value",
+			prev: peers(n(1, "foo", online(true)), n(2, "bar")),
+			mapRes: &tailcfg.MapResponse{
+				OnlineChange: map[tailcfg.NodeID]bool{
+					1: true,
+					2: true,
+				},
+			},
+			want: peers(
+				n(1, "foo", online(true)),
+				n(2, "bar", online(true)),
+			),
+			wantStats: updateStats{changed: 2},
+			wantDelta: PeerDeltaStats{Updated: 1, OnlineChanged: 1},
 		},
 		{
 			name: "online_change_offline",
@@ -170,6 +268,79 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 				n(2, "bar", online(true)),
 			),
 			wantStats: updateStats{changed: 2},
+			wantDelta: PeerDeltaStats{Updated: 2, OnlineChanged: 2},
+		},
+		{
+			name: "capability_change",
+			prev: peers(n(1, "foo"), n(2, "bar", withCaps(tailcfg.NodeCapMap{"cap-b": {}}))),
+			mapRes: &tailcfg.MapResponse{
+				PeerCapabilityChange: map[tailcfg.NodeID][]tailcfg.NodeCapability{
+					1:   {"cap-a"},
+					404: {"cap-a"},
+				},
+			},
+			want: peers(
+				n(1, "foo", withCaps(tailcfg.NodeCapMap{"cap-a": {}})),
+				n(2, "bar", withCaps(tailcfg.NodeCapMap{"cap-b": {}})),
+			),
+			wantStats: updateStats{changed: 1},
+			wantDelta: PeerDeltaStats{Updated: 1},
+		},
+		{
+			name: "capability_change_keeps_values",
+			prev: peers(n(1, "foo", withCaps(tailcfg.NodeCapMap{
+				"cap-a": {`{"x":1}`},
+				"cap-b": {},
+			}))),
+			mapRes: &tailcfg.MapResponse{
+				PeerCapabilityChange: map[tailcfg.NodeID][]tailcfg.NodeCapability{
+					1: {"cap-a", "cap-c"},
+				},
+			},
+			want: peers(n(1, "foo", withCaps(tailcfg.NodeCapMap{
+				"cap-a": {`{"x":1}`},
+				"cap-c": {},
+			}))),
+			wantStats: updateStats{changed: 1},
+			wantDelta: PeerDeltaStats{Updated: 1},
+		},
+		{
+			name: "capability_change_clear",
+			prev: peers(n(1, "foo", withCaps(tailcfg.NodeCapMap{"cap-a": {}}))),
+			mapRes: &tailcfg.MapResponse{
+				PeerCapabilityChange: map[tailcfg.NodeID][]tailcfg.NodeCapability{
+					1: nil,
+				},
+			},
+			want:      peers(n(1, "foo")),
+			wantStats: updateStats{changed: 1},
+			wantDelta: PeerDeltaStats{Updated: 1},
+		},
+		{
+			name: "capability_change_of_removed_peer",
+			prev: peers(n(1, "foo"), n(2, "bar")),
+			mapRes: &tailcfg.MapResponse{
+				PeersRemoved: []tailcfg.NodeID{2},
+				PeerCapabilityChange: map[tailcfg.NodeID][]tailcfg.NodeCapability{
+					2: {"cap-a"},
+				},
+			},
+			want:      peers(n(1, "foo")),
+			wantStats: updateStats{removed: 1},
+			wantDelta: PeerDeltaStats{Removed: 1},
+		},
+		{
+			name: "capability_change_after_peers_changed",
+			prev: peers(n(1, "foo")),
+			mapRes: &tailcfg.MapResponse{
+				PeersChanged: peers(n(1, "foo2", withCaps(tailcfg.NodeCapMap{"cap-b": {}}))),
+				PeerCapabilityChange: map[tailcfg.NodeID][]tailcfg.NodeCapability{
+					1: {"cap-a"},
+				},
+			},
+			want:      peers(n(1, "foo2", withCaps(tailcfg.NodeCapMap{"cap-a": {}}))),
+			wantStats: updateStats{changed: 2},
+			wantDelta: PeerDeltaStats{Updated: 1},
 		},
 		{
 			name:    "peer_seen_at",
@@ -186,6 +357,7 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 				n(2, "bar", seenAt(time.Unix(123, 0))),
 			),
 			wantStats: updateStats{changed: 2},
+			wantDelta: PeerDeltaStats{Updated: 2, SeenChanged: 2},
 		},
 		{
 			name: "ep_change_derp",
@@ -198,6 +370,7 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 			},
 			want:      peers(n(1, "foo", withDERP("127.3.3.40:4"))),
 			wantStats: updateStats{changed: 1},
+			wantDelta: PeerDeltaStats{Updated: 1},
 		},
 		{
 			name: "ep_change_udp",
@@ -210,6 +383,7 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 			},
 			want:      peers(n(1, "foo", withEP("1.2.3.4:56"))),
 			wantStats: updateStats{changed: 1},
+			wantDelta: PeerDeltaStats{Updated: 1},
 		},
 		{
 			name: "ep_change_udp_2",
@@ -222,6 +396,7 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 			},
 			want:      peers(n(1, "foo", withDERP("127.3.3.40:3"), withEP("1.2.3.4:56"))),
 			wantStats: updateStats{changed: 1},
+			wantDelta: PeerDeltaStats{Updated: 1},
 		},
 		{
 			name: "ep_change_both",
@@ -235,6 +410,7 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 			},
 			want:      peers(n(1, "foo", withDERP("127.3.3.40:2"), withEP("1.2.3.4:56"))),
 			wantStats: updateStats{changed: 1},
+			wantDelta: PeerDeltaStats{Updated: 1},
 		},
 		{
 			name: "change_key",
@@ -250,6 +426,7 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 				Key:  key.NodePublicFromRaw32(mem.B(append(make([]byte, 31), 'A'))),
 			}),
 			wantStats: updateStats{changed: 1},
+			wantDelta: PeerDeltaStats{Updated: 1},
 		},
 		{
 			name: "change_key_signature",
@@ -266,6 +443,7 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 				KeySignature: []byte{3, 4},
 			}),
 			wantStats: updateStats{changed: 1},
+			wantDelta: PeerDeltaStats{Updated: 1},
 		},
 		{
 			name: "change_disco_key",
@@ -282,6 +460,7 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 				DiscoKey: key.DiscoPublicFromRaw32(mem.B(append(make([]byte, 31), 'A'))),
 			}),
 			wantStats: updateStats{changed: 1},
+			wantDelta: PeerDeltaStats{Updated: 1},
 		},
 		{
 			name: "change_online",
@@ -298,6 +477,7 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 				Online: ptr.To(true),
 			}),
 			wantStats: updateStats{changed: 1},
+			wantDelta: PeerDeltaStats{Updated: 1, OnlineChanged: 1},
 		},
 		{
 			name: "change_last_seen",
@@ -314,6 +494,7 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 				LastSeen: ptr.To(time.Unix(123, 0).UTC()),
 			}),
 			wantStats: updateStats{changed: 1},
+			wantDelta: PeerDeltaStats{Updated: 1, SeenChanged: 1},
 		},
 		{
 			name: "change_key_expiry",
@@ -330,6 +511,7 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 				KeyExpiry: time.Unix(123, 0).UTC(),
 			}),
 			wantStats: updateStats{changed: 1},
+			wantDelta: PeerDeltaStats{Updated: 1},
 		},
 	}
 	for _, tt := range tests {
@@ -343,6 +525,15 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 				mak.Set(&ms.peers, n.ID, ptr.To(n.View()))
 			}
 			ms.rebuildSorted()
+			var gotDelta PeerDeltaStats
+			ms.onPeerDelta = func(stats PeerDeltaStats) { gotDelta = stats }
+			var gotInvalid []string
+			ms.onInvalidNode = func(n tailcfg.NodeView, err error) {
+				if !errors.Is(err, errZeroNodeID) && !errors.Is(err, errDuplicateNodeID) {
+					t.Errorf("onInvalidNode(%v) with unexpected error %v", n.Name(), err)
+				}
+				gotInvalid = append(gotInvalid, n.Name())
+			}
 
 			gotStats := ms.updatePeersStateFromResponse(tt.mapRes)
 
@@ -353,9 +544,15 @@ func TestUpdatePeersStateFromResponse(t *testing.T) {
 			if gotStats != tt.wantStats {
 				t.Errorf("got stats = %+v; want %+v", gotStats, tt.wantStats)
 			}
+			if gotDelta != tt.wantDelta {
+				t.Errorf("got delta = %+v; want %+v", gotDelta, tt.wantDelta)
+			}
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("wrong results\n got: %s\nwant: %s", formatNodes(got), formatNodes(tt.want))
 			}
+			if !reflect.DeepEqual(gotInvalid, tt.wantInvalid) {
+				t.Errorf("invalid nodes = %q; want %q", gotInvalid, tt.wantInvalid)
+			}
 		})
 	}
 }
@@ -730,6 +927,531 @@ type step struct {
 	}
 }
 
+func TestUndeltaDNS(t *testing.T) {
+	res := func(addrs ...string) (ret []*dnstype.Resolver) {
+		for _, a := range addrs {
+			ret = append(ret, &dnstype.Resolver{Addr: a})
+		}
+		return ret
+	}
+	prev := &tailcfg.DNSConfig{
+		Resolvers: res("1.1.1.1"),
+		Routes: map[string][]*dnstype.Resolver{
+			"corp.example.":  res("10.0.0.1"),
+			"infra.example.": res("10.0.0.2", "10.0.0.3"),
+			"records.ts.net": {},
+		},
+		Domains: []string{"example.ts.net"},
+	}
+	prevJSON := must.Get(json.Marshal(prev))
+
+	tests := []struct {
+		name    string
+		changed map[string][]*dnstype.Resolver
+		removed []string
+		want    map[string][]*dnstype.Resolver
+	}{
+		{
+			name: "no-op",
+			want: prev.Routes,
+		},
+		{
+			name:    "empty-non-nil",
+			changed: map[string][]*dnstype.Resolver{},
+			removed: []string{},
+			want:    prev.Routes,
+		},
+		{
+			name:    "add",
+			changed: map[string][]*dnstype.Resolver{"new.example.": res("10.0.0.9")},
+			want: map[string][]*dnstype.Resolver{
+				"corp.example.":  res("10.0.0.1"),
+				"infra.example.": res("10.0.0.2", "10.0.0.3"),
+				"records.ts.net": {},
+				"new.example.":   res("10.0.0.9"),
+			},
+		},
+		{
+			name:    "update",
+			changed: map[string][]*dnstype.Resolver{"infra.example.": res("10.0.0.4")},
+			want: map[string][]*dnstype.Resolver{
+				"corp.example.":  res("10.0.0.1"),
+				"infra.example.": res("10.0.0.4"),
+				"records.ts.net": {},
+			},
+		},
+		{
+			name:    "remove",
+			removed: []string{"corp.example.", "unknown.example."},
+			want: map[string][]*dnstype.Resolver{
+				"infra.example.": res("10.0.0.2", "10.0.0.3"),
+				"records.ts.net": {},
+			},
+		},
+		{
+			name:    "remove-all",
+			removed: []string{"corp.example.", "infra.example.", "records.ts.net"},
+			want:    nil,
+		},
+		{
+			name:    "change-then-remove",
+			changed: map[string][]*dnstype.Resolver{"corp.example.": res("10.0.0.5")},
+			removed: []string{"corp.example."},
+			want: map[string][]*dnstype.Resolver{
+				"infra.example.": res("10.0.0.2", "10.0.0.3"),
+				"records.ts.net": {},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := undeltaDNS(prev, tt.changed, tt.removed)
+			if !reflect.DeepEqual(got.Routes, tt.want) {
+				t.Errorf("Routes = %s; want %s", logger.AsJSON(got.Routes), logger.AsJSON(tt.want))
+			}
+			if !reflect.DeepEqual(got.Resolvers, prev.Resolvers) || !reflect.DeepEqual(got.Domains, prev.Domains) {
+				t.Errorf("non-route fields changed: %s", logger.AsJSON(got))
+			}
+			if len(tt.changed) == 0 && len(tt.removed) == 0 && got != prev {
+				t.Error("empty delta didn't return prev")
+			}
+			if gotPrev := must.Get(json.Marshal(prev)); !bytes.Equal(gotPrev, prevJSON) {
+				t.Errorf("prev modified: %s", gotPrev)
+			}
+		})
+	}
+}
+
+func TestDeltaDNSRoutes(t *testing.T) {
+	ms := newTestMapSession(t, nil)
+	r := func(addr string) []*dnstype.Resolver { return []*dnstype.Resolver{{Addr: addr}} }
+
+	ms.netmapForResponse(&tailcfg.MapResponse{DNSConfig: &tailcfg.DNSConfig{
+		Domains: []string{"example.ts.net"},
+		Routes:  map[string][]*dnstype.Resolver{"a.example.": r("10.0.0.1"), "b.example.": r("10.0.0.2")},
+	}})
+	resp := &tailcfg.MapResponse{
+		DNSRoutesChanged: map[string][]*dnstype.Resolver{"c.example.": r("10.0.0.3")},
+		DNSRoutesRemoved: []string{"a.example."},
+	}
+	nm := ms.netmapForResponse(resp)
+	want := &tailcfg.DNSConfig{
+		Domains: []string{"example.ts.net"},
+		Routes:  map[string][]*dnstype.Resolver{"b.example.": r("10.0.0.2"), "c.example.": r("10.0.0.3")},
+	}
+	if !reflect.DeepEqual(&nm.DNS, want) {
+		t.Errorf("netmap DNS = %s; want %s", logger.AsJSON(nm.DNS), logger.AsJSON(want))
+	}
+	if !reflect.DeepEqual(resp.DNSConfig, want) {
+		t.Errorf("resp.DNSConfig = %s; want the full merged config", logger.AsJSON(resp.DNSConfig))
+	}
+}
+
+func TestEmptyDERPMap(t *testing.T) {
+	regions := map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, Nodes: []*tailcfg.DERPNode{{Name: "derp1a", RegionID: 1}}},
+	}
+	peers := []*tailcfg.Node{{ID: 2, Key: key.NewNode().Public(), Addresses: testPeerAddresses(2)}}
+
+	tests := []struct {
+		name      string
+		first     *tailcfg.DERPMap // if non-nil, sent in a full map first
+		resp      *tailcfg.MapResponse
+		want      *tailcfg.DERPMap
+		wantCalls int
+	}{
+		{
+			name:  "empty-in-delta",
+			first: &tailcfg.DERPMap{Regions: regions},
+			resp:  &tailcfg.MapResponse{DERPMap: &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{}}},
+			want:  &tailcfg.DERPMap{Regions: regions},
+		},
+		{
+			name:      "empty-in-full",
+			first:     &tailcfg.DERPMap{Regions: regions},
+			resp:      &tailcfg.MapResponse{Peers: peers, DERPMap: &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{}}},
+			want:      &tailcfg.DERPMap{Regions: regions},
+			wantCalls: 1,
+		},
+		{
+			name:      "empty-in-first-full",
+			resp:      &tailcfg.MapResponse{Peers: peers, DERPMap: &tailcfg.DERPMap{}},
+			want:      nil,
+			wantCalls: 1,
+		},
+		{
+			name:  "unchanged-regions-in-full",
+			first: &tailcfg.DERPMap{Regions: regions},
+			resp:  &tailcfg.MapResponse{Peers: peers, DERPMap: &tailcfg.DERPMap{}},
+			want:  &tailcfg.DERPMap{Regions: regions},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := newTestMapSession(t, nil)
+			var calls int
+			ms.onEmptyDERPMap = func() { calls++ }
+			if tt.first != nil {
+				ms.netmapForResponse(&tailcfg.MapResponse{Peers: peers, DERPMap: tt.first})
+			}
+			nm := ms.netmapForResponse(tt.resp)
+			if !reflect.DeepEqual(nm.DERPMap, tt.want) {
+				t.Errorf("DERPMap = %s; want %s", logger.AsJSON(nm.DERPMap), logger.AsJSON(tt.want))
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("onEmptyDERPMap called %d times; want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestQuarantinePeers(t *testing.T) {
+	good := func(id tailcfg.NodeID) *tailcfg.Node {
+		return &tailcfg.Node{
+			ID:        id,
+			Key:       key.NewNode().Public(),
+			Addresses: []netip.Prefix{netip.PrefixFrom(netip.AddrFrom4([4]byte{100, 64, 0, byte(id)}), 32)},
+		}
+	}
+	badAddr := good(3)
+	badAddr.Addresses = []netip.Prefix{netip.MustParsePrefix("100.64.0.0/24")}
+
+	var nu recordingNetmapUpdater
+	ms := newTestMapSession(t, &nu)
+	ms.quarantinePeers = true
+	var quarantined []tailcfg.NodeID
+	ms.onQuarantinedPeers = func(qs []QuarantinedPeer) {
+		for _, q := range qs {
+			if q.Err == nil {
+				t.Errorf("quarantined peer %v has nil Err", q.ID)
+			}
+			quarantined = append(quarantined, q.ID)
+		}
+	}
+	handle := func(resp *tailcfg.MapResponse) {
+		t.Helper()
+		if err := ms.HandleNonKeepAliveMapResponse(context.Background(), resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantPeers := func(want ...tailcfg.NodeID) {
+		t.Helper()
+		nm := nu.nms[len(nu.nms)-1]
+		var got []tailcfg.NodeID
+		for _, p := range nm.Peers {
+			got = append(got, p.ID())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("netmap peers = %v; want %v", got, want)
+		}
+	}
+	wantQuarantined := func(want ...tailcfg.NodeID) {
+		t.Helper()
+		if !reflect.DeepEqual(quarantined, want) {
+			t.Errorf("quarantined = %v; want %v", quarantined, want)
+		}
+		quarantined = nil
+	}
+
+	// One bad peer in a full map is excluded; the others remain.
+	handle(&tailcfg.MapResponse{
+		Node:  good(100),
+		Peers: []*tailcfg.Node{good(1), good(2), badAddr, {ID: 4}},
+	})
+	wantPeers(1, 2)
+	wantQuarantined(3, 4)
+
+	// A changed peer that becomes invalid is removed from the netmap.
+	badKey := good(2)
+	badKey.Key = key.NodePublic{}
+	handle(&tailcfg.MapResponse{
+		PeersChanged: []*tailcfg.Node{badKey, good(5)},
+	})
+	wantPeers(1, 5)
+	wantQuarantined(2)
+
+	// A full map of only bad peers leaves no peers.
+	handle(&tailcfg.MapResponse{
+		Peers: []*tailcfg.Node{badAddr},
+	})
+	wantPeers()
+	wantQuarantined(3)
+}
+
+func TestMalformedPeers(t *testing.T) {
+	good := func(id tailcfg.NodeID) *tailcfg.Node {
+		return &tailcfg.Node{ID: id, Key: key.NewNode().Public(), Addresses: testPeerAddresses(id)}
+	}
+	noKey := func(id tailcfg.NodeID) *tailcfg.Node {
+		n := good(id)
+		n.Key = key.NodePublic{}
+		return n
+	}
+	noAddrs := func(id tailcfg.NodeID) *tailcfg.Node {
+		n := good(id)
+		n.Addresses = nil
+		return n
+	}
+	tests := []struct {
+		name      string
+		policy    MalformedPeerPolicy
+		resp      *tailcfg.MapResponse // applied after a full map with peers 2 and 3
+		wantErr   bool
+		wantPeers []tailcfg.NodeID
+	}{
+		{
+			name:      "drop_full_no_key",
+			policy:    MalformedPeerDrop,
+			resp:      &tailcfg.MapResponse{Peers: []*tailcfg.Node{good(2), noKey(4)}},
+			wantPeers: []tailcfg.NodeID{2},
+		},
+		{
+			name:      "drop_full_no_addrs",
+			policy:    MalformedPeerDrop,
+			resp:      &tailcfg.MapResponse{Peers: []*tailcfg.Node{noAddrs(2), good(4)}},
+			wantPeers: []tailcfg.NodeID{4},
+		},
+		{
+			name:      "drop_full_all_bad",
+			policy:    MalformedPeerDrop,
+			resp:      &tailcfg.MapResponse{Peers: []*tailcfg.Node{noAddrs(2), noKey(4)}},
+			wantPeers: nil,
+		},
+		{
+			name:      "drop_changed_no_key",
+			policy:    MalformedPeerDrop,
+			resp:      &tailcfg.MapResponse{PeersChanged: []*tailcfg.Node{noKey(3), good(4)}},
+			wantPeers: []tailcfg.NodeID{2, 4},
+		},
+		{
+			name:      "drop_changed_no_addrs",
+			policy:    MalformedPeerDrop,
+			resp:      &tailcfg.MapResponse{PeersChanged: []*tailcfg.Node{noAddrs(5)}},
+			wantPeers: []tailcfg.NodeID{2, 3},
+		},
+		{
+			name:    "reject_full_no_key",
+			policy:  MalformedPeerReject,
+			resp:    &tailcfg.MapResponse{Peers: []*tailcfg.Node{good(2), noKey(4)}},
+			wantErr: true,
+		},
+		{
+			name:    "reject_changed_no_addrs",
+			policy:  MalformedPeerReject,
+			resp:    &tailcfg.MapResponse{PeersChanged: []*tailcfg.Node{noAddrs(4)}},
+			wantErr: true,
+		},
+		{
+			name:      "reject_all_good",
+			policy:    MalformedPeerReject,
+			resp:      &tailcfg.MapResponse{PeersChanged: []*tailcfg.Node{good(4)}},
+			wantPeers: []tailcfg.NodeID{2, 3, 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var nu recordingNetmapUpdater
+			ms := newTestMapSession(t, &nu)
+			ms.malformedPeerPolicy = tt.policy
+			ctx := context.Background()
+			if err := ms.HandleNonKeepAliveMapResponse(ctx, &tailcfg.MapResponse{
+				Node:  &tailcfg.Node{ID: 1},
+				Peers: []*tailcfg.Node{good(2), good(3)},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			err := ms.HandleNonKeepAliveMapResponse(ctx, tt.resp)
+			if tt.wantErr {
+				if !errors.Is(err, errMalformedPeer) {
+					t.Fatalf("got error %v; want errMalformedPeer", err)
+				}
+				if len(nu.nms) != 1 {
+					t.Errorf("rejected response produced a netmap")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []tailcfg.NodeID
+			for _, p := range nu.nms[len(nu.nms)-1].Peers {
+				got = append(got, p.ID())
+			}
+			if !reflect.DeepEqual(got, tt.wantPeers) {
+				t.Errorf("netmap peers = %v; want %v", got, tt.wantPeers)
+			}
+		})
+	}
+}
+
+func TestValidateDeltas(t *testing.T) {
+	peer := func(id tailcfg.NodeID) *tailcfg.Node {
+		return &tailcfg.Node{ID: id, Key: key.NewNode().Public(), Addresses: testPeerAddresses(id)}
+	}
+	tests := []struct {
+		name    string
+		delta   *tailcfg.MapResponse
+		wantErr bool
+	}{
+		{
+			name:  "valid",
+			delta: &tailcfg.MapResponse{OnlineChange: map[tailcfg.NodeID]bool{2: true}},
+		},
+		{
+			name: "patch_of_peer_added_in_same_delta",
+			delta: &tailcfg.MapResponse{
+				PeersChanged:      []*tailcfg.Node{peer(3)},
+				PeersChangedPatch: []*tailcfg.PeerChange{{NodeID: 3, DERPRegion: 1}},
+			},
+		},
+		{
+			name:    "patch_of_unknown_peer",
+			delta:   &tailcfg.MapResponse{PeersChangedPatch: []*tailcfg.PeerChange{{NodeID: 9, DERPRegion: 1}}},
+			wantErr: true,
+		},
+		{
+			name:    "removal_of_unknown_peer",
+			delta:   &tailcfg.MapResponse{PeersRemoved: []tailcfg.NodeID{9}},
+			wantErr: true,
+		},
+		{
+			name:    "online_change_of_unknown_peer",
+			delta:   &tailcfg.MapResponse{OnlineChange: map[tailcfg.NodeID]bool{9: true}},
+			wantErr: true,
+		},
+		{
+			name:    "seen_change_of_unknown_peer",
+			delta:   &tailcfg.MapResponse{PeerSeenChange: map[tailcfg.NodeID]bool{9: true}},
+			wantErr: true,
+		},
+		{
+			name:    "capability_change_of_unknown_peer",
+			delta:   &tailcfg.MapResponse{PeerCapabilityChange: map[tailcfg.NodeID][]tailcfg.NodeCapability{9: {"cap-a"}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var nu recordingNetmapUpdater
+			ms := newTestMapSession(t, &nu)
+			ms.validateDeltas = true
+			ctx := context.Background()
+			if err := ms.HandleNonKeepAliveMapResponse(ctx, &tailcfg.MapResponse{
+				Node:  &tailcfg.Node{ID: 1},
+				Peers: []*tailcfg.Node{peer(2)},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			err := ms.HandleNonKeepAliveMapResponse(ctx, tt.delta)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidDelta) {
+					t.Fatalf("got error %v; want errInvalidDelta", err)
+				}
+				if len(nu.nms) != 1 {
+					t.Errorf("rejected delta produced a netmap")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	t.Run("no_self_node", func(t *testing.T) {
+		ms := newTestMapSession(t, new(recordingNetmapUpdater))
+		ms.validateDeltas = true
+		err := ms.HandleNonKeepAliveMapResponse(context.Background(), &tailcfg.MapResponse{Domain: "example.com"})
+		if !errors.Is(err, errInvalidDelta) {
+			t.Fatalf("got error %v; want errInvalidDelta", err)
+		}
+	})
+}
+
+func TestPeerFilter(t *testing.T) {
+	peer := func(id tailcfg.NodeID, tags ...string) *tailcfg.Node {
+		return &tailcfg.Node{ID: id, Key: key.NewNode().Public(), Addresses: testPeerAddresses(id), Tags: tags}
+	}
+	var nu recordingNetmapUpdater
+	ms := newTestMapSession(t, &nu)
+	ms.validateDeltas = true
+	ms.peerFilter = func(n *tailcfg.Node) bool {
+		return slices.Contains(n.Tags, "tag:db")
+	}
+
+	steps := []struct {
+		name      string
+		resp      *tailcfg.MapResponse
+		wantPeers []tailcfg.NodeID
+	}{
+		{
+			name: "full",
+			resp: &tailcfg.MapResponse{
+				Node:  &tailcfg.Node{ID: 1},
+				Peers: []*tailcfg.Node{peer(2, "tag:db"), peer(3), peer(4, "tag:db"), peer(5, "tag:web")},
+			},
+			wantPeers: []tailcfg.NodeID{2, 4},
+		},
+		{
+			name: "deltas_for_filtered_peers",
+			resp: &tailcfg.MapResponse{
+				PeersChanged:         []*tailcfg.Node{peer(3), peer(6)},
+				PeersChangedPatch:    []*tailcfg.PeerChange{{NodeID: 5, DERPRegion: 1}},
+				OnlineChange:         map[tailcfg.NodeID]bool{3: true, 2: true},
+				PeerSeenChange:       map[tailcfg.NodeID]bool{5: true},
+				PeerCapabilityChange: map[tailcfg.NodeID][]tailcfg.NodeCapability{6: {"cap-a"}},
+			},
+			wantPeers: []tailcfg.NodeID{2, 4},
+		},
+		{
+			name:      "remove_filtered_peers",
+			resp:      &tailcfg.MapResponse{PeersRemoved: []tailcfg.NodeID{3, 6}},
+			wantPeers: []tailcfg.NodeID{2, 4},
+		},
+		{
+			name:      "tags_changed",
+			resp:      &tailcfg.MapResponse{PeersChanged: []*tailcfg.Node{peer(4), peer(5, "tag:db")}},
+			wantPeers: []tailcfg.NodeID{2, 5},
+		},
+		{
+			name: "deltas_for_newly_filtered_peer",
+			resp: &tailcfg.MapResponse{
+				OnlineChange: map[tailcfg.NodeID]bool{4: true, 5: true},
+				PeersRemoved: []tailcfg.NodeID{4},
+			},
+			wantPeers: []tailcfg.NodeID{2, 5},
+		},
+		{
+			name: "full_all_filtered",
+			resp: &tailcfg.MapResponse{
+				Peers: []*tailcfg.Node{peer(2), peer(5), peer(7)},
+			},
+			wantPeers: nil,
+		},
+	}
+	for _, st := range steps {
+		if err := ms.HandleNonKeepAliveMapResponse(context.Background(), st.resp); err != nil {
+			t.Fatalf("%s: %v", st.name, err)
+		}
+		var got []tailcfg.NodeID
+		for _, p := range nu.nms[len(nu.nms)-1].Peers {
+			got = append(got, p.ID())
+		}
+		if !reflect.DeepEqual(got, st.wantPeers) {
+			t.Errorf("%s: netmap peers = %v; want %v", st.name, got, st.wantPeers)
+		}
+		if len(ms.peers) != len(st.wantPeers) {
+			t.Errorf("%s: session stores %d peers; want %d", st.name, len(ms.peers), len(st.wantPeers))
+		}
+	}
+
+	// Deltas for peers that were never seen are still invalid.
+	err := ms.HandleNonKeepAliveMapResponse(context.Background(), &tailcfg.MapResponse{
+		OnlineChange: map[tailcfg.NodeID]bool{9: true},
+	})
+	if !errors.Is(err, errInvalidDelta) {
+		t.Errorf("got error %v for delta of unknown peer; want errInvalidDelta", err)
+	}
+}
+
 func TestPeerChangeDiff(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -1058,3 +1780,8 @@ func BenchmarkMapSessionDelta(b *testing.B) {
 		})
 	}
 }
+
+// testPeerAddresses returns the Addresses of a well-formed test peer.
+func testPeerAddresses(id tailcfg.NodeID) []netip.Prefix {
+	return []netip.Prefix{netip.PrefixFrom(netip.AddrFrom4([4]byte{100, 64, byte(id >> 8), byte(id)}), 32)}
+}
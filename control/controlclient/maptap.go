@@ -0,0 +1,51 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"encoding/json"
+	"net/netip"
+
+	"tailscale.com/tailcfg"
+)
+
+// tapMapRequest passes a copy of the encoded MapRequest body to the
+// Options.MapRequestTap func, if any, redacting it first if requested.
+//
+// The copy is decoded from the encoded body, so the tap sees exactly what's
+// sent to control.
+func (c *Direct) tapMapRequest(body []byte) {
+	if c.mapRequestTap == nil {
+		return
+	}
+	req := new(tailcfg.MapRequest)
+	if err := json.Unmarshal(body, req); err != nil {
+		c.logf("MapRequestTap: decoding request: %v", err)
+		return
+	}
+	if c.redactMapRequestTap {
+		redactMapRequest(req)
+	}
+	c.mapRequestTap(req)
+}
+
+// redactMapRequest removes fields that identify the node's user, host or
+// network location from req, which must be owned by the caller. Endpoint
+// addresses are zeroed but their count and types are kept.
+func redactMapRequest(req *tailcfg.MapRequest) {
+	for i := range req.Endpoints {
+		req.Endpoints[i] = netip.AddrPort{}
+	}
+	hi := req.Hostinfo
+	if hi == nil {
+		return
+	}
+	hi.Hostname = ""
+	hi.PushDeviceToken = ""
+	hi.WoLMACs = nil
+	hi.NodeIdentity = ""
+	if hi.NetInfo != nil {
+		hi.NetInfo.PublicIPs = nil
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
+	"tailscale.com/types/key"
+)
+
+// tapRecorder records the MapRequests passed to an Options.MapRequestTap.
+type tapRecorder struct {
+	mu   sync.Mutex
+	reqs []*tailcfg.MapRequest
+}
+
+func (r *tapRecorder) tap(req *tailcfg.MapRequest) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reqs = append(r.reqs, req)
+}
+
+func (r *tapRecorder) last(t *testing.T) *tailcfg.MapRequest {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.reqs) == 0 {
+		t.Fatal("MapRequestTap not called")
+	}
+	return r.reqs[len(r.reqs)-1]
+}
+
+func testEndpoints(addrs ...string) (ret []tailcfg.Endpoint) {
+	for _, a := range addrs {
+		ret = append(ret, tailcfg.Endpoint{
+			Addr: netip.MustParseAddrPort(a),
+			Type: tailcfg.EndpointSTUN,
+		})
+	}
+	return ret
+}
+
+func TestMapRequestTap(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestMapServer(t)
+	var rec tapRecorder
+	c := srv.newDirect(Options{MapRequestTap: rec.tap})
+
+	c.SetEndpoints(testEndpoints("1.2.3.4:41641"))
+	if err := c.SendUpdate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got := rec.last(t)
+	if !reflect.DeepEqual(got, srv.lastRequest()) {
+		t.Errorf("tapped request differs from the one sent:\ntapped: %+v\nsent:   %+v", got, srv.lastRequest())
+	}
+	if want := []netip.AddrPort{netip.MustParseAddrPort("1.2.3.4:41641")}; !reflect.DeepEqual(got.Endpoints, want) {
+		t.Errorf("Endpoints = %v; want %v", got.Endpoints, want)
+	}
+
+	// Changes to endpoints and Hostinfo show up in the next request.
+	c.SetEndpoints(testEndpoints("1.2.3.4:41641", "5.6.7.8:1234"))
+	c.SetHostinfo(&tailcfg.Hostinfo{BackendLogID: "test-backend-log-id", Hostname: "newname"})
+	if err := c.SendUpdate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got = rec.last(t)
+	if len(got.Endpoints) != 2 {
+		t.Errorf("Endpoints = %v; want 2", got.Endpoints)
+	}
+	if got.Hostinfo.Hostname != "newname" {
+		t.Errorf("Hostinfo.Hostname = %q; want %q", got.Hostinfo.Hostname, "newname")
+	}
+
+	// The tap gets its own copy.
+	got.Hostinfo.Hostname = "mutated"
+	if err := c.SendUpdate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if hn := srv.lastRequest().Hostinfo.Hostname; hn != "newname" {
+		t.Errorf("sent Hostinfo.Hostname = %q after tap mutation; want %q", hn, "newname")
+	}
+}
+
+func TestMapRequestTapRedact(t *testing.T) {
+	srv := newTestMapServer(t)
+	var rec tapRecorder
+	c := srv.newDirect(Options{
+		MapRequestTap:       rec.tap,
+		RedactMapRequestTap: true,
+		Hostinfo: &tailcfg.Hostinfo{
+			BackendLogID:    "test-backend-log-id",
+			Hostname:        "secret-host",
+			PushDeviceToken: "secret-token",
+			OS:              "linux",
+		},
+	})
+	c.SetEndpoints(testEndpoints("1.2.3.4:41641", "[2001:db8::1]:41641"))
+	if err := c.SendUpdate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := rec.last(t)
+	if want := make([]netip.AddrPort, 2); !reflect.DeepEqual(got.Endpoints, want) {
+		t.Errorf("redacted Endpoints = %v; want %v", got.Endpoints, want)
+	}
+	if want := []tailcfg.EndpointType{tailcfg.EndpointSTUN, tailcfg.EndpointSTUN}; !reflect.DeepEqual(got.EndpointTypes, want) {
+		t.Errorf("redacted EndpointTypes = %v; want %v", got.EndpointTypes, want)
+	}
+	if hi := got.Hostinfo; hi.Hostname != "" || hi.PushDeviceToken != "" {
+		t.Errorf("redacted Hostinfo has Hostname=%q PushDeviceToken=%q; want empty", hi.Hostname, hi.PushDeviceToken)
+	}
+	if got.Hostinfo.OS != "linux" {
+		t.Errorf("redacted Hostinfo.OS = %q; want %q", got.Hostinfo.OS, "linux")
+	}
+
+	// Control still gets the real request.
+	sent := srv.lastRequest()
+	if sent.Hostinfo.Hostname != "secret-host" || len(sent.Endpoints) != 2 || !sent.Endpoints[0].IsValid() {
+		t.Errorf("sent request was redacted: %+v", sent)
+	}
+}
+
+func TestOnRawMapResponse(t *testing.T) {
+	srv := newTestMapServer(t)
+	type raw struct {
+		resp         tailcfg.MapResponse
+		visiblePeers int // when the callback ran
+	}
+	var got []raw
+	var c *Direct
+	c = srv.newDirect(Options{
+		OnRawMapResponse: func(b []byte) {
+			var r raw
+			if err := json.Unmarshal(b, &r.resp); err != nil {
+				t.Errorf("raw response isn't a MapResponse: %v; %q", err, b)
+			}
+			r.visiblePeers = c.VisiblePeerCount()
+			got = append(got, r)
+		},
+	})
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{
+			Node:   &tailcfg.Node{ID: 1},
+			Peers:  []*tailcfg.Node{{ID: 2, Key: key.NewNode().Public(), Addresses: testPeerAddresses(2)}},
+			Domain: "a.example",
+		})
+		send(&tailcfg.MapResponse{KeepAlive: true})
+		send(&tailcfg.MapResponse{Domain: "b.example"})
+	})
+	pollNetMap(t, c)
+
+	if len(got) != 3 {
+		t.Fatalf("got %d raw responses; want 3", len(got))
+	}
+	if got[0].resp.Domain != "a.example" || got[0].visiblePeers != 0 {
+		t.Errorf("first raw response = %+v; want a.example, seen before it was applied", got[0])
+	}
+	if !got[1].resp.KeepAlive {
+		t.Errorf("second raw response = %+v; want keep-alive", got[1].resp)
+	}
+	if got[2].resp.Domain != "b.example" || got[2].visiblePeers != 1 {
+		t.Errorf("third raw response = %+v; want b.example after the first was applied", got[2])
+	}
+}
+
+func TestOnRawMapResponseKept(t *testing.T) {
+	for name, compression := range map[string]Compression{"none": CompressionNone, "zstd": CompressionZstd} {
+		srv := newTestMapServer(t)
+		var got [][]byte
+		c := srv.newDirect(Options{
+			Compression:      compression,
+			OnRawMapResponse: func(b []byte) { got = append(got, b) },
+		})
+		srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+			send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 1}, Domain: "a.example"})
+			send(&tailcfg.MapResponse{Domain: "b.example"})
+		})
+		pollNetMap(t, c)
+
+		// The slices kept from earlier responses aren't overwritten by
+		// later ones.
+		var domains []string
+		for _, b := range got {
+			var resp tailcfg.MapResponse
+			if err := json.Unmarshal(b, &resp); err != nil {
+				t.Fatalf("%s: kept raw response isn't a MapResponse: %v; %q", name, err, b)
+			}
+			domains = append(domains, resp.Domain)
+		}
+		if want := []string{"a.example", "b.example"}; !reflect.DeepEqual(domains, want) {
+			t.Errorf("%s: kept raw response domains = %q; want %q", name, domains, want)
+		}
+	}
+}
+
+func TestOnMapPollHeartbeat(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clk := tstest.NewClock(tstest.ClockOpts{Start: start})
+	srv := newTestMapServer(t)
+	var keepAlives []bool
+	c := srv.newDirect(Options{
+		Clock: clk,
+		OnMapPollHeartbeat: func(at time.Time, keepAlive bool) {
+			if !at.Equal(start) {
+				t.Errorf("heartbeat at %v; want %v", at, start)
+			}
+			keepAlives = append(keepAlives, keepAlive)
+		},
+	})
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 1}})
+		send(&tailcfg.MapResponse{KeepAlive: true})
+		send(&tailcfg.MapResponse{KeepAlive: true})
+		send(&tailcfg.MapResponse{Domain: "example.com"})
+	})
+	pollNetMap(t, c)
+
+	if want := []bool{false, true, true, false}; !reflect.DeepEqual(keepAlives, want) {
+		t.Errorf("heartbeat keepAlive args = %v; want %v", keepAlives, want)
+	}
+}
@@ -163,6 +163,7 @@ type NoiseClient struct {
 	dialer       *tsdial.Dialer
 	dnsCache     *dnscache.Resolver
 	privKey      key.MachinePrivate
+	signer       controlbase.MachineKeySigner // or nil to use privKey
 	serverPubKey key.MachinePublic
 	host         string // the host part of serverURL
 	httpPort     string // the default port to call
@@ -173,6 +174,9 @@ type NoiseClient struct {
 	// be nil.
 	dialPlan func() *tailcfg.ControlDialPlan
 
+	proxy              func(*http.Request) (*url.URL, error) // or nil for the system proxy configuration
+	proxyConnectHeader http.Header                           // or nil for the system proxy authentication
+
 	logf   logger.Logf
 	netMon *netmon.Monitor
 	health *health.Tracker
@@ -188,8 +192,12 @@ type NoiseClient struct {
 // NoiseOpts contains options for the NewNoiseClient function. All fields are
 // required unless otherwise specified.
 type NoiseOpts struct {
-	// PrivKey is this node's private key.
+	// PrivKey is this node's private key. It's not required if
+	// MachineKeySigner is set.
 	PrivKey key.MachinePrivate
+	// MachineKeySigner, if non-nil, is used instead of PrivKey for the
+	// operations with this node's private key.
+	MachineKeySigner controlbase.MachineKeySigner
 	// ServerPubKey is the public key of the server.
 	ServerPubKey key.MachinePublic
 	// ServerURL is the URL of the server to connect to.
@@ -211,6 +219,12 @@ type NoiseOpts struct {
 	// DialPlan, if set, is a function that should return an explicit plan
 	// on how to connect to the server.
 	DialPlan func() *tailcfg.ControlDialPlan
+	// Proxy, if non-nil, returns the proxy to connect to the server through,
+	// instead of the system proxy configuration.
+	Proxy func(*http.Request) (*url.URL, error)
+	// ProxyConnectHeader, if non-nil, is sent to the proxy in CONNECT
+	// requests instead of the system proxy authentication.
+	ProxyConnectHeader http.Header
 }
 
 // NewNoiseClient returns a new noiseClient for the provided server and machine key.
@@ -243,6 +257,7 @@ func NewNoiseClient(opts NoiseOpts) (*NoiseClient, error) {
 	np := &NoiseClient{
 		serverPubKey: opts.ServerPubKey,
 		privKey:      opts.PrivKey,
+		signer:       opts.MachineKeySigner,
 		host:         u.Hostname(),
 		httpPort:     httpPort,
 		httpsPort:    httpsPort,
@@ -252,6 +267,9 @@ func NewNoiseClient(opts NoiseOpts) (*NoiseClient, error) {
 		logf:         opts.Logf,
 		netMon:       opts.NetMon,
 		health:       opts.HealthTracker,
+
+		proxy:              opts.Proxy,
+		proxyConnectHeader: opts.ProxyConnectHeader,
 	}
 
 	// Create the HTTP/2 Transport using a net/http.Transport
@@ -447,19 +465,23 @@ func (nc *NoiseClient) dial(ctx context.Context) (*noiseConn, error) {
 	defer cancel()
 
 	clientConn, err := (&controlhttp.Dialer{
-		Hostname:        nc.host,
-		HTTPPort:        nc.httpPort,
-		HTTPSPort:       nc.httpsPort,
-		MachineKey:      nc.privKey,
-		ControlKey:      nc.serverPubKey,
-		ProtocolVersion: uint16(tailcfg.CurrentCapabilityVersion),
-		Dialer:          nc.dialer.SystemDial,
-		DNSCache:        nc.dnsCache,
-		DialPlan:        dialPlan,
-		Logf:            nc.logf,
-		NetMon:          nc.netMon,
-		HealthTracker:   nc.health,
-		Clock:           tstime.StdClock{},
+		Hostname:         nc.host,
+		HTTPPort:         nc.httpPort,
+		HTTPSPort:        nc.httpsPort,
+		MachineKey:       nc.privKey,
+		MachineKeySigner: nc.signer,
+		ControlKey:       nc.serverPubKey,
+		ProtocolVersion:  uint16(tailcfg.CurrentCapabilityVersion),
+		Dialer:           nc.dialer.SystemDial,
+		DNSCache:         nc.dnsCache,
+		DialPlan:         dialPlan,
+		Logf:             nc.logf,
+		NetMon:           nc.netMon,
+		HealthTracker:    nc.health,
+		Clock:            tstime.StdClock{},
+
+		Proxy:              nc.proxy,
+		ProxyConnectHeader: nc.proxyConnectHeader,
 	}).Dial(ctx)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,67 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"slices"
+	"time"
+)
+
+// onlineDurationBuckets are the upper bounds (exclusive) of the buckets of an
+// OnlineDurationHistogram. Durations of at least the last bound go in a final,
+// unbounded bucket.
+var onlineDurationBuckets = []time.Duration{
+	time.Minute,
+	10 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+}
+
+// OnlineDurationHistogram counts how long peers stayed online, from when they
+// were seen to come online (or first seen online) until they were seen to go
+// offline.
+type OnlineDurationHistogram struct {
+	// Bounds are the exclusive upper bounds of all but the last bucket.
+	Bounds []time.Duration
+
+	// Counts has len(Bounds)+1 elements. Counts[i] is the number of online
+	// periods shorter than Bounds[i] (and not shorter than Bounds[i-1]).
+	// The final element counts periods of at least Bounds[len(Bounds)-1].
+	Counts []int64
+}
+
+// onlineHistogram is the mutable form of OnlineDurationHistogram, with a
+// fixed number of buckets.
+type onlineHistogram [6]int64 // len(onlineDurationBuckets)+1
+
+// add counts an online period of duration d.
+func (h *onlineHistogram) add(d time.Duration) {
+	i, _ := slices.BinarySearch(onlineDurationBuckets, d+1)
+	h[i]++
+}
+
+// notePeerOnlineLocked updates ps.onlineSince, and c.onlineHist if the peer
+// went offline, given whether the peer is now online. c.mu must be held.
+func (c *Direct) notePeerOnlineLocked(ps *peerState, online bool, now time.Time) {
+	switch {
+	case online && ps.onlineSince.IsZero():
+		ps.onlineSince = now
+	case !online && !ps.onlineSince.IsZero():
+		c.onlineHist.add(now.Sub(ps.onlineSince))
+		ps.onlineSince = time.Time{}
+	}
+}
+
+// OnlineDurationHistogram returns a histogram of how long peers stayed online
+// while this Direct has been polling the netmap, or since the last call to
+// ResetStats.
+func (c *Direct) OnlineDurationHistogram() OnlineDurationHistogram {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return OnlineDurationHistogram{
+		Bounds: slices.Clone(onlineDurationBuckets),
+		Counts: slices.Clone(c.onlineHist[:]),
+	}
+}
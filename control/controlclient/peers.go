@@ -0,0 +1,201 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/views"
+)
+
+// peerState is what Direct tracks about each peer in the most recent netmap,
+// for answering per-peer queries from outside the map poll goroutine.
+type peerState struct {
+	node tailcfg.NodeView
+
+	// endpointsUpdated is when node's Endpoints were last seen to change
+	// (or when the peer was first seen).
+	endpointsUpdated time.Time
+
+	// onlineSince is when node was seen to come online, or the zero value
+	// if it's not online.
+	onlineSince time.Time
+
+	// lastActive is when the peer was last marked active with
+	// MarkPeerActive (or when the peer was first seen).
+	lastActive time.Time
+}
+
+// updatePeers updates c.peers from a map session's peer changes. It's the
+// mapSession.onPeersUpdated hook.
+func (c *Direct) updatePeers(full bool, changed []tailcfg.NodeView, removed []tailcfg.NodeID) {
+	now := c.clock.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	old := c.peers
+	if full {
+		c.peers = make(map[tailcfg.NodeID]*peerState, len(changed))
+	}
+	for _, id := range removed {
+		delete(c.peers, id)
+	}
+	for _, n := range changed {
+		ps, ok := old[n.ID()]
+		if !ok {
+			ps = &peerState{endpointsUpdated: now, lastActive: now}
+		} else if !views.SliceEqual(ps.node.Endpoints(), n.Endpoints()) {
+			ps.endpointsUpdated = now
+		}
+		ps.node = n
+		c.notePeerOnlineLocked(ps, n.Online() != nil && *n.Online(), now)
+		if c.peers == nil {
+			c.peers = make(map[tailcfg.NodeID]*peerState)
+		}
+		c.peers[n.ID()] = ps
+	}
+}
+
+// PeerEndpointsAge reports how long ago the endpoints of the peer with the
+// given node ID last changed, according to the most recent netmap. It reports
+// false if the peer isn't in the netmap.
+//
+// Callers can use this to decide whether to trust a peer's cached endpoints
+// or to force a disco re-probe.
+func (c *Direct) PeerEndpointsAge(id tailcfg.NodeID) (_ time.Duration, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ps, ok := c.peers[id]
+	if !ok {
+		return 0, false
+	}
+	return c.clock.Since(ps.endpointsUpdated), true
+}
+
+// PeerPreferredEndpoint returns control's preferred endpoint hint for the peer
+// with the given node ID (see tailcfg.Node.PreferredEndpoint), according to the
+// most recent netmap. It reports false if the peer isn't in the netmap or
+// control sent no hint for it.
+func (c *Direct) PeerPreferredEndpoint(id tailcfg.NodeID) (_ netip.AddrPort, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ps, ok := c.peers[id]
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	if ep := ps.node.PreferredEndpoint(); ep != nil {
+		return *ep, true
+	}
+	return netip.AddrPort{}, false
+}
+
+// PeerTags returns the ACL tags of the peer with the given node ID, according
+// to the most recent netmap. The result is a copy owned by the caller; it's
+// nil if the peer is untagged. It reports false if the peer isn't in the
+// netmap.
+func (c *Direct) PeerTags(id tailcfg.NodeID) (_ []string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ps, ok := c.peers[id]
+	if !ok {
+		return nil, false
+	}
+	return ps.node.Tags().AsSlice(), true
+}
+
+// MarkPeerActive records that the peer with the given node ID has had recent
+// traffic, for IdlePeers. It's a no-op if the peer isn't in the netmap.
+func (c *Direct) MarkPeerActive(id tailcfg.NodeID) {
+	now := c.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ps, ok := c.peers[id]; ok {
+		ps.lastActive = now
+	}
+}
+
+// IdlePeers returns the node IDs, sorted, of the peers in the most recent
+// netmap that haven't been marked active with MarkPeerActive for at least
+// threshold. Peers are considered active when first seen.
+//
+// The engine can use this to deprioritize or tear down idle WireGuard
+// sessions.
+func (c *Direct) IdlePeers(threshold time.Duration) []tailcfg.NodeID {
+	now := c.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var idle []tailcfg.NodeID
+	for id, ps := range c.peers {
+		if now.Sub(ps.lastActive) >= threshold {
+			idle = append(idle, id)
+		}
+	}
+	slices.Sort(idle)
+	return idle
+}
+
+// VisiblePeerCount returns the number of peers in the most recent netmap.
+// With scoped visibility (see Options.PeerScope), this may be fewer than
+// the number of nodes in the tailnet.
+func (c *Direct) VisiblePeerCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.peers)
+}
+
+// Peers returns the peers in the most recent netmap in its order: by
+// Options.PeerSortLess, or by node ID if it's nil. Peers that PeerSortLess
+// considers equal are ordered by node ID.
+func (c *Direct) Peers() []tailcfg.NodeView {
+	c.mu.Lock()
+	peers := make([]tailcfg.NodeView, 0, len(c.peers))
+	for _, ps := range c.peers {
+		peers = append(peers, ps.node)
+	}
+	c.mu.Unlock()
+
+	slices.SortFunc(peers, func(a, b tailcfg.NodeView) int {
+		return cmp.Compare(a.ID(), b.ID())
+	})
+	if c.peerSortLess != nil {
+		sortPeersStable(peers, c.peerSortLess)
+	}
+	return peers
+}
+
+// sortPeersStable sorts peers, which are in node ID order, by less, keeping
+// peers that less considers equal in node ID order.
+func sortPeersStable(peers []tailcfg.NodeView, less func(a, b tailcfg.NodeView) bool) {
+	slices.SortStableFunc(peers, func(a, b tailcfg.NodeView) int {
+		switch {
+		case less(a, b):
+			return -1
+		case less(b, a):
+			return 1
+		}
+		return 0
+	})
+}
+
+// ExportPeers returns copies of the peers in the most recent netmap, sorted by
+// node ID, for an embedder to save and pass as Options.PersistedPeers to the
+// Direct it creates after a restart.
+func (c *Direct) ExportPeers() []*tailcfg.Node {
+	c.mu.Lock()
+	nodes := make([]*tailcfg.Node, 0, len(c.peers))
+	for _, ps := range c.peers {
+		nodes = append(nodes, ps.node.AsStruct())
+	}
+	c.mu.Unlock()
+
+	slices.SortFunc(nodes, func(a, b *tailcfg.Node) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return nodes
+}
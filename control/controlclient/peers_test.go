@@ -0,0 +1,447 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"context"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/ptr"
+)
+
+// newTestPeerSession returns a Direct and a mapSession whose peer updates
+// are fed to the Direct, as sendMapRequest does.
+func newTestPeerSession(t *testing.T, opts Options) (*Direct, *mapSession) {
+	c := newTestMapServer(t).newDirect(opts)
+	ms := newTestMapSession(t, nil)
+	ms.altClock = c.clock
+	ms.onPeersUpdated = c.updatePeers
+	return c, ms
+}
+
+func TestPeerEndpointsAge(t *testing.T) {
+	clk := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1000, 0)})
+	c, ms := newTestPeerSession(t, Options{Clock: clk})
+
+	wantAge := func(id tailcfg.NodeID, want time.Duration) {
+		t.Helper()
+		got, ok := c.PeerEndpointsAge(id)
+		if !ok {
+			t.Fatalf("PeerEndpointsAge(%v) unknown peer", id)
+		}
+		if got != want {
+			t.Errorf("PeerEndpointsAge(%v) = %v; want %v", id, got, want)
+		}
+	}
+
+	ms.updateStateFromResponse(&tailcfg.MapResponse{
+		Peers: []*tailcfg.Node{
+			{ID: 1, Endpoints: eps("1.2.3.4:1")},
+			{ID: 2, Endpoints: eps("5.6.7.8:2")},
+		},
+	})
+	wantAge(1, 0)
+	wantAge(2, 0)
+
+	// Age grows while nothing changes, including on deltas that don't
+	// touch endpoints.
+	clk.Advance(10 * time.Second)
+	ms.updateStateFromResponse(&tailcfg.MapResponse{
+		OnlineChange: map[tailcfg.NodeID]bool{1: true},
+		PeersChangedPatch: []*tailcfg.PeerChange{{
+			NodeID:     2,
+			DERPRegion: 3,
+		}},
+	})
+	wantAge(1, 10*time.Second)
+	wantAge(2, 10*time.Second)
+
+	// An endpoint-changing delta resets the age for just that peer.
+	clk.Advance(5 * time.Second)
+	ms.updateStateFromResponse(&tailcfg.MapResponse{
+		PeersChangedPatch: []*tailcfg.PeerChange{{
+			NodeID:    1,
+			Endpoints: eps("1.2.3.4:99"),
+		}},
+	})
+	wantAge(1, 0)
+	wantAge(2, 15*time.Second)
+
+	// A full map with the same endpoints doesn't reset the age.
+	clk.Advance(5 * time.Second)
+	ms.updateStateFromResponse(&tailcfg.MapResponse{
+		Peers: []*tailcfg.Node{
+			{ID: 1, Endpoints: eps("1.2.3.4:99")},
+			{ID: 2, Endpoints: eps("5.6.7.8:2")},
+		},
+	})
+	wantAge(1, 5*time.Second)
+	wantAge(2, 20*time.Second)
+
+	ms.updateStateFromResponse(&tailcfg.MapResponse{
+		PeersRemoved: []tailcfg.NodeID{2},
+	})
+	if _, ok := c.PeerEndpointsAge(2); ok {
+		t.Error("PeerEndpointsAge(2) known after removal")
+	}
+	if _, ok := c.PeerEndpointsAge(404); ok {
+		t.Error("PeerEndpointsAge(404) known for never-seen peer")
+	}
+}
+
+func TestPeerPreferredEndpoint(t *testing.T) {
+	c, ms := newTestPeerSession(t, Options{})
+	hint := netip.MustParseAddrPort("192.168.1.2:41641")
+
+	wantHint := func(id tailcfg.NodeID, want netip.AddrPort, wantOK bool) {
+		t.Helper()
+		got, ok := c.PeerPreferredEndpoint(id)
+		if got != want || ok != wantOK {
+			t.Errorf("PeerPreferredEndpoint(%v) = %v, %v; want %v, %v", id, got, ok, want, wantOK)
+		}
+	}
+
+	ms.updateStateFromResponse(&tailcfg.MapResponse{
+		Peers: []*tailcfg.Node{
+			{ID: 1, Endpoints: eps("1.2.3.4:1", hint.String()), PreferredEndpoint: &hint},
+			{ID: 2, Endpoints: eps("5.6.7.8:2")},
+		},
+	})
+	wantHint(1, hint, true)
+	wantHint(2, netip.AddrPort{}, false)
+	wantHint(404, netip.AddrPort{}, false)
+
+	// Partial updates that don't mention the hint preserve it.
+	ms.updateStateFromResponse(&tailcfg.MapResponse{
+		OnlineChange: map[tailcfg.NodeID]bool{1: true},
+		PeersChangedPatch: []*tailcfg.PeerChange{{
+			NodeID:    1,
+			Endpoints: eps("1.2.3.4:99", hint.String()),
+		}},
+	})
+	wantHint(1, hint, true)
+
+	// A changed node carrying a new hint replaces it.
+	hint2 := netip.MustParseAddrPort("192.168.1.2:12345")
+	ms.updateStateFromResponse(&tailcfg.MapResponse{
+		PeersChanged: []*tailcfg.Node{
+			{ID: 2, Endpoints: eps("5.6.7.8:2", hint2.String()), PreferredEndpoint: &hint2},
+		},
+	})
+	wantHint(1, hint, true)
+	wantHint(2, hint2, true)
+}
+
+func TestPeerTags(t *testing.T) {
+	c, ms := newTestPeerSession(t, Options{})
+
+	wantTags := func(id tailcfg.NodeID, want []string, wantOK bool) {
+		t.Helper()
+		got, ok := c.PeerTags(id)
+		if !reflect.DeepEqual(got, want) || ok != wantOK {
+			t.Errorf("PeerTags(%v) = %q, %v; want %q, %v", id, got, ok, want, wantOK)
+		}
+	}
+
+	ms.updateStateFromResponse(&tailcfg.MapResponse{
+		Peers: []*tailcfg.Node{
+			{ID: 1, Tags: []string{"tag:server", "tag:prod"}},
+			{ID: 2},
+		},
+	})
+	wantTags(1, []string{"tag:server", "tag:prod"}, true)
+	wantTags(2, nil, true)
+	wantTags(404, nil, false)
+
+	// The result is a copy.
+	tags, _ := c.PeerTags(1)
+	tags[0] = "tag:mutated"
+	wantTags(1, []string{"tag:server", "tag:prod"}, true)
+
+	// Partial updates that don't touch tags keep them.
+	ms.updateStateFromResponse(&tailcfg.MapResponse{
+		OnlineChange: map[tailcfg.NodeID]bool{1: true},
+		PeersChangedPatch: []*tailcfg.PeerChange{{
+			NodeID:    1,
+			Endpoints: eps("1.2.3.4:5"),
+		}},
+	})
+	wantTags(1, []string{"tag:server", "tag:prod"}, true)
+
+	// A changed node replaces them.
+	ms.updateStateFromResponse(&tailcfg.MapResponse{
+		PeersChanged: []*tailcfg.Node{{ID: 2, Tags: []string{"tag:new"}}},
+	})
+	wantTags(2, []string{"tag:new"}, true)
+}
+
+func TestOnlineDurationHistogram(t *testing.T) {
+	clk := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1000, 0)})
+	c, ms := newTestPeerSession(t, Options{Clock: clk})
+
+	wantCounts := func(want ...int64) {
+		t.Helper()
+		h := c.OnlineDurationHistogram()
+		if len(h.Counts) != len(h.Bounds)+1 {
+			t.Fatalf("got %d counts for %d bounds", len(h.Counts), len(h.Bounds))
+		}
+		if !reflect.DeepEqual(h.Counts, want) {
+			t.Errorf("Counts = %v; want %v", h.Counts, want)
+		}
+	}
+	online := func(m map[tailcfg.NodeID]bool) {
+		ms.updateStateFromResponse(&tailcfg.MapResponse{OnlineChange: m})
+	}
+
+	ms.updateStateFromResponse(&tailcfg.MapResponse{
+		Peers: []*tailcfg.Node{
+			{ID: 1, Online: ptr.To(true)},
+			{ID: 2, Online: ptr.To(true)},
+			{ID: 3},
+		},
+	})
+	wantCounts(0, 0, 0, 0, 0, 0)
+
+	// Peer 1 goes offline after 30s, peer 2 after 2h.
+	clk.Advance(30 * time.Second)
+	online(map[tailcfg.NodeID]bool{1: false})
+	clk.Advance(2*time.Hour - 30*time.Second)
+	online(map[tailcfg.NodeID]bool{2: false})
+	wantCounts(1, 0, 0, 1, 0, 0)
+
+	// Peer 3 comes online; repeated online notifications don't restart
+	// its period.
+	online(map[tailcfg.NodeID]bool{3: true})
+	clk.Advance(5 * time.Minute)
+	online(map[tailcfg.NodeID]bool{3: true})
+	clk.Advance(5 * time.Minute)
+	online(map[tailcfg.NodeID]bool{3: false})
+	wantCounts(1, 0, 1, 1, 0, 0)
+
+	// Offline peers going offline again aren't counted.
+	online(map[tailcfg.NodeID]bool{1: false, 3: false})
+	wantCounts(1, 0, 1, 1, 0, 0)
+
+	// Long periods go in the last bucket.
+	online(map[tailcfg.NodeID]bool{1: true})
+	clk.Advance(48 * time.Hour)
+	online(map[tailcfg.NodeID]bool{1: false})
+	wantCounts(1, 0, 1, 1, 0, 1)
+
+	// Removed peers aren't counted.
+	online(map[tailcfg.NodeID]bool{2: true})
+	clk.Advance(time.Minute)
+	ms.updateStateFromResponse(&tailcfg.MapResponse{PeersRemoved: []tailcfg.NodeID{2}})
+	wantCounts(1, 0, 1, 1, 0, 1)
+
+	c.ResetStats()
+	wantCounts(0, 0, 0, 0, 0, 0)
+}
+
+func TestIdlePeers(t *testing.T) {
+	clk := tstest.NewClock(tstest.ClockOpts{Start: time.Unix(1000, 0)})
+	c, ms := newTestPeerSession(t, Options{Clock: clk})
+
+	wantIdle := func(threshold time.Duration, want ...tailcfg.NodeID) {
+		t.Helper()
+		if got := c.IdlePeers(threshold); !reflect.DeepEqual(got, want) {
+			t.Errorf("IdlePeers(%v) = %v; want %v", threshold, got, want)
+		}
+	}
+
+	ms.updateStateFromResponse(&tailcfg.MapResponse{
+		Peers: []*tailcfg.Node{{ID: 1}, {ID: 2}, {ID: 3}},
+	})
+	// New peers count as active.
+	wantIdle(time.Minute)
+
+	clk.Advance(30 * time.Second)
+	c.MarkPeerActive(2)
+	c.MarkPeerActive(404) // unknown peers are ignored
+	clk.Advance(40 * time.Second)
+	wantIdle(time.Minute, 1, 3)
+	wantIdle(30*time.Second, 1, 2, 3)
+	wantIdle(2 * time.Minute)
+
+	c.MarkPeerActive(3)
+	clk.Advance(30 * time.Second)
+	wantIdle(time.Minute, 1, 2)
+
+	// Activity survives full netmaps and deltas for existing peers, and
+	// newly added peers start out active.
+	ms.updateStateFromResponse(&tailcfg.MapResponse{
+		Peers: []*tailcfg.Node{{ID: 1}, {ID: 3}, {ID: 4}},
+	})
+	wantIdle(time.Minute, 1)
+	ms.updateStateFromResponse(&tailcfg.MapResponse{
+		OnlineChange: map[tailcfg.NodeID]bool{1: true, 3: true},
+	})
+	wantIdle(time.Minute, 1)
+
+	clk.Advance(time.Minute)
+	wantIdle(time.Minute, 1, 3, 4)
+}
+
+func TestPeersSortLess(t *testing.T) {
+	resp := &tailcfg.MapResponse{
+		Peers: []*tailcfg.Node{
+			{ID: 5, Name: "b"},
+			{ID: 1, Name: "c"},
+			{ID: 4, Name: "a"},
+			{ID: 2, Name: "b"},
+			{ID: 3, Name: "a"},
+		},
+	}
+	peerIDs := func(c *Direct) []tailcfg.NodeID {
+		var ids []tailcfg.NodeID
+		for _, n := range c.Peers() {
+			ids = append(ids, n.ID())
+		}
+		return ids
+	}
+
+	c, ms := newTestPeerSession(t, Options{})
+	ms.updateStateFromResponse(resp)
+	if got, want := peerIDs(c), []tailcfg.NodeID{1, 2, 3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Peers without PeerSortLess = %v; want %v", got, want)
+	}
+
+	c, ms = newTestPeerSession(t, Options{
+		PeerSortLess: func(a, b tailcfg.NodeView) bool { return a.Name() < b.Name() },
+	})
+	ms.updateStateFromResponse(resp)
+	if got, want := peerIDs(c), []tailcfg.NodeID{3, 4, 2, 5, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Peers by name = %v; want %v", got, want)
+	}
+}
+
+// TestPeerSortLessNetmap tests that the netmaps a map poll delivers have
+// their peers ordered by PeerSortLess, including after changes that would
+// otherwise be sent as deltas.
+func TestPeerSortLessNetmap(t *testing.T) {
+	var peers []*tailcfg.Node
+	for _, p := range []struct {
+		id   tailcfg.NodeID
+		name string
+	}{{5, "b"}, {1, "c"}, {4, "a"}, {2, "b"}, {3, "a"}} {
+		peers = append(peers, &tailcfg.Node{
+			ID:        p.id,
+			Name:      p.name,
+			Key:       key.NewNode().Public(),
+			Addresses: testPeerAddresses(p.id),
+		})
+	}
+	nmPeerIDs := func(nm *netmap.NetworkMap) []tailcfg.NodeID {
+		var ids []tailcfg.NodeID
+		for _, n := range nm.Peers {
+			ids = append(ids, n.ID())
+		}
+		return ids
+	}
+
+	for _, tt := range []struct {
+		name string
+		less func(a, b tailcfg.NodeView) bool
+		want []tailcfg.NodeID
+	}{
+		{"nil", nil, []tailcfg.NodeID{1, 2, 3, 4, 5}},
+		{"name", func(a, b tailcfg.NodeView) bool { return a.Name() < b.Name() }, []tailcfg.NodeID{3, 4, 2, 5, 1}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestMapServer(t)
+			c := srv.newDirect(Options{PeerSortLess: tt.less})
+			srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+				send(&tailcfg.MapResponse{Node: &tailcfg.Node{ID: 100}, Peers: peers})
+				send(&tailcfg.MapResponse{PeersChangedPatch: []*tailcfg.PeerChange{{NodeID: 2, Online: ptr.To(true)}}})
+			})
+			var nu deltaRecordingNetmapUpdater
+			c.PollNetMap(context.Background(), &nu)
+
+			wantNetmaps, wantDeltas := 1, 1
+			if tt.less != nil {
+				// The patch becomes a full netmap, in PeerSortLess order.
+				wantNetmaps, wantDeltas = 2, 0
+			}
+			if len(nu.nms) != wantNetmaps || len(nu.muts) != wantDeltas {
+				t.Fatalf("got %d netmaps and %d deltas; want %d and %d", len(nu.nms), len(nu.muts), wantNetmaps, wantDeltas)
+			}
+			for i, nm := range nu.nms {
+				if got := nmPeerIDs(nm); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("netmap %d peers = %v; want %v", i, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPersistedPeers(t *testing.T) {
+	keys := map[tailcfg.NodeID]key.NodePublic{}
+	peer := func(id tailcfg.NodeID, name string) *tailcfg.Node {
+		if _, ok := keys[id]; !ok {
+			keys[id] = key.NewNode().Public()
+		}
+		return &tailcfg.Node{ID: id, Name: name, Key: keys[id], Addresses: testPeerAddresses(id)}
+	}
+	self := &tailcfg.Node{ID: 1, Name: "self.example.ts.net."}
+
+	// pollOnce polls c, with control sending resp, and returns the
+	// resulting netmap peers.
+	pollOnce := func(srv *testMapServer, c *Direct, resp *tailcfg.MapResponse) []*tailcfg.Node {
+		t.Helper()
+		srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+			send(resp)
+		})
+		nms := pollNetMap(t, c)
+		if len(nms) == 0 {
+			t.Fatal("no netmap")
+		}
+		var peers []*tailcfg.Node
+		for _, p := range nms[len(nms)-1].Peers {
+			peers = append(peers, p.AsStruct())
+		}
+		return peers
+	}
+
+	// A previous run gets a full netmap, and saves its peers.
+	srv := newTestMapServer(t)
+	prev := srv.newDirect(Options{})
+	pollOnce(srv, prev, &tailcfg.MapResponse{
+		Node:  self,
+		Peers: []*tailcfg.Node{peer(2, "a"), peer(3, "b"), peer(4, "c")},
+	})
+	saved := prev.ExportPeers()
+
+	// After a restart, a delta applies to the saved peers.
+	srv = newTestMapServer(t)
+	c := srv.newDirect(Options{PersistedPeers: saved})
+	if got := c.ExportPeers(); !reflect.DeepEqual(got, saved) {
+		t.Errorf("ExportPeers before polling = %v; want the persisted peers %v", got, saved)
+	}
+	got := pollOnce(srv, c, &tailcfg.MapResponse{
+		Node:         self,
+		PeersChanged: []*tailcfg.Node{peer(3, "b2"), peer(5, "d")},
+		PeersRemoved: []tailcfg.NodeID{4},
+	})
+
+	// That matches a full netmap from scratch.
+	srv = newTestMapServer(t)
+	want := pollOnce(srv, srv.newDirect(Options{}), &tailcfg.MapResponse{
+		Node:  self,
+		Peers: []*tailcfg.Node{peer(2, "a"), peer(3, "b2"), peer(5, "d")},
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("peers after delta on persisted peers:\n got: %v\nwant: %v", logger.AsJSON(got), logger.AsJSON(want))
+	}
+	if got := c.ExportPeers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ExportPeers after delta = %v; want %v", logger.AsJSON(got), logger.AsJSON(want))
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import "tailscale.com/tailcfg"
+
+// addPeersPage assembles paginated full peer lists (see
+// MapResponse.PeersPageToken) from the responses of the map poll.
+//
+// If resp is a page other than the last, it's buffered and addPeersPage
+// reports false; the caller should then skip the rest of resp's processing.
+// Otherwise it reports true, having set resp.Peers to the complete list if
+// resp was the last page. If that list is empty, which wouldn't be treated
+// as a full map, resp instead removes all current peers explicitly.
+//
+// A response that doesn't continue the list being assembled, if any,
+// discards the partial list.
+func (ms *mapSession) addPeersPage(resp *tailcfg.MapResponse) bool {
+	tok := resp.PeersPageToken
+	if ms.peersPageToken != "" && tok != ms.peersPageToken {
+		ms.logf("netmap: discarding incomplete paginated peer list %q (%d peers)", ms.peersPageToken, len(ms.pagedPeers))
+		metricAbortedPeerPages.Add(1)
+		ms.peersPageToken, ms.pagedPeers = "", nil
+	}
+	if tok == "" {
+		return true
+	}
+	if ms.peersPageToken == "" {
+		ms.peersPageToken = tok
+	}
+	ms.pagedPeers = append(ms.pagedPeers, resp.Peers...)
+	if resp.PeersMorePages {
+		ms.vlogf("netmap: got peer list page %q (%d peers so far)", tok, len(ms.pagedPeers))
+		return false
+	}
+	resp.Peers = ms.pagedPeers
+	ms.peersPageToken, ms.pagedPeers = "", nil
+	if len(resp.Peers) == 0 {
+		// As with a full map, ignore any deltas, which can only refer to
+		// the peers being removed.
+		resp.PeersChanged = nil
+		resp.PeersChangedPatch = nil
+		resp.PeerSeenChange = nil
+		resp.OnlineChange = nil
+		resp.PeerCapabilityChange = nil
+		resp.PeersRemoved = resp.PeersRemoved[:0]
+		for id := range ms.peers {
+			resp.PeersRemoved = append(resp.PeersRemoved, id)
+		}
+	}
+	return true
+}
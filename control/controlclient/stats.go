@@ -0,0 +1,62 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats are counts of a Direct's activity with control.
+//
+// They're cumulative since the Direct was created or since the most recent
+// call to Direct.ResetStats, whichever is later. This differs from the
+// process-wide controlclient_* clientmetrics (such as
+// controlclient_map_requests), which are cumulative over the lifetime of the
+// process and are never reset.
+type Stats struct {
+	Since            time.Time // when counting began
+	RegisterRequests int64     // register (login and logout) requests sent
+	MapRequests      int64     // map requests sent, streaming or not
+	MapResponses     int64     // map response messages received, including keep-alives
+	KeepAlives       int64     // keep-alive map response messages received
+}
+
+// directStats is the mutable form of Stats. A Direct swaps in a new one to
+// reset all counters at once.
+type directStats struct {
+	since            time.Time
+	registerRequests atomic.Int64
+	mapRequests      atomic.Int64
+	mapResponses     atomic.Int64
+	keepAlives       atomic.Int64
+}
+
+// curStats returns the counters currently being incremented.
+func (c *Direct) curStats() *directStats {
+	return c.stats.Load()
+}
+
+// Stats returns the activity counts since the Direct was created or its stats
+// were last reset.
+func (c *Direct) Stats() Stats {
+	s := c.curStats()
+	return Stats{
+		Since:            s.since,
+		RegisterRequests: s.registerRequests.Load(),
+		MapRequests:      s.mapRequests.Load(),
+		MapResponses:     s.mapResponses.Load(),
+		KeepAlives:       s.keepAlives.Load(),
+	}
+}
+
+// ResetStats zeroes all the counters returned by Stats, as well as the
+// OnlineDurationHistogram. It doesn't affect the session with control or the
+// process-wide clientmetrics.
+func (c *Direct) ResetStats() {
+	c.stats.Store(&directStats{since: c.clock.Now()})
+	c.mu.Lock()
+	c.onlineHist = onlineHistogram{}
+	c.mu.Unlock()
+}
@@ -0,0 +1,112 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"sync"
+
+	"tailscale.com/types/netmap"
+)
+
+// subscriberBuffer is the number of NetMapUpdates buffered per Subscribe
+// channel.
+const subscriberBuffer = 16
+
+// NetMapUpdate is a network map update delivered to Subscribe channels.
+// Exactly one of its fields is set.
+type NetMapUpdate struct {
+	// NetMap, if non-nil, is a new full network map.
+	NetMap *netmap.NetworkMap
+
+	// Mutations, if non-nil, are incremental changes to the previous
+	// full network map.
+	Mutations []netmap.NodeMutation
+}
+
+// Subscribe returns a channel that receives each network map update from the
+// map poll, and a func to unsubscribe. Multiple subscribers are supported.
+//
+// Each channel buffers a limited number of updates. Sending never blocks the
+// map poll: if a subscriber falls behind and its buffer is full, its oldest
+// buffered update is dropped to make room for the newest. Subscribers that
+// need complete state should therefore treat the next full NetMap as
+// authoritative.
+//
+// The unsubscribe func closes the channel. It's safe to call more than once.
+func (c *Direct) Subscribe() (_ <-chan NetMapUpdate, unsubscribe func()) {
+	ch := make(chan NetMapUpdate, subscriberBuffer)
+	c.mu.Lock()
+	if c.subs == nil {
+		c.subs = make(map[chan NetMapUpdate]bool)
+	}
+	c.subs[ch] = true
+	c.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			delete(c.subs, ch)
+			close(ch)
+		})
+	}
+}
+
+// publish sends u to all subscribers without blocking.
+func (c *Direct) publish(u NetMapUpdate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ch := range c.subs {
+		for {
+			select {
+			case ch <- u:
+			default:
+				// Full. Drop the oldest and retry.
+				select {
+				case <-ch:
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+// newPublishingNetmapUpdater returns a NetmapUpdater that forwards updates to
+// nu and then publishes them to c's subscribers. The result implements
+// NetmapDeltaUpdater only if nu does.
+func (c *Direct) newPublishingNetmapUpdater(nu NetmapUpdater) NetmapUpdater {
+	pu := publishingNetmapUpdater{c, nu}
+	if nud, ok := nu.(NetmapDeltaUpdater); ok {
+		return publishingNetmapDeltaUpdater{pu, nud}
+	}
+	return pu
+}
+
+type publishingNetmapUpdater struct {
+	c  *Direct
+	nu NetmapUpdater
+}
+
+func (u publishingNetmapUpdater) UpdateFullNetmap(nm *netmap.NetworkMap) {
+	u.c.setLastNetMap(nm)
+	u.nu.UpdateFullNetmap(nm)
+	u.c.publish(NetMapUpdate{NetMap: nm})
+}
+
+type publishingNetmapDeltaUpdater struct {
+	publishingNetmapUpdater
+	nud NetmapDeltaUpdater
+}
+
+func (u publishingNetmapDeltaUpdater) UpdateNetmapDelta(muts []netmap.NodeMutation) bool {
+	if !u.nud.UpdateNetmapDelta(muts) {
+		// The caller falls back to a full netmap, which gets published.
+		return false
+	}
+	u.c.publish(NetMapUpdate{Mutations: muts})
+	return true
+}
@@ -0,0 +1,63 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"os"
+	"strings"
+)
+
+// systemTimeZone returns the IANA name of the system's local time zone, from
+// the TZ environment variable or the /etc/localtime symlink, or the empty
+// string if it can't be determined.
+func systemTimeZone() string {
+	if tz, ok := os.LookupEnv("TZ"); ok {
+		// A leading colon is allowed by POSIX; TZ="" means UTC.
+		tz = strings.TrimPrefix(tz, ":")
+		if tz == "" {
+			return "UTC"
+		}
+		if strings.HasPrefix(tz, "/") {
+			// A path to a zoneinfo file.
+			_, name, _ := strings.Cut(tz, "zoneinfo/")
+			return name
+		}
+		return tz
+	}
+	dst, err := os.Readlink("/etc/localtime")
+	if err != nil {
+		return ""
+	}
+	_, name, _ := strings.Cut(dst, "zoneinfo/")
+	return name
+}
+
+// timeZone returns the Hostinfo.TimeZone value to report, or the empty string
+// if it's unknown or not to be reported (see Options.ReportTimeZone).
+func (c *Direct) timeZone() string {
+	if !c.reportTimeZone {
+		return ""
+	}
+	if c.timeZoneFunc == nil {
+		return systemTimeZone()
+	}
+	return c.timeZoneFunc()
+}
+
+// RefreshTimeZone re-evaluates the node's time zone (see Options.TimeZoneFunc)
+// and reports whether the Hostinfo.TimeZone value changed, in which case the
+// new Hostinfo should be sent to control.
+func (c *Direct) RefreshTimeZone() (changed bool) {
+	tz := c.timeZone()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hostinfo.TimeZone == tz {
+		return false
+	}
+	hi := c.hostinfo.Clone()
+	hi.TimeZone = tz
+	c.hostinfo = hi
+	c.logf("[v1] HostInfo.TimeZone: %q", tz)
+	return true
+}
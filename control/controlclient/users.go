@@ -0,0 +1,24 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"tailscale.com/tailcfg"
+)
+
+// UserProfile returns the profile of the user with the given ID, as last
+// sent by control. Control may only send the profiles of users it hasn't sent
+// before, or that changed; the map session keeps them across responses.
+//
+// It reports false if control hasn't sent the profile or no node in the
+// current netmap references the user.
+func (c *Direct) UserProfile(id tailcfg.UserID) (_ tailcfg.UserProfile, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lastNetMap == nil {
+		return tailcfg.UserProfile{}, false
+	}
+	up, ok := c.lastNetMap.UserProfiles[id]
+	return up, ok
+}
@@ -0,0 +1,117 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"context"
+	"testing"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+)
+
+// netmapUpdaterFunc is a NetmapUpdater that calls the func with each full
+// netmap.
+type netmapUpdaterFunc func(*netmap.NetworkMap)
+
+func (f netmapUpdaterFunc) UpdateFullNetmap(nm *netmap.NetworkMap) { f(nm) }
+
+func TestUserProfileCache(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{})
+
+	peer := func(id tailcfg.NodeID, user tailcfg.UserID) *tailcfg.Node {
+		return &tailcfg.Node{ID: id, Key: key.NewNode().Public(), Addresses: testPeerAddresses(id), User: user}
+	}
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{
+			Node:  &tailcfg.Node{ID: 1, User: 10},
+			Peers: []*tailcfg.Node{peer(2, 20), peer(3, 30)},
+			UserProfiles: []tailcfg.UserProfile{
+				{ID: 10, LoginName: "self@example.com"},
+				{ID: 20, LoginName: "alice@example.com"},
+				{ID: 30, LoginName: "bob@example.com"},
+			},
+		})
+		// A delta referencing a known user needn't resend its profile;
+		// it's served from the cache. Updated profiles replace old ones.
+		send(&tailcfg.MapResponse{
+			PeersChanged: []*tailcfg.Node{peer(4, 20)},
+			UserProfiles: []tailcfg.UserProfile{
+				{ID: 30, LoginName: "bob@example.com", DisplayName: "Bob"},
+			},
+		})
+		// Once no node references a user, its profile is evicted.
+		send(&tailcfg.MapResponse{PeersRemoved: []tailcfg.NodeID{3}})
+	})
+
+	wantProfile := func(id tailcfg.UserID, want tailcfg.UserProfile) {
+		t.Helper()
+		got, ok := c.UserProfile(id)
+		if want.ID == 0 {
+			if ok {
+				t.Errorf("UserProfile(%v) = %+v; want not found", id, got)
+			}
+			return
+		}
+		if !ok {
+			t.Errorf("UserProfile(%v) not found; want %+v", id, want)
+		} else if got != want {
+			t.Errorf("UserProfile(%v) = %+v; want %+v", id, got, want)
+		}
+	}
+	self := tailcfg.UserProfile{ID: 10, LoginName: "self@example.com"}
+	alice := tailcfg.UserProfile{ID: 20, LoginName: "alice@example.com"}
+	checks := []func(){
+		func() {
+			wantProfile(10, self)
+			wantProfile(20, alice)
+			wantProfile(30, tailcfg.UserProfile{ID: 30, LoginName: "bob@example.com"})
+			wantProfile(40, tailcfg.UserProfile{})
+		},
+		func() {
+			wantProfile(20, alice)
+			wantProfile(30, tailcfg.UserProfile{ID: 30, LoginName: "bob@example.com", DisplayName: "Bob"})
+		},
+		func() {
+			wantProfile(10, self)
+			wantProfile(20, alice)
+			wantProfile(30, tailcfg.UserProfile{})
+		},
+	}
+	var n int
+	c.PollNetMap(context.Background(), netmapUpdaterFunc(func(*netmap.NetworkMap) {
+		if n < len(checks) {
+			checks[n]()
+		}
+		n++
+	}))
+	if n != len(checks) {
+		t.Errorf("got %d netmaps; want %d", n, len(checks))
+	}
+}
+
+func TestUserProfileRejectedResponse(t *testing.T) {
+	srv := newTestMapServer(t)
+	c := srv.newDirect(Options{ValidateDeltas: true})
+	alice := tailcfg.UserProfile{ID: 20, LoginName: "alice@example.com"}
+	srv.setStream(func(_ *tailcfg.MapRequest, send func(*tailcfg.MapResponse)) {
+		send(&tailcfg.MapResponse{
+			Node:         &tailcfg.Node{ID: 1, User: 20},
+			UserProfiles: []tailcfg.UserProfile{alice},
+		})
+		// A delta that fails validation doesn't update the profiles.
+		send(&tailcfg.MapResponse{
+			PeersRemoved: []tailcfg.NodeID{99},
+			UserProfiles: []tailcfg.UserProfile{{ID: 20, LoginName: "mallory@example.com"}},
+		})
+	})
+	if nms := pollNetMap(t, c); len(nms) != 1 {
+		t.Fatalf("got %d netmaps; want 1", len(nms))
+	}
+	if got, ok := c.UserProfile(20); !ok || got != alice {
+		t.Errorf("UserProfile(20) = %+v, %v; want %+v", got, ok, alice)
+	}
+}
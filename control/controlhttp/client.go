@@ -36,7 +36,6 @@
 	"sync/atomic"
 	"time"
 
-	"tailscale.com/control/controlbase"
 	"tailscale.com/envknob"
 	"tailscale.com/net/dnscache"
 	"tailscale.com/net/dnsfallback"
@@ -74,8 +73,8 @@ func (a *Dialer) logf(format string, args ...any) {
 }
 
 func (a *Dialer) getProxyFunc() func(*http.Request) (*url.URL, error) {
-	if a.proxyFunc != nil {
-		return a.proxyFunc
+	if a.Proxy != nil {
+		return a.Proxy
 	}
 	return tshttpproxy.ProxyFromEnvironment
 }
@@ -363,7 +362,7 @@ type tryURLRes struct {
 
 // dialURL attempts to connect to the given URL.
 func (a *Dialer) dialURL(ctx context.Context, u *url.URL, addr netip.Addr) (*ClientConn, error) {
-	init, cont, err := controlbase.ClientDeferred(a.MachineKey, a.ControlKey, a.ProtocolVersion)
+	init, cont, err := a.clientHandshake()
 	if err != nil {
 		return nil, err
 	}
@@ -426,7 +425,11 @@ func (a *Dialer) tryURLUpgrade(ctx context.Context, u *url.URL, addr netip.Addr,
 	tr := http.DefaultTransport.(*http.Transport).Clone()
 	defer tr.CloseIdleConnections()
 	tr.Proxy = a.getProxyFunc()
-	tshttpproxy.SetTransportGetProxyConnectHeader(tr)
+	if a.ProxyConnectHeader != nil {
+		tr.ProxyConnectHeader = a.ProxyConnectHeader
+	} else {
+		tshttpproxy.SetTransportGetProxyConnectHeader(tr)
+	}
 	tr.DialContext = dnscache.Dialer(dialer, dns)
 	// Disable HTTP2, since h2 can't do protocol switching.
 	tr.TLSClientConfig.NextProtos = []string{}
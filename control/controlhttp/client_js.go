@@ -11,7 +11,6 @@
 	"net/url"
 
 	"nhooyr.io/websocket"
-	"tailscale.com/control/controlbase"
 	"tailscale.com/net/wsconn"
 )
 
@@ -22,7 +21,7 @@ func (d *Dialer) Dial(ctx context.Context) (*ClientConn, error) {
 		return nil, errors.New("required Dialer.Hostname empty")
 	}
 
-	init, cont, err := controlbase.ClientDeferred(d.MachineKey, d.ControlKey, d.ProtocolVersion)
+	init, cont, err := d.clientHandshake()
 	if err != nil {
 		return nil, err
 	}
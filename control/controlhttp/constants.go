@@ -8,6 +8,7 @@
 	"net/url"
 	"time"
 
+	"tailscale.com/control/controlbase"
 	"tailscale.com/health"
 	"tailscale.com/net/dnscache"
 	"tailscale.com/net/netmon"
@@ -41,9 +42,14 @@ type Dialer struct {
 
 	// MachineKey contains the current machine's private key.
 	//
-	// This field is required.
+	// This field is required unless MachineKeySigner is set.
 	MachineKey key.MachinePrivate
 
+	// MachineKeySigner, if non-nil, is used instead of MachineKey for the
+	// operations with the machine private key, for keys that aren't held in
+	// process memory.
+	MachineKeySigner controlbase.MachineKeySigner
+
 	// ControlKey contains the expected public key for the control server.
 	//
 	// This field is required.
@@ -88,7 +94,17 @@ type Dialer struct {
 	// plan before falling back to DNS.
 	DialPlan *tailcfg.ControlDialPlan
 
-	proxyFunc func(*http.Request) (*url.URL, error) // or nil
+	// Proxy, if non-nil, returns the proxy to use for the connection, like
+	// http.Transport.Proxy.
+	//
+	// If not specified, the system proxy configuration is used.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// ProxyConnectHeader, if non-nil, is sent to the proxy in CONNECT
+	// requests, like http.Transport.ProxyConnectHeader.
+	//
+	// If not specified, the system proxy authentication is used.
+	ProxyConnectHeader http.Header
 
 	// For tests only
 	drainFinished        chan struct{}
@@ -106,3 +122,12 @@ func strDef(v1, v2 string) string {
 	}
 	return v2
 }
+
+// clientHandshake starts the client side of the Noise handshake, with
+// MachineKeySigner if set, and otherwise MachineKey.
+func (d *Dialer) clientHandshake() (init []byte, cont controlbase.HandshakeContinuation, err error) {
+	if d.MachineKeySigner != nil {
+		return controlbase.ClientDeferredSigner(d.MachineKeySigner, d.ControlKey, d.ProtocolVersion)
+	}
+	return controlbase.ClientDeferred(d.MachineKey, d.ControlKey, d.ProtocolVersion)
+}
@@ -224,11 +224,11 @@ func testControlHTTP(t *testing.T, param httpTestParam) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		a.proxyFunc = func(*http.Request) (*url.URL, error) {
+		a.Proxy = func(*http.Request) (*url.URL, error) {
 			return proxyURL, nil
 		}
 	} else {
-		a.proxyFunc = func(*http.Request) (*url.URL, error) {
+		a.Proxy = func(*http.Request) (*url.URL, error) {
 			return nil, nil
 		}
 	}
@@ -674,7 +674,7 @@ func TestDialPlan(t *testing.T) {
 				Dialer:               dialer.Dial,
 				Logf:                 t.Logf,
 				DialPlan:             tt.plan,
-				proxyFunc:            func(*http.Request) (*url.URL, error) { return nil, nil },
+				Proxy:                func(*http.Request) (*url.URL, error) { return nil, nil },
 				drainFinished:        drained,
 				omitCertErrorLogging: true,
 				testFallbackDelay:    50 * time.Millisecond,
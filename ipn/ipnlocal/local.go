@@ -1792,6 +1792,7 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		OnClientVersion:            b.onClientVersion,
 		OnTailnetDefaultAutoUpdate: b.onTailnetDefaultAutoUpdate,
 		OnControlTime:              b.em.onControlTime,
+		OnRediscoveryRequested:     b.onRediscoveryRequested,
 		Dialer:                     b.Dialer(),
 		Observer:                   b,
 		C2NHandler:                 http.HandlerFunc(b.handleC2N),
@@ -2554,6 +2555,12 @@ func (b *LocalBackend) onClientVersion(v *tailcfg.ClientVersion) {
 	b.send(ipn.Notify{ClientVersion: v})
 }
 
+// onRediscoveryRequested is called by the control client when control asks
+// for this node's endpoints to be rediscovered.
+func (b *LocalBackend) onRediscoveryRequested() {
+	b.MagicConn().ReSTUN("control-rediscover")
+}
+
 func (b *LocalBackend) onTailnetDefaultAutoUpdate(au bool) {
 	unlock := b.lockAndGetUnlock()
 	defer unlock()
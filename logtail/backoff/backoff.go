@@ -30,6 +30,12 @@ type Backoff struct {
 	// LogLongerThan sets the minimum time of a single backoff interval
 	// before we mention it in the log.
 	LogLongerThan time.Duration
+
+	// Scale, if non-nil, returns a factor by which to multiply each backoff
+	// interval (including the maximum), such as to back off harder on a
+	// poor network link. Factors less than or equal to zero are treated
+	// as 1.
+	Scale func() float64
 }
 
 // NewBackoff returns a new Backoff timer with the provided name (for logging), logger,
@@ -65,6 +71,11 @@ func (b *Backoff) BackOff(ctx context.Context, err error) {
 	if d > b.maxBackoff {
 		d = b.maxBackoff
 	}
+	if b.Scale != nil {
+		if f := b.Scale(); f > 0 {
+			d = time.Duration(float64(d) * f)
+		}
+	}
 	// Randomize the delay between 0.5-1.5 x msec, in order
 	// to prevent accidental "thundering herd" problems.
 	d = time.Duration(float64(d) * (rand.Float64() + 0.5))
@@ -196,6 +196,14 @@ type Client struct {
 	// If false, the default net.Resolver will be used, with no caching.
 	UseDNSCache bool
 
+	// MinDERPSamples, if greater than one, is the number of recent reports
+	// (see addReportHistoryAndSetPreferredDERP) that must include a latency
+	// for a DERP region before PreferredDERP may switch to it. Until then,
+	// the previous PreferredDERP is kept, as long as it's still reachable.
+	// This avoids switching home regions based on a single noisy
+	// measurement. It has no effect on the first choice of PreferredDERP.
+	MinDERPSamples int
+
 	// For tests
 	testEnoughRegions      int
 	testCaptivePortalDelay time.Duration
@@ -1411,6 +1419,8 @@ func (c *Client) addReportHistoryAndSetPreferredDERP(rs *reportState, r *Report,
 
 	// region ID => its best recent latency in last maxAge
 	bestRecent := map[int]time.Duration{}
+	// region ID => number of reports in last maxAge with a latency for it
+	samples := map[int]int{}
 
 	for t, pr := range c.prev {
 		if now.Sub(t) > maxAge {
@@ -1418,6 +1428,7 @@ func (c *Client) addReportHistoryAndSetPreferredDERP(rs *reportState, r *Report,
 			continue
 		}
 		for regionID, d := range pr.RegionLatency {
+			samples[regionID]++
 			if bd, ok := bestRecent[regionID]; !ok || d < bd {
 				bestRecent[regionID] = d
 			}
@@ -1484,6 +1495,10 @@ func (c *Client) addReportHistoryAndSetPreferredDERP(rs *reportState, r *Report,
 	// mechanism, or have a latency (and thus heard back via STUN).
 	oldRegionIsAccessible := oldRegionCurLatency != 0 || heardFromOldRegionRecently
 	if changingPreferred && oldRegionIsAccessible {
+		if samples[r.PreferredDERP] < c.MinDERPSamples {
+			// Not enough measurements of the new region to trust it yet.
+			keepOld = true
+		}
 		// bestAny < any other value, so oldRegionCurLatency - bestAny >= 0
 		if oldRegionCurLatency-bestAny < preferredDERPAbsoluteDiff {
 			// The absolute value of latency difference is below
@@ -281,6 +281,7 @@ type step struct {
 		steps       []step
 		homeParams  *tailcfg.DERPHomeParams
 		opts        *GetReportOpts
+		minSamples  int // Client.MinDERPSamples
 		wantDERP    int // want PreferredDERP on final step
 		wantPrevLen int // wanted len(c.prev)
 	}{
@@ -437,12 +438,53 @@ type step struct {
 			wantPrevLen: 3,
 			wantDERP:    2, // moved to d2 since d1 is gone
 		},
+		{
+			name: "min_samples_first_reading",
+			steps: []step{
+				{0, report("d1", 2, "d2", 3)},
+			},
+			minSamples:  3,
+			wantPrevLen: 1,
+			wantDERP:    1, // nothing to fall back to
+		},
+		{
+			name: "min_samples_no_switch",
+			steps: []step{
+				{0, report("d1", 4)},
+				{1 * time.Second, report("d1", 4, "d2", 1)}, // d2 much faster, but only one sample
+			},
+			minSamples:  2,
+			wantPrevLen: 2,
+			wantDERP:    1,
+		},
+		{
+			name: "min_samples_switch_old_gone",
+			steps: []step{
+				{0, report("d1", 4)},
+				{1 * time.Second, report("d2", 1)}, // d2 unproven, but d1 gone
+			},
+			minSamples:  2,
+			wantPrevLen: 2,
+			wantDERP:    2,
+		},
+		{
+			name: "min_samples_do_switch",
+			steps: []step{
+				{0, report("d1", 4)},
+				{1 * time.Second, report("d1", 4, "d2", 1)},
+				{2 * time.Second, report("d1", 4, "d2", 1)}, // second sample of d2
+			},
+			minSamples:  2,
+			wantPrevLen: 3,
+			wantDERP:    2,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			fakeTime := startTime
 			c := &Client{
-				TimeNow: func() time.Time { return fakeTime },
+				TimeNow:        func() time.Time { return fakeTime },
+				MinDERPSamples: tt.minSamples,
 			}
 			dm := &tailcfg.DERPMap{HomeParams: tt.homeParams}
 			rs := &reportState{
@@ -136,7 +136,17 @@
 //   - 93: 2024-05-06: added support for stateful firewalling.
 //   - 94: 2024-05-06: Client understands Node.IsJailed.
 //   - 95: 2024-05-06: Client uses NodeAttrUserDialUseRoutes to change DNS dialing behavior.
-const CurrentCapabilityVersion CapabilityVersion = 95
+//   - 96: 2026-10-15: Client understands MapResponse.DataPlaneDisabled
+//   - 97: 2026-10-15: Client understands MapResponse.EphemeralTTL
+//   - 98: 2026-10-15: Client understands Node.PreferredEndpoint
+//   - 99: 2026-10-15: Client understands MapResponse.EndpointReportInterval
+//   - 100: 2026-10-15: Client understands MapResponse.RediscoverEndpoints
+//   - 101: 2026-10-15: Client understands NodeAttrReportPeerLatency and sends MapRequest.PeerLatencies
+//   - 102: 2026-10-15: Client understands paginated full peer lists (MapResponse.PeersPageToken)
+//   - 103: 2026-10-15: Client understands MapResponse.DNSRoutesChanged and DNSRoutesRemoved
+//   - 104: 2026-10-15: Client understands MapResponse.PeerCapabilityChange
+//   - 105: 2026-10-15: Client accepts gzip-compressed MapResponses (MapRequest.Compress "gzip")
+const CurrentCapabilityVersion CapabilityVersion = 105
 
 type StableID string
 
@@ -426,6 +436,13 @@ type Node struct {
 	// ExitNodeDNSResolvers is the list of DNS servers that should be used when this
 	// node is marked IsWireGuardOnly and being used as an exit node.
 	ExitNodeDNSResolvers []*dnstype.Resolver `json:",omitempty"`
+
+	// PreferredEndpoint, if non-nil, is a hint from control that this
+	// endpoint (normally one of Endpoints) is likely the best path to the
+	// peer from the current node, for example because control knows both
+	// nodes share a LAN. Clients may try it first. It's only populated for
+	// peers.
+	PreferredEndpoint *netip.AddrPort `json:",omitempty"`
 }
 
 // HasCap reports whether the node has the given capability.
@@ -779,6 +796,39 @@ type Hostinfo struct {
 	// explicitly declared by a node.
 	Location *Location `json:",omitempty"`
 
+	// NodeIdentity, if non-empty, is a stable identifier for this host
+	// derived from a host-provided identity file (such as a cloud instance
+	// ID file). It lets control recognize an ephemeral or immutable host
+	// that was re-created with the same identity. It is the hex-encoded
+	// SHA-256 of the file's contents, so the contents themselves are not sent.
+	NodeIdentity string `json:",omitempty"`
+
+	// AcceptDNS is whether the node uses the DNS configuration from control
+	// (its "accept-dns" preference). It's empty if unknown.
+	AcceptDNS opt.Bool `json:",omitempty"`
+
+	// ClockSource is the detected source of the node's wall clock, such as
+	// "ntp", "chrony", "systemd-timesyncd" or "rtc", for debugging
+	// time-related auth failures. It's empty if unknown.
+	ClockSource string `json:",omitempty"`
+
+	// ClockSynced is whether the node's wall clock is synchronized (for
+	// example, by NTP). It's empty if unknown.
+	ClockSynced opt.Bool `json:",omitempty"`
+
+	// TKAKey is the node's tailnet lock (TKA) signing public key, in the
+	// "nlpub:<hex>" form of key.NLPublic.MarshalText. It's empty if unknown.
+	TKAKey string `json:",omitempty"`
+
+	// TimeZone is the IANA name of the node's local time zone, such as
+	// "Europe/Berlin", for scheduling features that use the node's local
+	// time. It's empty if unknown.
+	TimeZone string `json:",omitempty"`
+
+	// ExitNodeID is the stable ID of the exit node that the node is currently
+	// routing its internet traffic through, if any, for display by control.
+	ExitNodeID StableNodeID `json:",omitempty"`
+
 	// NOTE: any new fields containing pointers in this type
 	//       require changes to Hostinfo.Equal.
 }
@@ -871,6 +921,13 @@ type NetInfo struct {
 	// are not managed by tailscaled.
 	FirewallMode string `json:",omitempty"`
 
+	// PublicIPs are the node's public IP addresses as observed via STUN,
+	// sorted. Unlike endpoints, they have no ports and don't include local
+	// addresses. For privacy, they're normally coarsened to the /24 (IPv4)
+	// or /48 (IPv6) containing each address; otherwise they're single-IP
+	// prefixes.
+	PublicIPs []netip.Prefix `json:",omitempty"`
+
 	// Update BasicallyEqual when adding fields.
 }
 
@@ -930,7 +987,8 @@ func (ni *NetInfo) BasicallyEqual(ni2 *NetInfo) bool {
 		ni.PCP == ni2.PCP &&
 		ni.PreferredDERP == ni2.PreferredDERP &&
 		ni.LinkType == ni2.LinkType &&
-		ni.FirewallMode == ni2.FirewallMode
+		ni.FirewallMode == ni2.FirewallMode &&
+		slices.Equal(ni.PublicIPs, ni2.PublicIPs)
 }
 
 // Equal reports whether h and h2 are equal.
@@ -1215,7 +1273,7 @@ type MapRequest struct {
 	// For current values and history, see the CapabilityVersion type's docs.
 	Version CapabilityVersion
 
-	Compress  string // "zstd" or "" (no compression)
+	Compress  string // "zstd", "gzip", or "" (no compression)
 	KeepAlive bool   // whether server should send keep-alives back to us
 	NodeKey   key.NodePublic
 	DiscoKey  key.DiscoPublic
@@ -1302,8 +1360,61 @@ type MapRequest struct {
 	//     * "warn-router-unhealthy": client's Router implementation is
 	//       having problems.
 	DebugFlags []string `json:",omitempty"`
+
+	// Features lists the optional features this client supports, sorted,
+	// so control can tailor its responses. Unlike DebugFlags, these are
+	// stable; unknown values should be ignored.
+	Features []ClientFeature `json:",omitempty"`
+
+	// PeerLatencies, if non-empty, are the client's aggregated round-trip
+	// latency measurements to peers since its last MapRequest that included
+	// them, sorted by NodeID. They're only sent by clients that opted in, and
+	// only if the node has the NodeAttrReportPeerLatency capability.
+	PeerLatencies []PeerLatency `json:",omitempty"`
+
+	// PeerScope, if non-empty, asks control to send only the peers in the
+	// named visibility scope, for large tailnets where a node doesn't need
+	// to see every peer. Control may ignore it if it doesn't support scopes
+	// or the scope isn't permitted. Either way, each full netmap's Peers is
+	// the complete set of peers visible to the node.
+	PeerScope string `json:",omitempty"`
+
+	// Attestation, if non-empty, is an opaque hardware attestation (such as
+	// from a TPM or secure enclave) with which control can verify that
+	// NodeKey is hardware-bound. Its format depends on the platform.
+	Attestation []byte `json:",omitempty"`
 }
 
+// PeerLatency is a client's aggregated round-trip latency measurements to a
+// peer, as sent in MapRequest.PeerLatencies.
+type PeerLatency struct {
+	NodeID  NodeID
+	Samples int           // number of measurements aggregated
+	P50     time.Duration // median round-trip time
+	P95     time.Duration // 95th percentile round-trip time
+}
+
+// ClientFeature is an optional client feature advertised to control in
+// MapRequest.Features.
+type ClientFeature string
+
+const (
+	// ClientFeatureDeltaDERPMap means the client merges a DERPMap sent in a
+	// MapResponse into its previous one rather than replacing it.
+	ClientFeatureDeltaDERPMap ClientFeature = "delta-derpmap"
+
+	// ClientFeatureCompressedUploads means the client zstd-compresses the
+	// data it uploads, such as its logs.
+	ClientFeatureCompressedUploads ClientFeature = "compressed-uploads"
+
+	// ClientFeatureSSH means the client can run a Tailscale SSH server.
+	ClientFeatureSSH ClientFeature = "ssh"
+
+	// ClientFeatureExitNode means the client offers to act as an exit node:
+	// its Hostinfo.RoutableIPs include the exit routes.
+	ClientFeatureExitNode ClientFeature = "exit-node"
+)
+
 // PortRange represents a range of UDP or TCP port numbers.
 type PortRange struct {
 	First uint16
@@ -1805,6 +1916,13 @@ type MapResponse struct {
 	// OnlineChange changes the value of a Peer Node.Online value.
 	OnlineChange map[NodeID]bool `json:",omitempty"`
 
+	// PeerCapabilityChange sets the capabilities of peers without resending
+	// their full Node: each listed peer's Node.CapMap is replaced by the
+	// given capabilities, keeping the values of any it already had. It's
+	// applied after PeersChanged and PeersRemoved, so it doesn't re-add a
+	// peer removed in the same response.
+	PeerCapabilityChange map[NodeID][]NodeCapability `json:",omitempty"`
+
 	// DNSConfig contains the DNS settings for the client to use.
 	// A nil value means no change from an earlier non-nil value.
 	DNSConfig *DNSConfig `json:",omitempty"`
@@ -1923,6 +2041,55 @@ type MapResponse struct {
 	// MaxKeyDuration describes the MaxKeyDuration setting for the tailnet.
 	// If zero, the value is unchanged.
 	MaxKeyDuration time.Duration `json:",omitempty"`
+
+	// DataPlaneDisabled, if true, tells the node to stay registered and keep
+	// its configuration current but to carry no traffic (for example, while
+	// the node is under a compliance hold). While disabled, the client stops
+	// reporting its endpoints. If unset, the most recent non-empty value in
+	// the HTTP response stream is used.
+	DataPlaneDisabled opt.Bool `json:",omitempty"`
+
+	// EphemeralTTL, if non-zero, is how long after going offline this
+	// ephemeral node will be automatically removed from the tailnet. It's
+	// informational, for observability on the client. If zero, the value is
+	// unchanged.
+	EphemeralTTL time.Duration `json:",omitempty"`
+
+	// EndpointReportInterval, if positive, is the minimum time the client
+	// should wait between map requests sent just to report changed endpoints,
+	// so control can reduce their rate when it's under load. A negative
+	// value removes any limit. If zero, the value is unchanged.
+	EndpointReportInterval time.Duration `json:",omitempty"`
+
+	// RediscoverEndpoints, if non-empty, asks the client to immediately
+	// rediscover its endpoints (re-STUN and report any changes), such as when
+	// control suspects they're stale after a DERP region outage. The value is
+	// an opaque ID for the request; the client acts once per distinct value,
+	// so control may keep sending the same one without repeated rediscovery.
+	RediscoverEndpoints string `json:",omitempty"`
+
+	// DNSRoutesChanged, if non-nil, is a delta to the current
+	// DNSConfig.Routes, to avoid resending large split DNS route tables:
+	// each entry adds or replaces the resolvers for that suffix, leaving the
+	// other routes unchanged. It's applied after DNSConfig, if also set.
+	DNSRoutesChanged map[string][]*dnstype.Resolver `json:",omitempty"`
+
+	// DNSRoutesRemoved, if non-empty, are suffixes to remove from the
+	// current DNSConfig.Routes. They're applied after DNSRoutesChanged.
+	DNSRoutesRemoved []string `json:",omitempty"`
+
+	// PeersPageToken, if non-empty, means that Peers is one page of a full
+	// peer list that control splits over several responses, such as for
+	// very large tailnets. All pages of a list have the same token, and the
+	// client only applies the list once it has the last one (see
+	// PeersMorePages). The netmap fields other than Peers should only be
+	// sent on the last page. Any response with a different (or no) token
+	// before the last page abandons the partial list.
+	PeersPageToken string `json:",omitempty"`
+
+	// PeersMorePages is whether more pages of the peer list identified by
+	// PeersPageToken follow this response.
+	PeersMorePages bool `json:",omitempty"`
 }
 
 // ClientVersion is information about the latest client version that's available
@@ -2054,7 +2221,8 @@ func (n *Node) Equal(n2 *Node) bool {
 		eqPtr(n.SelfNodeV4MasqAddrForThisPeer, n2.SelfNodeV4MasqAddrForThisPeer) &&
 		eqPtr(n.SelfNodeV6MasqAddrForThisPeer, n2.SelfNodeV6MasqAddrForThisPeer) &&
 		n.IsWireGuardOnly == n2.IsWireGuardOnly &&
-		n.IsJailed == n2.IsJailed
+		n.IsJailed == n2.IsJailed &&
+		eqPtr(n.PreferredEndpoint, n2.PreferredEndpoint)
 }
 
 func eqPtr[T comparable](a, b *T) bool {
@@ -2274,6 +2442,10 @@ type Oauth2Token struct {
 	// depending on the destination address and the configured routes. When present, it also makes
 	// the DNS forwarder use UserDial instead of SystemDial when dialing resolvers.
 	NodeAttrUserDialUseRoutes NodeCapability = "user-dial-routes"
+
+	// NodeAttrReportPeerLatency permits the client to report its measured
+	// latencies to peers in MapRequest.PeerLatencies, if it opted in.
+	NodeAttrReportPeerLatency NodeCapability = "report-peer-latency"
 )
 
 // SetDNSRequest is a request to add a DNS record.
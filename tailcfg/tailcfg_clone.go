@@ -80,6 +80,9 @@ func (src *Node) Clone() *Node {
 			dst.ExitNodeDNSResolvers[i] = src.ExitNodeDNSResolvers[i].Clone()
 		}
 	}
+	if dst.PreferredEndpoint != nil {
+		dst.PreferredEndpoint = ptr.To(*src.PreferredEndpoint)
+	}
 	return dst
 }
 
@@ -120,6 +123,7 @@ func (src *Node) Clone() *Node {
 	IsWireGuardOnly               bool
 	IsJailed                      bool
 	ExitNodeDNSResolvers          []*dnstype.Resolver
+	PreferredEndpoint             *netip.AddrPort
 }{})
 
 // Clone makes a deep copy of Hostinfo.
@@ -180,6 +184,13 @@ func (src *Hostinfo) Clone() *Hostinfo {
 	UserspaceRouter opt.Bool
 	AppConnector    opt.Bool
 	Location        *Location
+	NodeIdentity    string
+	AcceptDNS       opt.Bool
+	ClockSource     string
+	ClockSynced     opt.Bool
+	TKAKey          string
+	TimeZone        string
+	ExitNodeID      StableNodeID
 }{})
 
 // Clone makes a deep copy of NetInfo.
@@ -191,6 +202,7 @@ func (src *NetInfo) Clone() *NetInfo {
 	dst := new(NetInfo)
 	*dst = *src
 	dst.DERPLatency = maps.Clone(src.DERPLatency)
+	dst.PublicIPs = append(src.PublicIPs[:0:0], src.PublicIPs...)
 	return dst
 }
 
@@ -210,6 +222,7 @@ func (src *NetInfo) Clone() *NetInfo {
 	LinkType              string
 	DERPLatency           map[string]float64
 	FirewallMode          string
+	PublicIPs             []netip.Prefix
 }{})
 
 // Clone makes a deep copy of Login.
@@ -199,6 +199,14 @@ func (v NodeView) IsJailed() bool        { return v.ж.IsJailed }
 func (v NodeView) ExitNodeDNSResolvers() views.SliceView[*dnstype.Resolver, dnstype.ResolverView] {
 	return views.SliceOfViews[*dnstype.Resolver, dnstype.ResolverView](v.ж.ExitNodeDNSResolvers)
 }
+func (v NodeView) PreferredEndpoint() *netip.AddrPort {
+	if v.ж.PreferredEndpoint == nil {
+		return nil
+	}
+	x := *v.ж.PreferredEndpoint
+	return &x
+}
+
 func (v NodeView) Equal(v2 NodeView) bool { return v.ж.Equal(v2.ж) }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
@@ -238,6 +246,7 @@ func (v NodeView) Equal(v2 NodeView) bool { return v.ж.Equal(v2.ж) }
 	IsWireGuardOnly               bool
 	IsJailed                      bool
 	ExitNodeDNSResolvers          []*dnstype.Resolver
+	PreferredEndpoint             *netip.AddrPort
 }{})
 
 // View returns a readonly view of Hostinfo.
@@ -328,6 +337,13 @@ func (v HostinfoView) Location() *Location {
 	return &x
 }
 
+func (v HostinfoView) NodeIdentity() string       { return v.ж.NodeIdentity }
+func (v HostinfoView) AcceptDNS() opt.Bool        { return v.ж.AcceptDNS }
+func (v HostinfoView) ClockSource() string        { return v.ж.ClockSource }
+func (v HostinfoView) ClockSynced() opt.Bool      { return v.ж.ClockSynced }
+func (v HostinfoView) TKAKey() string             { return v.ж.TKAKey }
+func (v HostinfoView) TimeZone() string           { return v.ж.TimeZone }
+func (v HostinfoView) ExitNodeID() StableNodeID   { return v.ж.ExitNodeID }
 func (v HostinfoView) Equal(v2 HostinfoView) bool { return v.ж.Equal(v2.ж) }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
@@ -368,6 +384,13 @@ func (v HostinfoView) Equal(v2 HostinfoView) bool { return v.ж.Equal(v2.ж) }
 	UserspaceRouter opt.Bool
 	AppConnector    opt.Bool
 	Location        *Location
+	NodeIdentity    string
+	AcceptDNS       opt.Bool
+	ClockSource     string
+	ClockSynced     opt.Bool
+	TKAKey          string
+	TimeZone        string
+	ExitNodeID      StableNodeID
 }{})
 
 // View returns a readonly view of NetInfo.
@@ -430,6 +453,7 @@ func (v NetInfoView) LinkType() string                { return v.ж.LinkType }
 
 func (v NetInfoView) DERPLatency() views.Map[string, float64] { return views.MapOf(v.ж.DERPLatency) }
 func (v NetInfoView) FirewallMode() string                    { return v.ж.FirewallMode }
+func (v NetInfoView) PublicIPs() views.Slice[netip.Prefix]    { return views.SliceOf(v.ж.PublicIPs) }
 func (v NetInfoView) String() string                          { return v.ж.String() }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
@@ -448,6 +472,7 @@ func (v NetInfoView) String() string                          { return v.ж.Stri
 	LinkType              string
 	DERPLatency           map[string]float64
 	FirewallMode          string
+	PublicIPs             []netip.Prefix
 }{})
 
 // View returns a readonly view of Login.
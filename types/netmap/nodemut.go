@@ -158,6 +158,8 @@ func mapResponseContainsNonPatchFields(res *tailcfg.MapResponse) bool {
 	return res.Node != nil ||
 		res.DERPMap != nil ||
 		res.DNSConfig != nil ||
+		res.DNSRoutesChanged != nil ||
+		res.DNSRoutesRemoved != nil ||
 		res.Domain != "" ||
 		res.CollectServices != "" ||
 		res.PacketFilter != nil ||
@@ -172,6 +174,7 @@ func mapResponseContainsNonPatchFields(res *tailcfg.MapResponse) bool {
 		res.ClientVersion != nil ||
 		res.Peers != nil ||
 		res.PeersRemoved != nil ||
+		res.PeerCapabilityChange != nil ||
 		// PeersChanged is too coarse to be considered a patch. Also, we convert
 		// PeersChanged to PeersChangedPatch in patchifyPeersChanged before this
 		// function is called, so it should never be set anyway. But for
@@ -392,6 +392,11 @@ type Options struct {
 	// DisablePortMapper, if true, disables the portmapper.
 	// This is primarily useful in tests.
 	DisablePortMapper bool
+
+	// MinDERPSamples, if greater than one, is how many netcheck reports
+	// must measure a DERP region before it can become the home region,
+	// while the current one is reachable. See netcheck.Client.MinDERPSamples.
+	MinDERPSamples int
 }
 
 func (o *Options) logf() logger.Logf {
@@ -492,6 +497,7 @@ func NewConn(opts Options) (*Conn, error) {
 		SkipExternalNetwork: inTest(),
 		PortMapper:          c.portMapper,
 		UseDNSCache:         true,
+		MinDERPSamples:      opts.MinDERPSamples,
 	}
 
 	if d4, err := c.listenRawDisco("ip4"); err == nil {
@@ -221,6 +221,11 @@ type Config struct {
 	// DriveForLocal, if populated, will cause the engine to expose a Taildrive
 	// listener at 100.100.100.100:8080.
 	DriveForLocal drive.FileSystemForLocal
+
+	// MinDERPSamples optionally sets how many netcheck reports must measure
+	// a DERP region before it can become the home region.
+	// See magicsock.Options.MinDERPSamples.
+	MinDERPSamples int
 }
 
 // NewFakeUserspaceEngine returns a new userspace engine for testing.
@@ -388,6 +393,7 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		ControlKnobs:     conf.ControlKnobs,
 		OnPortUpdate:     onPortUpdate,
 		PeerByKeyFunc:    e.PeerByKey,
+		MinDERPSamples:   conf.MinDERPSamples,
 	}
 
 	var err error